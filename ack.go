@@ -0,0 +1,302 @@
+package hl7
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Acknowledgment codes, as found in MSA-1. The "A" codes are used in original
+// mode and for application acknowledgments in enhanced mode, and the "C" codes
+// are used for accept acknowledgments in enhanced mode.
+const (
+	AckAccept       = "AA" // Application accept
+	AckError        = "AE" // Application error
+	AckReject       = "AR" // Application reject
+	AckCommitAccept = "CA" // Commit accept
+	AckCommitError  = "CE" // Commit error
+	AckCommitReject = "CR" // Commit reject
+)
+
+// ErrInvalidAckCode is used to represent the case where an acknowledgment code
+// is not one of the codes defined by the standard.
+var ErrInvalidAckCode = errors.New("invalid acknowledgment code")
+
+// ErrNotAck is used to represent the case where a message that was expected
+// to be an acknowledgment does not have an MSA segment.
+var ErrNotAck = errors.New("message is not an acknowledgment")
+
+// AckResult describes an acknowledgment message.
+type AckResult struct {
+	Code      string     // The acknowledgment code (MSA-1).
+	ControlID string     // The control ID of the message being acknowledged (MSA-2).
+	Text      string     // The text message (MSA-3), if any.
+	Errors    []AckIssue // The contents of any ERR segments.
+	Message   *Message   // The acknowledgment message itself.
+
+	// ExpectedSequence is the sequence number the receiver expects next
+	// (MSA-4), or zero if there is none. See SequenceTracker.
+	ExpectedSequence int64
+}
+
+// AckIssue describes a single ERR segment within an acknowledgment.
+//
+// When generating acknowledgments, the Location is written to ERR-2 (or ERR-1
+// for versions before 2.5) with any "^" characters taken as component
+// separators, for example "PID^1^3" for the third field of the first PID
+// segment. The Code should be taken from HL7 table 0357, such as "101" for a
+// missing required field or "207" for an application internal error.
+type AckIssue struct {
+	Location string // The error location (ERR-2), or ERR-1 for versions before 2.5.
+	Code     string // The identifier of the error code (ERR-3.1).
+	Text     string // The text of the error code (ERR-3.2).
+	Severity string // The severity (ERR-4), such as "E", "W" or "I".
+	Message  string // The user message (ERR-8), if any.
+}
+
+// OK reports whether the acknowledgment is positive (AA or CA).
+func (r *AckResult) OK() bool {
+	return r.Code == AckAccept || r.Code == AckCommitAccept
+}
+
+// ParseAck is used to read the details of an acknowledgment message.
+// ErrNotAck is returned if the message does not have an MSA segment.
+func ParseAck(msg *Message) (*AckResult, error) {
+	msa, ok := msg.Segment("MSA")
+
+	if !ok {
+		return nil, ErrNotAck
+	}
+	r := AckResult{
+		Code:      fieldString(msa, 1, 0),
+		ControlID: fieldString(msa, 2, 0),
+		Text:      fieldString(msa, 3, 0),
+		Message:   msg,
+	}
+	if seq := fieldString(msa, 4, 0); seq != "" {
+		r.ExpectedSequence, _ = strconv.ParseInt(seq, 10, 64)
+	}
+	for _, seg := range msg.Segments("ERR") {
+		issue := AckIssue{
+			Location: fieldComponents(seg, 2),
+			Code:     fieldString(seg, 3, 0),
+			Text:     fieldString(seg, 3, 1),
+			Severity: fieldString(seg, 4, 0),
+			Message:  fieldString(seg, 8, 0),
+		}
+		if issue.Location == "" {
+			issue.Location = fieldComponents(seg, 1)
+		}
+		r.Errors = append(r.Errors, issue)
+	}
+	return &r, nil
+}
+
+// fieldString returns the string value of the first repetition of the given
+// field and component within the segment, or an empty string if there isn't
+// one.
+func fieldString(seg Segment, field, comp int) string {
+	if sub, ok := seg.GetSubComponent(field, 0, comp, 0); ok {
+		return sub.String()
+	}
+	return ""
+}
+
+// fieldComponents returns the first repetition of the given field within the
+// segment, with the components joined by "^" characters. Only the first
+// sub-component of each component is used.
+func fieldComponents(seg Segment, field int) string {
+	f, ok := seg.GetField(field, 0)
+
+	if !ok {
+		return ""
+	}
+	comps := make([]string, len(f))
+
+	for i := range f {
+		if sub, ok := f.GetSubComponent(i, 0); ok {
+			comps[i] = sub.String()
+		}
+	}
+	return strings.Join(comps, "^")
+}
+
+// AckOptions is used to customize the acknowledgments generated by
+// Message.Ack. All of the fields are optional.
+type AckOptions struct {
+	ControlID string     // The control ID of the acknowledgment (MSH-10). Generated if empty.
+	Time      time.Time  // The date/time of the acknowledgment (MSH-7). The current time if zero.
+	Text      string     // A text message to include in MSA-3.
+	Errors    []AckIssue // Errors to include as ERR segments.
+
+	// ExpectedSequence is the sequence number to include in MSA-4, for the
+	// sequence number protocol (see SequenceTracker). Omitted if zero.
+	ExpectedSequence int64
+}
+
+// controlIDCounter is used to make generated control IDs unique within the
+// process.
+var controlIDCounter uint32
+
+// NewControlID returns a new message control ID, made up of the current time
+// and a counter so that it is unique within the process. The result is 20
+// characters long, which is the longest control ID allowed by older versions
+// of the standard.
+func NewControlID() string {
+	n := atomic.AddUint32(&controlIDCounter, 1) % 1000000
+	return fmt.Sprintf("%s%06d", time.Now().Format("20060102150405"), n)
+}
+
+// Ack is used to generate an acknowledgment for the message with the given
+// code (AA, AE or AR, or CA, CE or CR for accept acknowledgments in enhanced
+// mode). opts may be nil.
+//
+// The acknowledgment uses the same delimiters, processing ID (MSH-11) and
+// version (MSH-12) as the message. The sending and receiving applications and
+// facilities are swapped, MSH-9 is set to "ACK^<trigger event>^ACK" (without
+// the message structure for versions before 2.3.1), and the message's control
+// ID is copied into MSA-2. ERR segments are written in the format appropriate
+// for the message's version.
+func (m *Message) Ack(code string, opts *AckOptions) (*Message, error) {
+	switch code {
+	case AckAccept, AckError, AckReject, AckCommitAccept, AckCommitError, AckCommitReject:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAckCode, code)
+	}
+	if opts == nil {
+		opts = &AckOptions{}
+	}
+	h := headerFields(m.data)
+
+	if len(h) < 3 || !bytes.Equal(h[0], []byte("MSH")) {
+		return nil, ErrInvalidHeader
+	}
+	var (
+		version   = firstComponent(indexField(h, 12), m.compSep)
+		trigger   = component(indexField(h, 9), m.compSep, 1)
+		controlID = opts.ControlID
+		ts        = opts.Time
+		b         bytes.Buffer
+	)
+	if controlID == "" {
+		controlID = NewControlID()
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	msgType := "ACK"
+
+	if trigger != "" {
+		msgType += string(m.compSep) + trigger
+	}
+	if versionAtLeast(version, "2.3.1") {
+		msgType += string(m.compSep) + "ACK"
+	}
+	esc := func(str string) string {
+		return escapeString(str, m.fieldSep, m.compSep, m.repeat, m.escape, m.subCompSep)
+	}
+	writeSegment := func(fields ...string) {
+		// Drop trailing empty fields, which are not needed.
+		for len(fields) > 1 && fields[len(fields)-1] == "" {
+			fields = fields[:len(fields)-1]
+		}
+		b.WriteString(strings.Join(fields, string(m.fieldSep)))
+		b.WriteByte(CR)
+	}
+
+	writeSegment(
+		"MSH"+string(h[1])+string(h[2]),
+		string(indexField(h, 5)),
+		string(indexField(h, 6)),
+		string(indexField(h, 3)),
+		string(indexField(h, 4)),
+		ts.Format("20060102150405-0700"),
+		"",
+		msgType,
+		esc(controlID),
+		string(indexField(h, 11)),
+		string(indexField(h, 12)),
+	)
+	expected := ""
+
+	if opts.ExpectedSequence != 0 {
+		expected = strconv.FormatInt(opts.ExpectedSequence, 10)
+	}
+	writeSegment("MSA", code, string(indexField(h, 10)), esc(opts.Text), expected)
+
+	for _, issue := range opts.Errors {
+		var locParts []string
+
+		for _, part := range strings.Split(issue.Location, "^") {
+			locParts = append(locParts, esc(part))
+		}
+		location := strings.Join(locParts, string(m.compSep))
+		errCode := ""
+
+		if issue.Code != "" {
+			errCode = strings.Join([]string{esc(issue.Code), esc(issue.Text), "HL70357"}, string(m.compSep))
+		}
+
+		if !versionAtLeast(version, "2.5") {
+			// Before 2.5, ERR-1 contains the location with the error code as
+			// its fourth component.
+			for len(locParts) < 3 {
+				locParts = append(locParts, "")
+			}
+			errCode = strings.Replace(errCode, string(m.compSep), string(m.subCompSep), -1)
+			writeSegment("ERR", strings.Join(append(locParts[:3], errCode), string(m.compSep)))
+			continue
+		}
+		severity := issue.Severity
+
+		if severity == "" {
+			severity = "E"
+		}
+		writeSegment("ERR", "", location, errCode, esc(severity), "", "", "", esc(issue.Message))
+	}
+	return NewMessage(b.Bytes())
+}
+
+// component returns the component at the given index of a raw field.
+func component(field []byte, compSep byte, idx int) string {
+	parts := bytes.Split(field, []byte{compSep})
+
+	if idx < len(parts) {
+		return string(parts[idx])
+	}
+	return ""
+}
+
+func firstComponent(field []byte, compSep byte) string {
+	return component(field, compSep, 0)
+}
+
+// versionAtLeast reports whether the HL7 version (such as "2.5.1") is the
+// same as or later than min. Unknown versions are assumed to be recent.
+func versionAtLeast(version, min string) bool {
+	if version == "" {
+		return true
+	}
+	v := strings.Split(version, ".")
+	m := strings.Split(min, ".")
+
+	for i := 0; i < len(m); i++ {
+		if i >= len(v) {
+			return false
+		}
+		a, errA := strconv.Atoi(v[i])
+		b, errB := strconv.Atoi(m[i])
+
+		if errA != nil || errB != nil {
+			return true
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
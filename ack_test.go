@@ -0,0 +1,207 @@
+package hl7
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAck(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *AckResult
+		wantErr error
+	}{
+		{"not an ack", "MSH|^~\\&|||||||ADT^A01|1|P|2.5\rPID|1", nil, ErrNotAck},
+		{
+			"accept",
+			"MSH|^~\\&|||||||ACK^A01^ACK|2|P|2.5\rMSA|AA|1",
+			&AckResult{Code: "AA", ControlID: "1"},
+			nil,
+		},
+		{
+			"error (v2.5)",
+			"MSH|^~\\&|||||||ACK|2|P|2.5\rMSA|AE|1\rERR||PID^1^3|101^Required field missing^HL70357|E||||Patient ID is required",
+			&AckResult{
+				Code:      "AE",
+				ControlID: "1",
+				Errors: []AckIssue{{
+					Location: "PID^1^3",
+					Code:     "101",
+					Text:     "Required field missing",
+					Severity: "E",
+					Message:  "Patient ID is required",
+				}},
+			},
+			nil,
+		},
+		{
+			"reject (v2.3)",
+			"MSH|^~\\&|||||||ACK|2|P|2.3\rMSA|AR|1|Unsupported \\T\\ unknown\rERR|MSH^1^9^200",
+			&AckResult{
+				Code:      "AR",
+				ControlID: "1",
+				Text:      "Unsupported & unknown",
+				Errors:    []AckIssue{{Location: "MSH^1^9^200"}},
+			},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := NewMessage([]byte(tt.data))
+			got, err := ParseAck(msg)
+
+			assert.Equal(t, tt.wantErr, err)
+
+			if tt.want != nil {
+				tt.want.Message = msg
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAckResultOK(t *testing.T) {
+	for code, want := range map[string]bool{"AA": true, "CA": true, "AE": false, "AR": false, "CE": false, "CR": false, "": false} {
+		assert.Equal(t, want, (&AckResult{Code: code}).OK(), code)
+	}
+}
+
+func TestMessageAck(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", -5*60*60))
+
+	tests := []struct {
+		name string
+		data string
+		code string
+		opts *AckOptions
+		want string
+	}{
+		{
+			"accept (v2.5)",
+			"MSH|^~\\&|SendApp|SendFac|RecvApp|RecvFac|20200101||ADT^A01^ADT_A01|MSG1|P|2.5\rPID|1",
+			AckAccept,
+			&AckOptions{ControlID: "ACK1", Time: ts},
+			"MSH|^~\\&|RecvApp|RecvFac|SendApp|SendFac|20200102030405-0500||ACK^A01^ACK|ACK1|P|2.5\rMSA|AA|MSG1\r",
+		},
+		{
+			"accept (v2.3)",
+			"MSH|^~\\&|SendApp|SendFac|RecvApp|RecvFac|20200101||ADT^A01|MSG1|T|2.3\rPID|1",
+			AckAccept,
+			&AckOptions{ControlID: "ACK1", Time: ts},
+			"MSH|^~\\&|RecvApp|RecvFac|SendApp|SendFac|20200102030405-0500||ACK^A01|ACK1|T|2.3\rMSA|AA|MSG1\r",
+		},
+		{
+			"custom delimiters",
+			"MSH#*@\\%#SendApp#SendFac#RecvApp#RecvFac#20200101##ORU*R01*ORU_R01#MSG1#P#2.5.1",
+			AckCommitAccept,
+			&AckOptions{ControlID: "ACK1", Time: ts},
+			"MSH#*@\\%#RecvApp#RecvFac#SendApp#SendFac#20200102030405-0500##ACK*R01*ACK#ACK1#P#2.5.1\rMSA#CA#MSG1\r",
+		},
+		{
+			"error (v2.5)",
+			"MSH|^~\\&|SendApp|SendFac|RecvApp|RecvFac|20200101||ADT^A01^ADT_A01|MSG1|P|2.5",
+			AckError,
+			&AckOptions{
+				ControlID: "ACK1",
+				Time:      ts,
+				Text:      "Patient ID | MRN missing",
+				Errors: []AckIssue{
+					{Location: "PID^1^3", Code: "101", Text: "Required field missing", Message: "MRN is required"},
+					{Code: "207", Severity: "W"},
+				},
+			},
+			"MSH|^~\\&|RecvApp|RecvFac|SendApp|SendFac|20200102030405-0500||ACK^A01^ACK|ACK1|P|2.5\r" +
+				"MSA|AE|MSG1|Patient ID \\F\\ MRN missing\r" +
+				"ERR||PID^1^3|101^Required field missing^HL70357|E||||MRN is required\r" +
+				"ERR|||207^^HL70357|W\r",
+		},
+		{
+			"reject (v2.4)",
+			"MSH|^~\\&|SendApp|SendFac|RecvApp|RecvFac|20200101||ADT^A01^ADT_A01|MSG1|P|2.4",
+			AckReject,
+			&AckOptions{
+				ControlID: "ACK1",
+				Time:      ts,
+				Errors:    []AckIssue{{Location: "MSH^1^12", Code: "203", Text: "Unsupported version ID"}},
+			},
+			"MSH|^~\\&|RecvApp|RecvFac|SendApp|SendFac|20200102030405-0500||ACK^A01^ACK|ACK1|P|2.4\r" +
+				"MSA|AR|MSG1\r" +
+				"ERR|MSH^1^12^203&Unsupported version ID&HL70357\r",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := NewMessage([]byte(tt.data))
+			ack, err := msg.Ack(tt.code, tt.opts)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, string(ack.Bytes()))
+
+			// The generated acknowledgment should make sense to ParseAck.
+			result, err := ParseAck(ack)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, result.Code)
+			assert.Equal(t, "MSG1", result.ControlID)
+		})
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		msg, _ := NewMessage([]byte("MSH|^~\\&|A|B|C|D|20200101||ADT^A01|MSG1|P|2.5"))
+		ack, err := msg.Ack(AckAccept, nil)
+		assert.Nil(t, err)
+
+		h := headerFields(ack.Bytes())
+		assert.Regexp(t, regexp.MustCompile(`^\d{20}$`), string(h[10]))
+		_, err = SubComponent(h[7][:14]).Time()
+		assert.Nil(t, err)
+	})
+
+	t.Run("invalid code", func(t *testing.T) {
+		msg, _ := NewMessage([]byte("MSH|^~\\&|A|B|C|D|20200101||ADT^A01|MSG1|P|2.5"))
+		_, err := msg.Ack("XX", nil)
+		assert.True(t, errors.Is(err, ErrInvalidAckCode))
+	})
+
+	t.Run("invalid header", func(t *testing.T) {
+		msg, _ := NewMessage([]byte("PID|^~\\&|1"))
+		_, err := msg.Ack(AckAccept, nil)
+		assert.Equal(t, ErrInvalidHeader, err)
+	})
+}
+
+func TestNewControlID(t *testing.T) {
+	seen := map[string]bool{}
+
+	for i := 0; i < 1000; i++ {
+		id := NewControlID()
+		assert.Len(t, id, 20)
+		assert.False(t, seen[id])
+		seen[id] = true
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		min     string
+		want    bool
+	}{
+		{"2.5", "2.5", true},
+		{"2.5.1", "2.5", true},
+		{"2.4", "2.5", false},
+		{"2.3", "2.3.1", false},
+		{"2.3.1", "2.3.1", true},
+		{"2.10", "2.5", true},
+		{"", "2.5", true},
+		{"garbage", "2.5", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, versionAtLeast(tt.version, tt.min), tt.version+" >= "+tt.min)
+	}
+}
@@ -0,0 +1,360 @@
+package hl7
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults used by Client when the corresponding fields are not set.
+const (
+	DefaultAckTimeout      = 30 * time.Second
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultMaxRetryBackoff = 30 * time.Second
+)
+
+// ErrNoControlID is used to represent the case where a message being sent has
+// no control ID (MSH-10), so there is no way to match up its acknowledgment.
+var ErrNoControlID = errors.New("message has no control ID")
+
+// NegativeAckError is returned by Client.Send when the receiver acknowledged a
+// message with anything other than AA or CA.
+type NegativeAckError struct {
+	Ack *AckResult
+}
+
+func (e *NegativeAckError) Error() string {
+	msg := fmt.Sprintf("negative acknowledgment %s for message %q", e.Ack.Code, e.Ack.ControlID)
+
+	if e.Ack.Text != "" {
+		return msg + ": " + e.Ack.Text
+	}
+	for _, issue := range e.Ack.Errors {
+		if issue.Message != "" {
+			return msg + ": " + issue.Message
+		}
+		if issue.Text != "" {
+			return msg + ": " + issue.Text
+		}
+	}
+	return msg
+}
+
+// Client is used to send messages to an MLLP endpoint and wait for their
+// acknowledgments. The connection is opened on the first call to Send and kept
+// open between messages; if it breaks, a new one is dialed. A Client is safe
+// to use from multiple goroutines, but messages are sent one at a time since
+// MLLP does not allow more than one message to be outstanding on a connection.
+type Client struct {
+	Addr string // The TCP address to connect to.
+
+	// Dialer is used to open connections. If nil, a zero net.Dialer is used.
+	Dialer *net.Dialer
+
+	// TLSConfig, if set, is used to connect using TLS. If ServerName is empty,
+	// the host in Addr is used. To present a client certificate, set
+	// Certificates.
+	TLSConfig *tls.Config
+
+	// AckTimeout is how long to wait for an acknowledgment after sending a
+	// message. Zero means DefaultAckTimeout.
+	AckTimeout time.Duration
+
+	// WriteTimeout is the maximum duration for writing a message. Zero means
+	// no timeout.
+	WriteTimeout time.Duration
+
+	// MaxRetries is the number of times a message is sent again after a
+	// timeout, a connection error or a negative acknowledgment. Zero means
+	// messages are only sent once.
+	MaxRetries int
+
+	// RetryBackoff is how long to wait before the first retry. It doubles after
+	// each attempt, up to MaxRetryBackoff. Zero means DefaultRetryBackoff and
+	// DefaultMaxRetryBackoff respectively.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// Sequence, if set, is used to number messages using the sequence number
+	// protocol (see SequenceTracker). Each message is sent with the next
+	// sequence number for Addr in MSH-13; if that is not known yet, the
+	// receiver is asked for it first, by sending the message with a sequence
+	// number of -1 and a new control ID, so that the query is not mistaken for
+	// the message itself (by a DuplicateDetector, say). If the receiver rejects
+	// a message and says it expects a different sequence number, that is used
+	// for the next attempt.
+	Sequence *SequenceTracker
+
+	// ApplicationAcks, if set, is used to track application acknowledgments
+	// for messages sent in enhanced acknowledgment mode. The control ID of each
+	// such message is registered with it before sending (unless MSH-16 is NE,
+	// since no application acknowledgment will come), and any application
+	// acknowledgments that arrive on this connection (rather than on a separate
+	// one) are delivered to it. A control ID stays registered until it is
+	// waited for, so Wait should be called for every message that is sent.
+	ApplicationAcks *AckWaiter
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *MLLPReader
+	writer *MLLPWriter
+}
+
+// Send is used to send the message and wait for the acknowledgment whose
+// MSA-2 matches the message's control ID (MSH-10). Acknowledgments for other
+// messages (such as late responses to an earlier attempt) are ignored.
+//
+// If the acknowledgment is negative, the AckResult is returned along with a
+// *NegativeAckError once the retries have been exhausted.
+//
+// In enhanced acknowledgment mode (see AckAlways), the acknowledgment waited
+// for is the accept acknowledgment. If MSH-15 is NE or ER, Send returns a nil
+// AckResult as soon as the message is written, since a positive accept
+// acknowledgment will never arrive. The application acknowledgment can be
+// waited for using ApplicationAcks.
+func (c *Client) Send(ctx context.Context, msg *Message) (*AckResult, error) {
+	controlID := string(indexField(headerFields(msg.Bytes()), 10))
+
+	if controlID == "" {
+		return nil, ErrNoControlID
+	}
+	if c.ApplicationAcks != nil && msg.EnhancedMode() && msg.ApplicationAckType() != AckNever {
+		c.ApplicationAcks.Expect(controlID)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	backoff := c.RetryBackoff
+
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		var (
+			ack *AckResult
+			err error
+		)
+		if c.Sequence != nil {
+			ack, err = c.sendSequenced(ctx, msg, controlID)
+		} else {
+			ack, err = c.send(ctx, msg, controlID)
+		}
+		if err == nil && ack != nil && !ack.OK() {
+			err = &NegativeAckError{Ack: ack}
+		}
+		if err == nil || ctx.Err() != nil || attempt >= c.MaxRetries {
+			return ack, err
+		}
+		select {
+		case <-ctx.Done():
+			return ack, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.maxRetryBackoff() {
+			backoff = c.maxRetryBackoff()
+		}
+	}
+}
+
+// Close closes the connection, if there is one.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closeConn()
+}
+
+func (c *Client) maxRetryBackoff() time.Duration {
+	if c.MaxRetryBackoff > 0 {
+		return c.MaxRetryBackoff
+	}
+	return DefaultMaxRetryBackoff
+}
+
+// send makes a single attempt at sending the message. Any error other than a
+// negative acknowledgment closes the connection, so the next attempt starts
+// with a fresh one.
+func (c *Client) send(ctx context.Context, msg *Message, controlID string) (*AckResult, error) {
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	stop := interruptOnDone(ctx, c.conn)
+	ack, err := c.exchange(ctx, msg, controlID)
+	stop()
+
+	if err != nil {
+		c.closeConn()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ack, nil
+}
+
+// sendSequenced makes a single attempt at sending the message with the next
+// sequence number, and keeps track of the number the receiver expects next.
+func (c *Client) sendSequenced(ctx context.Context, msg *Message, controlID string) (*AckResult, error) {
+	n := c.Sequence.Expected(c.Addr)
+
+	if n == 0 {
+		queryID := NewControlID()
+		query, err := setHeaderField(msg, 13, "-1")
+
+		if err == nil {
+			query, err = setHeaderField(query, 10, queryID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ack, err := c.send(ctx, query, queryID)
+
+		if err != nil {
+			return nil, err
+		}
+		if n = 1; ack != nil && ack.ExpectedSequence > 0 {
+			n = ack.ExpectedSequence
+		}
+	}
+	msg, err := setHeaderField(msg, 13, strconv.FormatInt(n, 10))
+
+	if err != nil {
+		return nil, err
+	}
+	ack, err := c.send(ctx, msg, controlID)
+
+	if err != nil {
+		return nil, err
+	}
+	next := n + 1
+
+	switch {
+	case ack == nil:
+	case ack.OK() && ack.ExpectedSequence > n:
+		// The receiver had already seen this number.
+		next = ack.ExpectedSequence
+	case !ack.OK() && ack.ExpectedSequence > 0:
+		next = ack.ExpectedSequence
+	case !ack.OK():
+		next = n
+	}
+	return ack, c.Sequence.SetExpected(c.Addr, next)
+}
+
+func (c *Client) exchange(ctx context.Context, msg *Message, controlID string) (*AckResult, error) {
+	if c.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+	if err := c.writer.WriteMessage(msg); err != nil {
+		return nil, err
+	}
+	if msg.EnhancedMode() && !shouldAck(msg.AcceptAckType(), true) {
+		return nil, nil
+	}
+	timeout := c.AckTimeout
+
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	for {
+		resp, err := c.reader.ReadMessage()
+
+		if err == ErrInvalidHeader || err == ErrTruncatedFrame || err == ErrFrameTooLarge {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ack, err := ParseAck(resp)
+
+		if err != nil {
+			continue
+		}
+		// Application acknowledgments are passed on, including one for this
+		// message, which means the receiver went straight to processing it (or
+		// does not support enhanced mode).
+		if c.ApplicationAcks != nil {
+			c.ApplicationAcks.Deliver(resp)
+		}
+		if ack.ControlID != controlID {
+			continue
+		}
+		return ack, nil
+	}
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+	dialer := c.Dialer
+
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.TLSConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.TLSConfig}).DialContext(ctx, "tcp", c.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.Addr)
+	}
+
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = NewMLLPReader(conn)
+	c.writer = NewMLLPWriter(conn)
+
+	return nil
+}
+
+func (c *Client) closeConn() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.reader, c.writer = nil, nil, nil
+
+	return err
+}
+
+// interruptOnDone moves the connection's deadlines into the past if the
+// context is cancelled before stop is called, which makes any blocked reads
+// and writes return immediately.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	var (
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
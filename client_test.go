@@ -0,0 +1,164 @@
+package hl7
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSend(t *testing.T) {
+	var calls int32
+
+	s := &Server{Handler: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		atomic.AddInt32(&calls, 1)
+		id := string(indexField(headerFields(msg.Bytes()), 10))
+
+		switch id {
+		case "retry":
+			if atomic.LoadInt32(&calls) < 3 {
+				return testMessage(msh{msgType: "ACK", controlID: "A" + id}, "MSA|AE|"+id), nil
+			}
+		case "reject":
+			return testMessage(msh{msgType: "ACK", controlID: "A" + id}, "MSA|AR|"+id), nil
+		case "slow":
+			if atomic.LoadInt32(&calls) < 2 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		case "stale":
+			return testMessage(msh{msgType: "ACK", controlID: "Aother"}, "MSA|AA|other"), nil
+		}
+		return testMessage(msh{msgType: "ACK", controlID: "A" + id}, "MSA|AA|"+id), nil
+	})}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		client  *Client
+		id      string
+		code    string
+		calls   int32
+		wantErr bool
+	}{
+		{"accepted", &Client{}, "1", AckAccept, 1, false},
+		{"retried until accepted", &Client{MaxRetries: 3, RetryBackoff: time.Millisecond}, "retry", AckAccept, 3, false},
+		{"retries exhausted", &Client{MaxRetries: 2, RetryBackoff: time.Millisecond}, "reject", AckReject, 3, true},
+		{"timeout then accepted", &Client{AckTimeout: 20 * time.Millisecond, MaxRetries: 1, RetryBackoff: time.Millisecond}, "slow", AckAccept, 2, false},
+		{"stale acks are ignored", &Client{AckTimeout: 20 * time.Millisecond}, "stale", "", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			tt.client.Addr = addr
+			defer tt.client.Close()
+
+			ack, err := tt.client.Send(context.Background(), testMessage(msh{controlID: tt.id}))
+
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.calls, atomic.LoadInt32(&calls))
+
+			if tt.code != "" {
+				assert.Equal(t, tt.code, ack.Code)
+				assert.Equal(t, tt.id, ack.ControlID)
+			}
+		})
+	}
+
+	t.Run("negative acknowledgment error", func(t *testing.T) {
+		client := &Client{Addr: addr}
+		defer client.Close()
+
+		_, err := client.Send(context.Background(), testMessage(msh{controlID: "reject"}))
+
+		var nak *NegativeAckError
+		assert.True(t, errors.As(err, &nak))
+		assert.Equal(t, AckReject, nak.Ack.Code)
+	})
+
+	t.Run("connection is reused", func(t *testing.T) {
+		client := &Client{Addr: addr}
+		defer client.Close()
+
+		_, err := client.Send(context.Background(), testMessage(msh{controlID: "1"}))
+		assert.Nil(t, err)
+		conn := client.conn
+
+		_, err = client.Send(context.Background(), testMessage(msh{controlID: "2"}))
+		assert.Nil(t, err)
+		assert.Equal(t, conn, client.conn)
+	})
+
+	t.Run("no control ID", func(t *testing.T) {
+		client := &Client{Addr: addr}
+		msg, _ := NewMessage([]byte("MSH|^~\\&|||||||ADT^A01||P|2.5"))
+
+		_, err := client.Send(context.Background(), msg)
+		assert.Equal(t, ErrNoControlID, err)
+	})
+}
+
+func TestClientReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// The first connection is dropped as soon as a message arrives, and the
+	// second one is served properly.
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+			msg, err := NewMLLPReader(conn).ReadMessage()
+
+			if err == nil && i > 0 {
+				id := string(indexField(headerFields(msg.Bytes()), 10))
+				NewMLLPWriter(conn).WriteMessage(testMessage(msh{msgType: "ACK", controlID: "A" + id}, "MSA|AA|"+id))
+			}
+			conn.Close()
+		}
+	}()
+
+	client := &Client{Addr: l.Addr().String(), MaxRetries: 1, RetryBackoff: time.Millisecond}
+	defer client.Close()
+
+	ack, err := client.Send(context.Background(), testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+	assert.Equal(t, AckAccept, ack.Code)
+}
+
+func TestClientContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// Accept connections, but never respond.
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := &Client{Addr: l.Addr().String(), MaxRetries: 5}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = client.Send(ctx, testMessage(msh{controlID: "1"}))
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
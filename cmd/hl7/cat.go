@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+func init() {
+	commands["cat"] = &command{
+		usage: "[-expand] [-color when] [file ...]",
+		short: "print messages one segment per line, or field by field",
+		long: `
+Cat prints the messages in the files (or stdin, if there are none, or for a
+file named "-") one segment per line, with a blank line between messages.
+Compressed files are decompressed transparently. Anything in the input that is
+too short to be a message is reported and skipped, and makes the exit code 1.
+
+With -expand, each non-empty field is printed on its own line along with its
+name, with repetitions, components and sub-components indented beneath it:
+
+	PID-5 (Patient Name)
+	  PID-5-1 (Family Name): KLEINSAMPLE
+	  PID-5-2 (Given Name): BARRY
+`,
+		run: runCat,
+	}
+}
+
+func runCat(e *env, args []string) int {
+	cmd := commands["cat"]
+	fs := newFlagSet(e, "cat", cmd)
+	expand := fs.Bool("expand", false, "print each field on its own line, with its name")
+	color := fs.String("color", "auto", "colorize the output: auto, always or never")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	pal, err := choosePalette(*color, e.stdout)
+
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 cat:", err)
+		return exitUsage
+	}
+	w := bufio.NewWriter(e.stdout)
+	p := &catPrinter{w: w, pal: pal}
+
+	var failed bool
+
+	err = eachInput(e, fs.Args(), func(name string, r *hl7.Reader) error {
+		for i := 1; ; i++ {
+			msg, err := r.ReadMessage()
+
+			if err == io.EOF {
+				return nil
+			} else if err == hl7.ErrInvalidHeader {
+				failed = true
+				fmt.Fprintf(e.stderr, "hl7 cat: %s: message %d: %v\n", name, i, err)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if *expand {
+				p.expanded(msg)
+			} else {
+				p.compact(msg)
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+		}
+	})
+	w.Flush()
+
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 cat:", err)
+		return exitError
+	}
+	if failed {
+		return exitError
+	}
+	return exitOK
+}
+
+// palette holds the ANSI escape sequences used to colorize the output. The
+// zero value does not colorize anything.
+type palette struct {
+	segment string // Segment IDs.
+	path    string // Paths such as PID-5-1.
+	name    string // Field and component names.
+	sep     string // Separators.
+	reset   string
+}
+
+var ansiPalette = palette{
+	segment: "\x1b[1;36m",
+	path:    "\x1b[33m",
+	name:    "\x1b[2m",
+	sep:     "\x1b[2m",
+	reset:   "\x1b[0m",
+}
+
+// paint wraps the string in the escape sequence, if there is one.
+func (p palette) paint(code, s string) string {
+	if code == "" || s == "" {
+		return s
+	}
+	return code + s + p.reset
+}
+
+// choosePalette returns the palette to use for the given -color flag. With
+// "auto", colors are used if w is a terminal and the NO_COLOR environment
+// variable is not set.
+func choosePalette(when string, w io.Writer) (palette, error) {
+	switch when {
+	case "always":
+		return ansiPalette, nil
+	case "never":
+		return palette{}, nil
+	case "auto":
+		if isTerminal(w) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" {
+			return ansiPalette, nil
+		}
+		return palette{}, nil
+	}
+	return palette{}, fmt.Errorf("invalid -color value %q: must be auto, always or never", when)
+}
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// catPrinter prints messages for the cat command.
+type catPrinter struct {
+	w       *bufio.Writer
+	pal     palette
+	printed bool
+}
+
+// separate writes a blank line between messages.
+func (p *catPrinter) separate() {
+	if p.printed {
+		p.w.WriteByte('\n')
+	}
+	p.printed = true
+}
+
+// compact prints the message one segment per line.
+func (p *catPrinter) compact(msg *hl7.Message) {
+	p.separate()
+
+	data := msg.Bytes()
+	fieldSep := string(data[3:4])
+
+	for _, line := range segmentLines(data) {
+		s := string(line)
+
+		if p.pal == (palette{}) || len(s) < 3 {
+			p.w.WriteString(s)
+		} else {
+			p.w.WriteString(p.pal.paint(p.pal.segment, s[:3]))
+			p.w.WriteString(strings.Replace(s[3:], fieldSep, p.pal.paint(p.pal.sep, fieldSep), -1))
+		}
+		p.w.WriteByte('\n')
+	}
+}
+
+// expanded prints each non-empty field of the message on its own line.
+func (p *catPrinter) expanded(msg *hl7.Message) {
+	p.separate()
+
+	for _, line := range segmentLines(msg.Bytes()) {
+		seg, err := msg.ReadSegment()
+
+		if err != nil {
+			break
+		}
+		stype := seg.Type()
+		header := p.pal.paint(p.pal.segment, stype)
+
+		if name := segmentNames[stype]; name != "" {
+			header += " " + p.pal.paint(p.pal.name, "("+name+")")
+		}
+		p.w.WriteString(header + "\n")
+
+		first := 1
+
+		if stype == "MSH" {
+			// MSH-1 and MSH-2 hold the separators, so they can't be split
+			// like the other fields, and MSH-n is at index n-1 rather than n.
+			p.line(1, p.label("MSH-1", fieldName("MSH", 1)), string(line[3:4]))
+			p.line(1, p.label("MSH-2", fieldName("MSH", 2)), encodingCharacters(line))
+			first = 2
+		}
+		for i := first; i < len(seg); i++ {
+			n := i
+
+			if stype == "MSH" {
+				n = i + 1
+			}
+			p.field(stype, n, seg[i])
+		}
+	}
+}
+
+// field prints a field, and its repetitions if it has more than one.
+func (p *catPrinter) field(stype string, n int, reps hl7.Fields) {
+	var nonEmpty []int
+
+	for i, rep := range reps {
+		if !isEmptyField(rep) {
+			nonEmpty = append(nonEmpty, i)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return
+	}
+	path := fmt.Sprintf("%s-%d", stype, n)
+	label := p.label(path, fieldName(stype, n))
+
+	if len(reps) == 1 {
+		p.repetition(1, label, path, stype, n, reps[0])
+		return
+	}
+	p.line(1, label, "")
+
+	for _, i := range nonEmpty {
+		p.repetition(2, p.pal.paint(p.pal.path, fmt.Sprintf("[%d]", i+1)), path, stype, n, reps[i])
+	}
+}
+
+// repetition prints a single repetition of a field, with its components
+// indented beneath it unless it only has the one.
+func (p *catPrinter) repetition(indent int, label, path, stype string, n int, field hl7.Field) {
+	if len(field) == 1 && len(field[0]) <= 1 {
+		p.line(indent, label, subComponentString(field[0], 0))
+		return
+	}
+	p.line(indent, label, "")
+
+	for c, comp := range field {
+		if isEmptyComponent(comp) {
+			continue
+		}
+		compPath := fmt.Sprintf("%s-%d", path, c+1)
+		compLabel := p.label(compPath, componentName(stype, n, c+1))
+
+		if len(comp) <= 1 {
+			p.line(indent+1, compLabel, subComponentString(comp, 0))
+			continue
+		}
+		p.line(indent+1, compLabel, "")
+
+		for s, sub := range comp {
+			if len(sub) > 0 {
+				p.line(indent+2, p.label(fmt.Sprintf("%s-%d", compPath, s+1), ""), sub.String())
+			}
+		}
+	}
+}
+
+// label returns the path followed by the name in parentheses, if it has one.
+func (p *catPrinter) label(path, name string) string {
+	label := p.pal.paint(p.pal.path, path)
+
+	if name != "" {
+		label += " " + p.pal.paint(p.pal.name, "("+name+")")
+	}
+	return label
+}
+
+// line prints the label at the given level of indentation, followed by the
+// value if there is one. Values that span several lines are indented to
+// match.
+func (p *catPrinter) line(indent int, label, value string) {
+	prefix := strings.Repeat("  ", indent)
+	p.w.WriteString(prefix + label)
+
+	if value != "" {
+		value = strings.Replace(value, "\n", "\n"+prefix+"  ", -1)
+		p.w.WriteString(": " + value)
+	}
+	p.w.WriteByte('\n')
+}
+
+// segmentLines splits the raw message data into its segments.
+func segmentLines(data []byte) [][]byte {
+	return bytes.FieldsFunc(data, func(r rune) bool { return r == hl7.CR || r == hl7.LF })
+}
+
+// encodingCharacters returns MSH-2 from the raw MSH segment.
+func encodingCharacters(line []byte) string {
+	if len(line) < 4 {
+		return ""
+	}
+	rest := line[4:]
+
+	if i := bytes.IndexByte(rest, line[3]); i >= 0 {
+		rest = rest[:i]
+	}
+	return string(rest)
+}
+
+// subComponentString returns the unescaped value of sub-component i of the
+// component, or "" if it has none.
+func subComponentString(comp hl7.Component, i int) string {
+	if sub, ok := comp.GetSubComponent(i); ok {
+		return sub.String()
+	}
+	return ""
+}
+
+func isEmptyField(field hl7.Field) bool {
+	for _, comp := range field {
+		if !isEmptyComponent(comp) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmptyComponent(comp hl7.Component) bool {
+	for _, sub := range comp {
+		if len(sub) > 0 {
+			return false
+		}
+	}
+	return true
+}
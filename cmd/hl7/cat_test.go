@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCat(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			"compact",
+			[]string{"cat"},
+			"MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\n" +
+				"PID|||123^^^MRN~456^^^SSN||DOE^JOHN||19620910|M\n" +
+				"\n" +
+				"MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|2|P|2.5\n" +
+				"PID|||789^^^MRN||ROE^JANE\n",
+		},
+		{
+			"expanded",
+			[]string{"cat", "-expand"},
+			"MSH (Message Header)\n" +
+				"  MSH-1 (Field Separator): |\n" +
+				"  MSH-2 (Encoding Characters): ^~\\&\n" +
+				"  MSH-3 (Sending Application): App\n" +
+				"  MSH-4 (Sending Facility): Fac\n" +
+				"  MSH-7 (Date/Time of Message): 20060529090131\n" +
+				"  MSH-9 (Message Type)\n" +
+				"    MSH-9-1 (Message Code): ADT\n" +
+				"    MSH-9-2 (Trigger Event): A01\n" +
+				"  MSH-10 (Message Control ID): 1\n" +
+				"  MSH-11 (Processing ID): P\n" +
+				"  MSH-12 (Version ID): 2.5\n" +
+				"PID (Patient Identification)\n" +
+				"  PID-3 (Patient Identifier List)\n" +
+				"    [1]\n" +
+				"      PID-3-1 (ID Number): 123\n" +
+				"      PID-3-4 (Assigning Authority): MRN\n" +
+				"    [2]\n" +
+				"      PID-3-1 (ID Number): 456\n" +
+				"      PID-3-4 (Assigning Authority): SSN\n" +
+				"  PID-5 (Patient Name)\n" +
+				"    PID-5-1 (Family Name): DOE\n" +
+				"    PID-5-2 (Given Name): JOHN\n" +
+				"  PID-7 (Date/Time of Birth): 19620910\n" +
+				"  PID-8 (Administrative Sex): M\n" +
+				"\n" +
+				"MSH (Message Header)\n" +
+				"  MSH-1 (Field Separator): |\n" +
+				"  MSH-2 (Encoding Characters): ^~\\&\n" +
+				"  MSH-3 (Sending Application): App\n" +
+				"  MSH-4 (Sending Facility): Fac\n" +
+				"  MSH-7 (Date/Time of Message): 20060529090131\n" +
+				"  MSH-9 (Message Type)\n" +
+				"    MSH-9-1 (Message Code): ADT\n" +
+				"    MSH-9-2 (Trigger Event): A01\n" +
+				"  MSH-10 (Message Control ID): 2\n" +
+				"  MSH-11 (Processing ID): P\n" +
+				"  MSH-12 (Version ID): 2.5\n" +
+				"PID (Patient Identification)\n" +
+				"  PID-3 (Patient Identifier List)\n" +
+				"    PID-3-1 (ID Number): 789\n" +
+				"    PID-3-4 (Assigning Authority): MRN\n" +
+				"  PID-5 (Patient Name)\n" +
+				"    PID-5-1 (Family Name): ROE\n" +
+				"    PID-5-2 (Given Name): JANE\n",
+		},
+		{
+			"color",
+			[]string{"cat", "-color", "always"},
+			"\x1b[1;36mMSH\x1b[0m\x1b[2m|\x1b[0m^~\\&\x1b[2m|\x1b[0mApp\x1b[2m|\x1b[0mFac\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m20060529090131\x1b[2m|\x1b[0m\x1b[2m|\x1b[0mADT^A01\x1b[2m|\x1b[0m1\x1b[2m|\x1b[0mP\x1b[2m|\x1b[0m2.5\n" +
+				"\x1b[1;36mPID\x1b[0m\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m123^^^MRN~456^^^SSN\x1b[2m|\x1b[0m\x1b[2m|\x1b[0mDOE^JOHN\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m19620910\x1b[2m|\x1b[0mM\n" +
+				"\n" +
+				"\x1b[1;36mMSH\x1b[0m\x1b[2m|\x1b[0m^~\\&\x1b[2m|\x1b[0mApp\x1b[2m|\x1b[0mFac\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m20060529090131\x1b[2m|\x1b[0m\x1b[2m|\x1b[0mADT^A01\x1b[2m|\x1b[0m2\x1b[2m|\x1b[0mP\x1b[2m|\x1b[0m2.5\n" +
+				"\x1b[1;36mPID\x1b[0m\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m\x1b[2m|\x1b[0m789^^^MRN\x1b[2m|\x1b[0m\x1b[2m|\x1b[0mROE^JANE\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCommand(testMessages, tt.args...)
+			assert.Equal(t, exitOK, code)
+			assert.Equal(t, tt.want, stdout)
+			assert.Empty(t, stderr)
+		})
+	}
+}
+
+func TestCatFiles(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(testMessages))
+	w.Close()
+
+	plain, removePlain := writeTestFile(t, "plain.hl7", testMessages)
+	defer removePlain()
+
+	compressed, removeCompressed := writeTestFile(t, "compressed.hl7.gz", buf.String())
+	defer removeCompressed()
+
+	code, stdout, _ := runCommand(testMessages, "cat", plain, "-", compressed)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, 6, bytes.Count([]byte(stdout), []byte("MSH|")))
+}
+
+func TestCatTruncated(t *testing.T) {
+	code, stdout, stderr := runCommand(testTruncatedMessages, "cat")
+	assert.Equal(t, exitError, code)
+	assert.Equal(t, "MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\n"+
+		"\n"+
+		"MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|3|P|2.5\n", stdout)
+	assert.Equal(t, "hl7 cat: stdin: message 2: message does not begin with an MSH segment\n", stderr)
+}
+
+func TestCatInvalidColor(t *testing.T) {
+	code, _, stderr := runCommand("", "cat", "-color", "sometimes")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "invalid -color value")
+}
+
+func TestEncodingCharacters(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"MSH|^~\\&|App", "^~\\&"},
+		{"MSH|^~\\&#|App", "^~\\&#"},
+		{"MSH|^~\\&", "^~\\&"},
+		{"MSH", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, encodingCharacters([]byte(tt.line)), tt.line)
+	}
+}
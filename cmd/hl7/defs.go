@@ -0,0 +1,357 @@
+package main
+
+// This file holds the names and data types of the fields of the most common
+// segments, along with the names of the components of the most common data
+// types, as defined by HL7 v2.5. It is far from the whole standard, but it
+// covers what is needed to make sense of typical ADT, ORM, ORU and ACK
+// messages. Anything missing is simply shown without a name.
+
+// fieldDef describes a field of a segment.
+type fieldDef struct {
+	name     string
+	dataType string
+}
+
+// segmentNames holds the names of the segments.
+var segmentNames = map[string]string{
+	"AL1": "Patient Allergy Information",
+	"DG1": "Diagnosis",
+	"ERR": "Error",
+	"EVN": "Event Type",
+	"MSA": "Message Acknowledgment",
+	"MSH": "Message Header",
+	"NK1": "Next of Kin / Associated Parties",
+	"NTE": "Notes and Comments",
+	"OBR": "Observation Request",
+	"OBX": "Observation/Result",
+	"ORC": "Common Order",
+	"PID": "Patient Identification",
+	"PV1": "Patient Visit",
+}
+
+// segmentFields holds the fields of the segments, so that the definition of
+// XXX-n is segmentFields["XXX"][n-1].
+var segmentFields = map[string][]fieldDef{
+	"AL1": {
+		{"Set ID - AL1", "SI"},
+		{"Allergen Type Code", "CE"},
+		{"Allergen Code/Mnemonic/Description", "CE"},
+		{"Allergy Severity Code", "CE"},
+		{"Allergy Reaction Code", "ST"},
+		{"Identification Date", "DT"},
+	},
+	"DG1": {
+		{"Set ID - DG1", "SI"},
+		{"Diagnosis Coding Method", "ID"},
+		{"Diagnosis Code - DG1", "CE"},
+		{"Diagnosis Description", "ST"},
+		{"Diagnosis Date/Time", "TS"},
+		{"Diagnosis Type", "IS"},
+	},
+	"ERR": {
+		{"Error Code and Location", "ELD"},
+		{"Error Location", "ERL"},
+		{"HL7 Error Code", "CWE"},
+		{"Severity", "ID"},
+		{"Application Error Code", "CWE"},
+		{"Application Error Parameter", "ST"},
+		{"Diagnostic Information", "TX"},
+		{"User Message", "TX"},
+		{"Inform Person Indicator", "IS"},
+		{"Override Type", "CWE"},
+		{"Override Reason Code", "CWE"},
+		{"Help Desk Contact Point", "XTN"},
+	},
+	"EVN": {
+		{"Event Type Code", "ID"},
+		{"Recorded Date/Time", "TS"},
+		{"Date/Time Planned Event", "TS"},
+		{"Event Reason Code", "IS"},
+		{"Operator ID", "XCN"},
+		{"Event Occurred", "TS"},
+		{"Event Facility", "HD"},
+	},
+	"MSA": {
+		{"Acknowledgment Code", "ID"},
+		{"Message Control ID", "ST"},
+		{"Text Message", "ST"},
+		{"Expected Sequence Number", "NM"},
+		{"Delayed Acknowledgment Type", "ID"},
+		{"Error Condition", "CE"},
+	},
+	"MSH": {
+		{"Field Separator", "ST"},
+		{"Encoding Characters", "ST"},
+		{"Sending Application", "HD"},
+		{"Sending Facility", "HD"},
+		{"Receiving Application", "HD"},
+		{"Receiving Facility", "HD"},
+		{"Date/Time of Message", "TS"},
+		{"Security", "ST"},
+		{"Message Type", "MSG"},
+		{"Message Control ID", "ST"},
+		{"Processing ID", "PT"},
+		{"Version ID", "VID"},
+		{"Sequence Number", "NM"},
+		{"Continuation Pointer", "ST"},
+		{"Accept Acknowledgment Type", "ID"},
+		{"Application Acknowledgment Type", "ID"},
+		{"Country Code", "ID"},
+		{"Character Set", "ID"},
+		{"Principal Language of Message", "CE"},
+		{"Alternate Character Set Handling Scheme", "ID"},
+		{"Message Profile Identifier", "EI"},
+	},
+	"NK1": {
+		{"Set ID - NK1", "SI"},
+		{"Name", "XPN"},
+		{"Relationship", "CE"},
+		{"Address", "XAD"},
+		{"Phone Number", "XTN"},
+		{"Business Phone Number", "XTN"},
+		{"Contact Role", "CE"},
+		{"Start Date", "DT"},
+		{"End Date", "DT"},
+		{"Next of Kin / Associated Parties Job Title", "ST"},
+		{"Next of Kin / Associated Parties Job Code/Class", "JCC"},
+		{"Next of Kin / Associated Parties Employee Number", "CX"},
+		{"Organization Name - NK1", "XON"},
+	},
+	"NTE": {
+		{"Set ID - NTE", "SI"},
+		{"Source of Comment", "ID"},
+		{"Comment", "FT"},
+		{"Comment Type", "CE"},
+	},
+	"OBR": {
+		{"Set ID - OBR", "SI"},
+		{"Placer Order Number", "EI"},
+		{"Filler Order Number", "EI"},
+		{"Universal Service Identifier", "CE"},
+		{"Priority - OBR", "ID"},
+		{"Requested Date/Time", "TS"},
+		{"Observation Date/Time", "TS"},
+		{"Observation End Date/Time", "TS"},
+		{"Collection Volume", "CQ"},
+		{"Collector Identifier", "XCN"},
+		{"Specimen Action Code", "ID"},
+		{"Danger Code", "CE"},
+		{"Relevant Clinical Information", "ST"},
+		{"Specimen Received Date/Time", "TS"},
+		{"Specimen Source", "SPS"},
+		{"Ordering Provider", "XCN"},
+		{"Order Callback Phone Number", "XTN"},
+		{"Placer Field 1", "ST"},
+		{"Placer Field 2", "ST"},
+		{"Filler Field 1", "ST"},
+		{"Filler Field 2", "ST"},
+		{"Results Rpt/Status Chng - Date/Time", "TS"},
+		{"Charge to Practice", "MOC"},
+		{"Diagnostic Serv Sect ID", "ID"},
+		{"Result Status", "ID"},
+		{"Parent Result", "PRL"},
+		{"Quantity/Timing", "TQ"},
+		{"Result Copies To", "XCN"},
+		{"Parent", "EIP"},
+		{"Transportation Mode", "ID"},
+		{"Reason for Study", "CE"},
+		{"Principal Result Interpreter", "NDL"},
+	},
+	"OBX": {
+		{"Set ID - OBX", "SI"},
+		{"Value Type", "ID"},
+		{"Observation Identifier", "CE"},
+		{"Observation Sub-ID", "ST"},
+		{"Observation Value", "varies"},
+		{"Units", "CE"},
+		{"References Range", "ST"},
+		{"Abnormal Flags", "IS"},
+		{"Probability", "NM"},
+		{"Nature of Abnormal Test", "ID"},
+		{"Observation Result Status", "ID"},
+		{"Effective Date of Reference Range", "TS"},
+		{"User Defined Access Checks", "ST"},
+		{"Date/Time of the Observation", "TS"},
+		{"Producer's ID", "CE"},
+		{"Responsible Observer", "XCN"},
+		{"Observation Method", "CE"},
+		{"Equipment Instance Identifier", "EI"},
+		{"Date/Time of the Analysis", "TS"},
+	},
+	"ORC": {
+		{"Order Control", "ID"},
+		{"Placer Order Number", "EI"},
+		{"Filler Order Number", "EI"},
+		{"Placer Group Number", "EI"},
+		{"Order Status", "ID"},
+		{"Response Flag", "ID"},
+		{"Quantity/Timing", "TQ"},
+		{"Parent", "EIP"},
+		{"Date/Time of Transaction", "TS"},
+		{"Entered By", "XCN"},
+		{"Verified By", "XCN"},
+		{"Ordering Provider", "XCN"},
+		{"Enterer's Location", "PL"},
+		{"Call Back Phone Number", "XTN"},
+		{"Order Effective Date/Time", "TS"},
+		{"Order Control Code Reason", "CE"},
+		{"Entering Organization", "CE"},
+		{"Entering Device", "CE"},
+		{"Action By", "XCN"},
+		{"Advanced Beneficiary Notice Code", "CE"},
+		{"Ordering Facility Name", "XON"},
+		{"Ordering Facility Address", "XAD"},
+		{"Ordering Facility Phone Number", "XTN"},
+		{"Ordering Provider Address", "XAD"},
+		{"Order Status Modifier", "CWE"},
+	},
+	"PID": {
+		{"Set ID - PID", "SI"},
+		{"Patient ID", "CX"},
+		{"Patient Identifier List", "CX"},
+		{"Alternate Patient ID - PID", "CX"},
+		{"Patient Name", "XPN"},
+		{"Mother's Maiden Name", "XPN"},
+		{"Date/Time of Birth", "TS"},
+		{"Administrative Sex", "IS"},
+		{"Patient Alias", "XPN"},
+		{"Race", "CE"},
+		{"Patient Address", "XAD"},
+		{"County Code", "IS"},
+		{"Phone Number - Home", "XTN"},
+		{"Phone Number - Business", "XTN"},
+		{"Primary Language", "CE"},
+		{"Marital Status", "CE"},
+		{"Religion", "CE"},
+		{"Patient Account Number", "CX"},
+		{"SSN Number - Patient", "ST"},
+		{"Driver's License Number - Patient", "DLN"},
+		{"Mother's Identifier", "CX"},
+		{"Ethnic Group", "CE"},
+		{"Birth Place", "ST"},
+		{"Multiple Birth Indicator", "ID"},
+		{"Birth Order", "NM"},
+		{"Citizenship", "CE"},
+		{"Veterans Military Status", "CE"},
+		{"Nationality", "CE"},
+		{"Patient Death Date and Time", "TS"},
+		{"Patient Death Indicator", "ID"},
+		{"Identity Unknown Indicator", "ID"},
+		{"Identity Reliability Code", "IS"},
+		{"Last Update Date/Time", "TS"},
+		{"Last Update Facility", "HD"},
+		{"Species Code", "CE"},
+		{"Breed Code", "CE"},
+		{"Strain", "ST"},
+		{"Production Class Code", "CE"},
+		{"Tribal Citizenship", "CWE"},
+	},
+	"PV1": {
+		{"Set ID - PV1", "SI"},
+		{"Patient Class", "IS"},
+		{"Assigned Patient Location", "PL"},
+		{"Admission Type", "IS"},
+		{"Preadmit Number", "CX"},
+		{"Prior Patient Location", "PL"},
+		{"Attending Doctor", "XCN"},
+		{"Referring Doctor", "XCN"},
+		{"Consulting Doctor", "XCN"},
+		{"Hospital Service", "IS"},
+		{"Temporary Location", "PL"},
+		{"Preadmit Test Indicator", "IS"},
+		{"Re-admission Indicator", "IS"},
+		{"Admit Source", "IS"},
+		{"Ambulatory Status", "IS"},
+		{"VIP Indicator", "IS"},
+		{"Admitting Doctor", "XCN"},
+		{"Patient Type", "IS"},
+		{"Visit Number", "CX"},
+		{"Financial Class", "FC"},
+		{"Charge Price Indicator", "IS"},
+		{"Courtesy Code", "IS"},
+		{"Credit Rating", "IS"},
+		{"Contract Code", "IS"},
+		{"Contract Effective Date", "DT"},
+		{"Contract Amount", "NM"},
+		{"Contract Period", "NM"},
+		{"Interest Code", "IS"},
+		{"Transfer to Bad Debt Code", "IS"},
+		{"Transfer to Bad Debt Date", "DT"},
+		{"Bad Debt Agency Code", "IS"},
+		{"Bad Debt Transfer Amount", "NM"},
+		{"Bad Debt Recovery Amount", "NM"},
+		{"Delete Account Indicator", "IS"},
+		{"Delete Account Date", "DT"},
+		{"Discharge Disposition", "IS"},
+		{"Discharged to Location", "DLD"},
+		{"Diet Type", "CE"},
+		{"Servicing Facility", "IS"},
+		{"Bed Status", "IS"},
+		{"Account Status", "IS"},
+		{"Pending Location", "PL"},
+		{"Prior Temporary Location", "PL"},
+		{"Admit Date/Time", "TS"},
+		{"Discharge Date/Time", "TS"},
+		{"Current Patient Balance", "NM"},
+		{"Total Charges", "NM"},
+		{"Total Adjustments", "NM"},
+		{"Total Payments", "NM"},
+		{"Alternate Visit ID", "CX"},
+		{"Visit Indicator", "IS"},
+		{"Other Healthcare Provider", "XCN"},
+	},
+}
+
+// componentNames holds the names of the components of the composite data
+// types, in order.
+var componentNames = map[string][]string{
+	"CE":  {"Identifier", "Text", "Name of Coding System", "Alternate Identifier", "Alternate Text", "Name of Alternate Coding System"},
+	"CQ":  {"Quantity", "Units"},
+	"CWE": {"Identifier", "Text", "Name of Coding System", "Alternate Identifier", "Alternate Text", "Name of Alternate Coding System", "Coding System Version ID", "Alternate Coding System Version ID", "Original Text"},
+	"CX":  {"ID Number", "Check Digit", "Check Digit Scheme", "Assigning Authority", "Identifier Type Code", "Assigning Facility", "Effective Date", "Expiration Date", "Assigning Jurisdiction", "Assigning Agency or Department"},
+	"DLD": {"Discharge Location", "Effective Date"},
+	"DLN": {"License Number", "Issuing State, Province, Country", "Expiration Date"},
+	"EI":  {"Entity Identifier", "Namespace ID", "Universal ID", "Universal ID Type"},
+	"EIP": {"Placer Assigned Identifier", "Filler Assigned Identifier"},
+	"ELD": {"Segment ID", "Segment Sequence", "Field Position", "Code Identifying Error"},
+	"ERL": {"Segment ID", "Segment Sequence", "Field Position", "Field Repetition", "Component Number", "Sub-Component Number"},
+	"FC":  {"Financial Class Code", "Effective Date"},
+	"HD":  {"Namespace ID", "Universal ID", "Universal ID Type"},
+	"MSG": {"Message Code", "Trigger Event", "Message Structure"},
+	"PL":  {"Point of Care", "Room", "Bed", "Facility", "Location Status", "Person Location Type", "Building", "Floor", "Location Description", "Comprehensive Location Identifier", "Assigning Authority for Location"},
+	"PT":  {"Processing ID", "Processing Mode"},
+	"TS":  {"Time", "Degree of Precision"},
+	"VID": {"Version ID", "Internationalization Code", "International Version ID"},
+	"XAD": {"Street Address", "Other Designation", "City", "State or Province", "Zip or Postal Code", "Country", "Address Type", "Other Geographic Designation", "County/Parish Code", "Census Tract", "Address Representation Code", "Address Validity Range", "Effective Date", "Expiration Date"},
+	"XCN": {"ID Number", "Family Name", "Given Name", "Second and Further Given Names or Initials Thereof", "Suffix", "Prefix", "Degree", "Source Table", "Assigning Authority", "Name Type Code", "Identifier Check Digit", "Check Digit Scheme", "Identifier Type Code", "Assigning Facility", "Name Representation Code", "Name Context", "Name Validity Range", "Name Assembly Order", "Effective Date", "Expiration Date", "Professional Suffix", "Assigning Jurisdiction", "Assigning Agency or Department"},
+	"XON": {"Organization Name", "Organization Name Type Code", "ID Number", "Check Digit", "Check Digit Scheme", "Assigning Authority", "Identifier Type Code", "Assigning Facility", "Name Representation Code", "Organization Identifier"},
+	"XPN": {"Family Name", "Given Name", "Second and Further Given Names or Initials Thereof", "Suffix", "Prefix", "Degree", "Name Type Code", "Name Representation Code", "Name Context", "Name Validity Range", "Name Assembly Order", "Effective Date", "Expiration Date", "Professional Suffix"},
+	"XTN": {"Telephone Number", "Telecommunication Use Code", "Telecommunication Equipment Type", "Email Address", "Country Code", "Area/City Code", "Local Number", "Extension", "Any Text", "Extension Prefix", "Speed Dial Code", "Unformatted Telephone Number"},
+}
+
+// lookupField returns the definition of field n of the segment, if known.
+func lookupField(segment string, n int) (fieldDef, bool) {
+	fields := segmentFields[segment]
+
+	if n < 1 || n > len(fields) {
+		return fieldDef{}, false
+	}
+	return fields[n-1], true
+}
+
+// fieldName returns the name of field n of the segment, or "" if unknown.
+func fieldName(segment string, n int) string {
+	def, _ := lookupField(segment, n)
+	return def.name
+}
+
+// componentName returns the name of component c of field n of the segment, or
+// "" if unknown.
+func componentName(segment string, n, c int) string {
+	def, ok := lookupField(segment, n)
+
+	if !ok || c < 1 || c > len(componentNames[def.dataType]) {
+		return ""
+	}
+	return componentNames[def.dataType][c-1]
+}
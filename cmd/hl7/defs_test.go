@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComponentName(t *testing.T) {
+	tests := []struct {
+		segment string
+		field   int
+		comp    int
+		want    string
+	}{
+		{"PID", 5, 1, "Family Name"},
+		{"MSH", 9, 2, "Trigger Event"},
+		{"PV1", 3, 2, "Room"},
+		{"PID", 8, 1, ""},
+		{"PID", 5, 99, ""},
+		{"PID", 0, 1, ""},
+		{"ZZZ", 1, 1, ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, componentName(tt.segment, tt.field, tt.comp), "%s-%d-%d", tt.segment, tt.field, tt.comp)
+	}
+}
+
+func TestSegmentFields(t *testing.T) {
+	for segment := range segmentFields {
+		assert.NotEmpty(t, segmentNames[segment], segment)
+	}
+	assert.Equal(t, "Message Control ID", fieldName("MSH", 10))
+	assert.Equal(t, "", fieldName("MSH", 100))
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+func init() {
+	commands["get"] = &command{
+		usage: "[-format tsv|csv|json] [-repeat join|first] [-sep s] [-header] [-source] path ... [file ...]",
+		short: "extract fields from each message",
+		long: `
+Get prints the values at the given paths for each message in the files (or
+stdin, if there are none, or for a file named "-"), one line per message.
+Messages are read one at a time, so files of any size can be processed.
+
+A path names a segment and field, and optionally a component and
+sub-component, such as PID-3, PID-3-1 or PID-3-4-1. A particular occurrence of
+a segment or repetition of a field can be chosen by its (1-based) number in
+brackets, such as OBX[2]-5 or PID-3[1]-1; otherwise all of them are used.
+Values that have no further structure are unescaped; anything else (such as a
+whole field with several components) is printed as it appears in the message.
+
+When a path matches more than one value, because the segment occurs more than
+once or the field repeats, -repeat decides what happens: "join" joins them
+with the -sep string (or, in JSON, prints them as an array), and "first" only
+prints the first.
+
+Anything in the input that is too short to be a message is reported and
+skipped, and makes the exit code 1.
+`,
+		run: runGet,
+	}
+}
+
+// pathRegexp matches the paths accepted by the get command.
+var pathRegexp = regexp.MustCompile(`^([A-Z][A-Z0-9]{2})(?:\[(\d+)\])?-(\d+)(?:\[(\d+)\])?(?:-(\d+))?(?:-(\d+))?$`)
+
+// fieldPath is a parsed path, such as PID-3-1. Zero means all occurrences (or
+// repetitions), or the whole field (or component).
+type fieldPath struct {
+	name       string
+	segment    string
+	occurrence int
+	field      int
+	repetition int
+	component  int
+	sub        int
+}
+
+// parsePath parses a path, and reports whether it is valid.
+func parsePath(s string) (fieldPath, bool) {
+	m := pathRegexp.FindStringSubmatch(s)
+
+	if m == nil {
+		return fieldPath{}, false
+	}
+	num := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	p := fieldPath{
+		name:       s,
+		segment:    m[1],
+		occurrence: num(m[2]),
+		field:      num(m[3]),
+		repetition: num(m[4]),
+		component:  num(m[5]),
+		sub:        num(m[6]),
+	}
+	// Zero is only meaningful as "all", so an explicit zero is rejected.
+	if p.field == 0 || (m[2] != "" && p.occurrence == 0) || (m[4] != "" && p.repetition == 0) ||
+		(m[5] != "" && p.component == 0) || (m[6] != "" && p.sub == 0) {
+		return fieldPath{}, false
+	}
+	return p, true
+}
+
+// values returns the values at the path within the raw message data.
+func (p fieldPath) values(data []byte) []string {
+	if len(data) < 8 {
+		return nil
+	}
+	var (
+		fieldSep   = data[3]
+		compSep    = data[4]
+		repeat     = data[5]
+		subCompSep = data[7]
+		values     []string
+		occurrence int
+	)
+	for _, line := range segmentLines(data) {
+		if !bytes.HasPrefix(line, []byte(p.segment)) || (len(line) > 3 && line[3] != fieldSep) {
+			continue
+		}
+		occurrence++
+
+		if p.occurrence != 0 && p.occurrence != occurrence {
+			continue
+		}
+		field, ok := lineField(line, p.field)
+
+		if !ok {
+			continue
+		}
+		if p.segment == "MSH" && p.field <= 2 {
+			// These hold the separators, so they can't be split.
+			values = append(values, string(field))
+			continue
+		}
+		for r, rep := range bytes.Split(field, []byte{repeat}) {
+			if p.repetition != 0 && p.repetition != r+1 {
+				continue
+			}
+			value := rep
+			leaf := bytes.IndexByte(rep, compSep) < 0 && bytes.IndexByte(rep, subCompSep) < 0
+
+			if p.component != 0 {
+				comps := bytes.Split(rep, []byte{compSep})
+
+				if p.component > len(comps) {
+					values = append(values, "")
+					continue
+				}
+				value = comps[p.component-1]
+				leaf = bytes.IndexByte(value, subCompSep) < 0
+
+				if p.sub != 0 {
+					subs := bytes.Split(value, []byte{subCompSep})
+
+					if p.sub > len(subs) {
+						values = append(values, "")
+						continue
+					}
+					value = subs[p.sub-1]
+					leaf = true
+				}
+			}
+			if leaf {
+				values = append(values, hl7.SubComponent(value).String())
+			} else {
+				values = append(values, string(value))
+			}
+		}
+	}
+	return values
+}
+
+// lineField returns field n of the raw segment, and reports whether the
+// segment has that many fields. MSH-1 and MSH-2 are returned as they are,
+// since they hold the separators.
+func lineField(line []byte, n int) ([]byte, bool) {
+	if len(line) < 4 || n < 1 {
+		return nil, false
+	}
+	fieldSep := line[3]
+
+	if bytes.HasPrefix(line, []byte("MSH")) {
+		// MSH-1 is the field separator itself, so MSH-n is at n-1.
+		switch n {
+		case 1:
+			return line[3:4], true
+		case 2:
+			return []byte(encodingCharacters(line)), true
+		}
+		n--
+	}
+	fields := bytes.Split(line, []byte{fieldSep})
+
+	if n >= len(fields) {
+		return nil, false
+	}
+	return fields[n], true
+}
+
+func runGet(e *env, args []string) int {
+	cmd := commands["get"]
+	fs := newFlagSet(e, "get", cmd)
+	format := fs.String("format", "tsv", "the output format: tsv, csv or json (one object per line)")
+	repeat := fs.String("repeat", "join", "how to handle several values for a path: join or first")
+	sep := fs.String("sep", "~", "the separator to join several values with")
+	header := fs.Bool("header", false, "print a header row with the paths (tsv and csv)")
+	source := fs.Bool("source", false, "include the file name and message number (from 1) in the output")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	var (
+		paths []fieldPath
+		files = fs.Args()
+	)
+	for len(files) > 0 {
+		p, ok := parsePath(files[0])
+
+		if !ok {
+			break
+		}
+		paths = append(paths, p)
+		files = files[1:]
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(e.stderr, "hl7 get: no paths given")
+		fs.Usage()
+		return exitUsage
+	}
+	if *repeat != "join" && *repeat != "first" {
+		fmt.Fprintf(e.stderr, "hl7 get: invalid -repeat value %q: must be join or first\n", *repeat)
+		return exitUsage
+	}
+	w := bufio.NewWriter(e.stdout)
+	defer w.Flush()
+
+	out, err := newRowWriter(*format, w)
+
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 get:", err)
+		return exitUsage
+	}
+	var columns []string
+
+	if *source {
+		columns = append(columns, "file", "message")
+	}
+	for _, p := range paths {
+		columns = append(columns, p.name)
+	}
+	if *header {
+		out.header(columns)
+	}
+	var failed bool
+
+	err = eachInput(e, files, func(name string, r *hl7.Reader) error {
+		for i := 1; ; i++ {
+			msg, err := r.ReadMessage()
+
+			if err == io.EOF {
+				return nil
+			} else if err == hl7.ErrInvalidHeader {
+				failed = true
+				fmt.Fprintf(e.stderr, "hl7 get: %s: message %d: %v\n", name, i, err)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			var row []interface{}
+
+			if *source {
+				row = append(row, name, i)
+			}
+			for _, p := range paths {
+				values := p.values(msg.Bytes())
+
+				switch {
+				case *repeat == "first" && len(values) == 0:
+					row = append(row, nil)
+				case *repeat == "first":
+					row = append(row, values[0])
+				default:
+					row = append(row, values)
+				}
+			}
+			if err = out.row(columns, row, *sep); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 get:", err)
+		return exitError
+	}
+	if failed {
+		return exitError
+	}
+	return exitOK
+}
+
+// rowWriter writes the rows of values printed by the get command. Each value
+// is a string, an int, a []string or nil.
+type rowWriter interface {
+	header(columns []string) error
+	row(columns []string, values []interface{}, sep string) error
+}
+
+// newRowWriter returns a rowWriter for the format.
+func newRowWriter(format string, w io.Writer) (rowWriter, error) {
+	switch format {
+	case "tsv":
+		return &tsvWriter{w: w}, nil
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case "json":
+		return &jsonWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("invalid -format value %q: must be tsv, csv or json", format)
+}
+
+// cellString formats a value for TSV or CSV.
+func cellString(value interface{}, sep string) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case []string:
+		return strings.Join(v, sep)
+	}
+	return ""
+}
+
+// tsvEscaper escapes the characters that would break up a TSV row.
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+type tsvWriter struct {
+	w io.Writer
+}
+
+func (t *tsvWriter) header(columns []string) error {
+	_, err := fmt.Fprintln(t.w, strings.Join(columns, "\t"))
+	return err
+}
+
+func (t *tsvWriter) row(columns []string, values []interface{}, sep string) error {
+	cells := make([]string, len(values))
+
+	for i, v := range values {
+		cells[i] = tsvEscaper.Replace(cellString(v, sep))
+	}
+	_, err := fmt.Fprintln(t.w, strings.Join(cells, "\t"))
+	return err
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) header(columns []string) error {
+	c.w.Write(columns)
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) row(columns []string, values []interface{}, sep string) error {
+	cells := make([]string, len(values))
+
+	for i, v := range values {
+		cells[i] = cellString(v, sep)
+	}
+	c.w.Write(cells)
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonWriter writes each row as a JSON object, keyed by column, with the keys
+// in the same order as the columns.
+type jsonWriter struct {
+	w io.Writer
+}
+
+func (j *jsonWriter) header(columns []string) error {
+	return nil
+}
+
+func (j *jsonWriter) row(columns []string, values []interface{}, sep string) error {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if v, ok := v.([]string); ok && v == nil {
+			// Encode no values as an empty array rather than null.
+			values[i] = []string{}
+		}
+		key, _ := json.Marshal(columns[i])
+		value, err := json.Marshal(values[i])
+
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+
+	_, err := j.w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want fieldPath
+		ok   bool
+	}{
+		{"PID-3", fieldPath{name: "PID-3", segment: "PID", field: 3}, true},
+		{"PID-3-1", fieldPath{name: "PID-3-1", segment: "PID", field: 3, component: 1}, true},
+		{"PID-3-4-1", fieldPath{name: "PID-3-4-1", segment: "PID", field: 3, component: 4, sub: 1}, true},
+		{"OBX[2]-5", fieldPath{name: "OBX[2]-5", segment: "OBX", occurrence: 2, field: 5}, true},
+		{"PID-3[2]-1", fieldPath{name: "PID-3[2]-1", segment: "PID", field: 3, repetition: 2, component: 1}, true},
+		{"ZL1-1", fieldPath{name: "ZL1-1", segment: "ZL1", field: 1}, true},
+		{"PID", fieldPath{}, false},
+		{"PID-0", fieldPath{}, false},
+		{"PID-3[0]", fieldPath{}, false},
+		{"PID-3-1-1-1", fieldPath{}, false},
+		{"pid-3", fieldPath{}, false},
+		{"file.hl7", fieldPath{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parsePath(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.want, got, tt.path)
+	}
+}
+
+func TestFieldPathValues(t *testing.T) {
+	data := []byte("MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\r" +
+		"PID|||123^^^MRN&1.2.3&ISO~456^^^SSN||DOE^JOHN\\T\\SON||19620910|M\r" +
+		"OBX|1|NM|HT||1.80\r" +
+		"OBX|2|NM|WT||79\r")
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"MSH-1", []string{"|"}},
+		{"MSH-2", []string{"^~\\&"}},
+		{"MSH-9", []string{"ADT^A01"}},
+		{"MSH-9-2", []string{"A01"}},
+		{"MSH-10", []string{"1"}},
+		{"PID-3-1", []string{"123", "456"}},
+		{"PID-3[2]-1", []string{"456"}},
+		{"PID-3-4", []string{"MRN&1.2.3&ISO", "SSN"}},
+		{"PID-3-4-2", []string{"1.2.3", ""}},
+		{"PID-5-2", []string{"JOHN&SON"}},
+		{"PID-3-9", []string{"", ""}},
+		{"PID-30", nil},
+		{"OBX-5", []string{"1.80", "79"}},
+		{"OBX[2]-5", []string{"79"}},
+		{"OBX[3]-5", nil},
+		{"NK1-1", nil},
+	}
+
+	for _, tt := range tests {
+		p, ok := parsePath(tt.path)
+		assert.True(t, ok, tt.path)
+		assert.Equal(t, tt.want, p.values(data), tt.path)
+	}
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			"tsv",
+			[]string{"get", "MSH-10", "PID-3-1", "PID-5"},
+			"1\t123~456\tDOE^JOHN\n" +
+				"2\t789\tROE^JANE\n",
+		},
+		{
+			"tsv with header and source",
+			[]string{"get", "-header", "-source", "-sep", ",", "PID-3-1"},
+			"file\tmessage\tPID-3-1\n" +
+				"stdin\t1\t123,456\n" +
+				"stdin\t2\t789\n",
+		},
+		{
+			"first",
+			[]string{"get", "-repeat", "first", "PID-3-1", "NK1-2"},
+			"123\t\n" +
+				"789\t\n",
+		},
+		{
+			"csv",
+			[]string{"get", "-format", "csv", "-header", "PID-5", "PID-3-1"},
+			"PID-5,PID-3-1\n" +
+				"DOE^JOHN,123~456\n" +
+				"ROE^JANE,789\n",
+		},
+		{
+			"json",
+			[]string{"get", "-format", "json", "-source", "PID-3-1", "NK1-2"},
+			`{"file":"stdin","message":1,"PID-3-1":["123","456"],"NK1-2":[]}` + "\n" +
+				`{"file":"stdin","message":2,"PID-3-1":["789"],"NK1-2":[]}` + "\n",
+		},
+		{
+			"json first",
+			[]string{"get", "-format", "json", "-repeat", "first", "PID-3-1", "NK1-2"},
+			`{"PID-3-1":"123","NK1-2":null}` + "\n" +
+				`{"PID-3-1":"789","NK1-2":null}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCommand(testMessages, tt.args...)
+			assert.Equal(t, exitOK, code)
+			assert.Equal(t, tt.want, stdout)
+			assert.Empty(t, stderr)
+		})
+	}
+}
+
+func TestGetFiles(t *testing.T) {
+	path, remove := writeTestFile(t, "test.hl7", testMessages)
+	defer remove()
+
+	code, stdout, _ := runCommand("", "get", "-source", "MSH-10", path, path)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, path+"\t1\t1\n"+path+"\t2\t2\n"+path+"\t1\t1\n"+path+"\t2\t2\n", stdout)
+}
+
+func TestGetTruncated(t *testing.T) {
+	code, stdout, stderr := runCommand(testTruncatedMessages, "get", "-source", "MSH-10")
+	assert.Equal(t, exitError, code)
+	assert.Equal(t, "stdin\t1\t1\nstdin\t3\t3\n", stdout)
+	assert.Equal(t, "hl7 get: stdin: message 2: message does not begin with an MSH segment\n", stderr)
+}
+
+func TestGetUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stderr string
+	}{
+		{"no paths", []string{"get", "file.hl7"}, "no paths given"},
+		{"invalid format", []string{"get", "-format", "xml", "MSH-10"}, "invalid -format value"},
+		{"invalid repeat", []string{"get", "-repeat", "last", "MSH-10"}, "invalid -repeat value"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCommand("", tt.args...)
+			assert.Equal(t, exitUsage, code)
+			assert.Contains(t, stderr, tt.stderr)
+		})
+	}
+}
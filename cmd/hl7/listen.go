@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+// shutdownTimeout is how long listen waits for connections to finish when it
+// is stopped.
+const shutdownTimeout = 5 * time.Second
+
+func init() {
+	commands["listen"] = &command{
+		usage: "-port port [-host host] [-save dir] [-quiet] [-ack code] [-tls ...] [-rate n] [-count n]",
+		short: "receive messages over MLLP and acknowledge them",
+		long: `
+Listen accepts MLLP connections, prints each message it receives one segment
+per line (as cat does), and acknowledges it with AA, or the code given with
+-ack. It runs until it is interrupted, or until -count messages have been
+received.
+
+With -save, each message is written to a file in the directory (and synced to
+disk) before it is acknowledged. The files are named after the time they were
+received, and are moved to its "done" subdirectory once the message has been
+handled. A message that could not be handled (for example because listen was
+stopped while it waited for -rate) stays in the "pending" subdirectory.
+`,
+		run: runListen,
+	}
+}
+
+func runListen(e *env, args []string) int {
+	cmd := commands["listen"]
+	fs := newFlagSet(e, "listen", cmd)
+	host := fs.String("host", "", "the `address` to listen on (all of them if empty)")
+	port := fs.Int("port", 0, "the `port` to listen on")
+	save := fs.String("save", "", "the `directory` to save the messages to")
+	quiet := fs.Bool("quiet", false, "do not print the messages")
+	ackCode := fs.String("ack", hl7.AckAccept, "the acknowledgment `code` to respond with: AA, AE or AR")
+	readTimeout := fs.Duration("read-timeout", 0, "the longest to spend reading a message (0 means no limit)")
+	writeTimeout := fs.Duration("write-timeout", 0, "the longest to spend writing an acknowledgment (0 means no limit)")
+	idleTimeout := fs.Duration("idle-timeout", 0, "how long to wait for the next message before closing a connection (0 means no limit)")
+	rate := fs.Float64("rate", 0, "the most messages to acknowledge per second (0 means no limit)")
+	count := fs.Int64("count", 0, "stop after this many messages (0 means no limit)")
+
+	var tlsOpts tlsFlags
+	tlsOpts.register(fs, true)
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *port <= 0 {
+		fmt.Fprintln(e.stderr, "hl7 listen: -port is required")
+		return exitUsage
+	}
+	switch *ackCode {
+	case hl7.AckAccept, hl7.AckError, hl7.AckReject:
+	default:
+		fmt.Fprintf(e.stderr, "hl7 listen: invalid -ack value %q: must be AA, AE or AR\n", *ackCode)
+		return exitUsage
+	}
+	tlsConfig, err := tlsOpts.config(true)
+
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 listen:", err)
+		return exitUsage
+	}
+	pal, _ := choosePalette("auto", e.stdout)
+
+	var (
+		ctx, stop = context.WithCancel(e.ctx)
+		pace      = newPacer(*rate)
+		w         = bufio.NewWriter(e.stdout)
+		printer   = &catPrinter{w: w, pal: pal}
+		lock      sync.Mutex
+		received  int64
+	)
+	defer stop()
+
+	s := &hl7.Server{
+		Handler: hl7.HandlerFunc(func(hctx context.Context, msg *hl7.Message) (*hl7.Message, error) {
+			if err := pace.wait(hctx); err != nil {
+				return nil, err
+			}
+			if !*quiet {
+				lock.Lock()
+				printer.compact(msg)
+				w.Flush()
+				lock.Unlock()
+			}
+			if n := atomic.AddInt64(&received, 1); *count > 0 && n >= *count {
+				stop()
+			}
+			return msg.Ack(*ackCode, nil)
+		}),
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+		TLSConfig:    tlsConfig,
+		ErrorLog:     log.New(e.stderr, "", log.LstdFlags),
+	}
+	if *save != "" {
+		store, err := hl7.NewFileStore(*save)
+
+		if err != nil {
+			fmt.Fprintln(e.stderr, "hl7 listen:", err)
+			return exitError
+		}
+		s.Store = store
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(*host, strconv.Itoa(*port)))
+
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 listen:", err)
+		return exitError
+	}
+	fmt.Fprintf(e.stderr, "hl7 listen: listening on %s\n", l.Addr())
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := s.Shutdown(sctx); err != nil {
+			s.Close()
+		}
+	}()
+	err = s.Serve(l)
+	stop()
+	<-done
+
+	if err != hl7.ErrServerClosed {
+		fmt.Fprintln(e.stderr, "hl7 listen:", err)
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mylanconnolly/hl7"
+	"github.com/stretchr/testify/assert"
+)
+
+// freePort returns a port that nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitForListener waits until something is accepting connections on addr.
+func waitForListener(t *testing.T, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("nothing listening on %s", addr)
+}
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		code  string
+		quiet bool
+	}{
+		{"default", nil, hl7.AckAccept, false},
+		{"negative", []string{"-ack", "AE"}, hl7.AckError, false},
+		{"quiet", []string{"-quiet"}, hl7.AckAccept, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "listen")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			port := freePort(t)
+			args := append([]string{"listen", "-host", "127.0.0.1", "-port", strconv.Itoa(port), "-count", "2", "-save", dir}, tt.args...)
+
+			type result struct {
+				code           int
+				stdout, stderr string
+			}
+			done := make(chan result, 1)
+
+			go func() {
+				code, stdout, stderr := runCommand("", args...)
+				done <- result{code, stdout, stderr}
+			}()
+			addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+			waitForListener(t, addr)
+
+			c := &hl7.Client{Addr: addr}
+			defer c.Close()
+
+			for _, id := range []string{"1", "2"} {
+				msg, _ := hl7.NewMessage([]byte("MSH|^~\\&|||||||ADT^A01|" + id + "|P|2.5\rPID|1\r"))
+				ack, _ := c.Send(context.Background(), msg)
+
+				if assert.NotNil(t, ack) {
+					assert.Equal(t, tt.code, ack.Code)
+				}
+			}
+			select {
+			case res := <-done:
+				assert.Equal(t, exitOK, res.code)
+				assert.Contains(t, res.stderr, "listening on "+addr)
+
+				if tt.quiet {
+					assert.Empty(t, res.stdout)
+				} else {
+					assert.Equal(t, "MSH|^~\\&|||||||ADT^A01|1|P|2.5\nPID|1\n\nMSH|^~\\&|||||||ADT^A01|2|P|2.5\nPID|1\n", res.stdout)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("listen did not stop after -count messages")
+			}
+			saved, _ := filepath.Glob(filepath.Join(dir, "done", "*.hl7"))
+			assert.Len(t, saved, 2)
+		})
+	}
+}
+
+func TestListenUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stderr string
+	}{
+		{"no port", []string{"listen"}, "-port is required"},
+		{"invalid ack", []string{"listen", "-port", "2575", "-ack", "CA"}, `invalid -ack value "CA"`},
+		{"tls without cert", []string{"listen", "-port", "2575", "-tls"}, "required with -tls"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCommand("", tt.args...)
+			assert.Equal(t, exitUsage, code)
+			assert.Contains(t, stderr, tt.stderr)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Command hl7 is a tool for working with HL7 files and MLLP connections.
+//
+// Usage:
+//
+//	hl7 <command> [arguments]
+//
+// Run "hl7 help <command>" for more information about a command.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+// Exit codes shared by the commands.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// command is a subcommand of the tool.
+type command struct {
+	usage string // The arguments, as shown in the usage message.
+	short string // A one line description.
+	long  string // A longer description, shown by "hl7 help <command>".
+	run   func(env *env, args []string) int
+}
+
+// commands holds the subcommands, keyed by name. They register themselves in
+// their own files.
+var commands = map[string]*command{}
+
+// env holds the standard streams, so that commands can be tested without
+// touching the real ones, along with a context that is cancelled when the
+// command should stop.
+type env struct {
+	ctx    context.Context
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	ctx, cancel := interruptContext()
+	code := run(&env{ctx: ctx, stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, os.Args[1:])
+	cancel()
+	os.Exit(code)
+}
+
+// run runs the command named by the first argument, and returns the exit code.
+func run(e *env, args []string) int {
+	if len(args) == 0 {
+		usage(e.stderr)
+		return exitUsage
+	}
+	name := args[0]
+
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) > 1 {
+			if cmd, ok := commands[args[1]]; ok {
+				newFlagSet(e, args[1], cmd).Usage()
+				return exitOK
+			}
+		}
+		usage(e.stdout)
+		return exitOK
+	}
+	cmd, ok := commands[name]
+
+	if !ok {
+		fmt.Fprintf(e.stderr, "hl7: unknown command %q\n", name)
+		usage(e.stderr)
+		return exitUsage
+	}
+	return cmd.run(e, args[1:])
+}
+
+// usage writes the list of commands.
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: hl7 <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].short)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "hl7 help <command>" for more information about a command.`)
+}
+
+// newFlagSet returns a flag set for the command, which writes its usage
+// message and errors to stderr.
+func newFlagSet(e *env, name string, cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hl7 %s %s\n\n%s\n", name, cmd.usage, strings.TrimSpace(cmd.long))
+
+		if hasFlags(fs) {
+			fmt.Fprintln(fs.Output(), "\nFlags:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// hasFlags reports whether any flags have been defined in the flag set.
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+// parseFlags parses the arguments, and returns the exit code to use if the
+// command should not continue.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return exitOK, false
+	} else if err != nil {
+		return exitUsage, false
+	}
+	return 0, true
+}
+
+// eachInput calls fn with a Reader for each of the named files in turn, or
+// for stdin if there are none. A name of "-" also means stdin. Compressed
+// input is decompressed transparently. Errors opening a file are reported by
+// returning them, and stop the iteration.
+func eachInput(e *env, names []string, fn func(name string, r *hl7.Reader) error) error {
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	for _, name := range names {
+		if name == "-" {
+			r, err := hl7.NewDecompressingReader(e.stdin)
+
+			if err != nil {
+				return fmt.Errorf("stdin: %w", err)
+			}
+			if err = fn("stdin", r); err != nil {
+				return err
+			}
+			continue
+		}
+		r, closer, err := hl7.OpenFile(name)
+
+		if err != nil {
+			return err
+		}
+		err = fn(name, r)
+		closer.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
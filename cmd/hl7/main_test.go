@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMessages = "MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\r" +
+	"PID|||123^^^MRN~456^^^SSN||DOE^JOHN||19620910|M\r" +
+	"MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|2|P|2.5\r" +
+	"PID|||789^^^MRN||ROE^JANE\r"
+
+// testTruncatedMessages has a fragment too short to be a message between two
+// messages.
+const testTruncatedMessages = "MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\r" +
+	"MSH|^\r" +
+	"MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|3|P|2.5\r"
+
+// runCommand runs the tool with the arguments and input, and returns the exit
+// code along with what was written to stdout and stderr.
+func runCommand(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+
+	code := run(&env{ctx: context.Background(), stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr}, args)
+	return code, stdout.String(), stderr.String()
+}
+
+// writeTestFile writes the data to a file in a new temporary directory, and
+// returns its path along with a function that removes it.
+func writeTestFile(t *testing.T, name, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "hl7cmd")
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"no arguments", nil, exitUsage, "", "Usage: hl7"},
+		{"help", []string{"help"}, exitOK, "Commands:", ""},
+		{"help for command", []string{"help", "cat"}, exitOK, "", "Usage: hl7 cat"},
+		{"unknown command", []string{"frobnicate"}, exitUsage, "", `unknown command "frobnicate"`},
+		{"unknown flag", []string{"cat", "-frobnicate"}, exitUsage, "", "flag provided but not defined"},
+		{"missing file", []string{"cat", "missing.hl7"}, exitError, "", "missing.hl7"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCommand("", tt.args...)
+			assert.Equal(t, tt.code, code)
+			assert.Contains(t, stdout, tt.stdout)
+			assert.Contains(t, stderr, tt.stderr)
+		})
+	}
+}
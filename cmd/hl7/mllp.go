@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// This file holds what the send and listen commands have in common.
+
+// tlsFlags holds the TLS flags of the send and listen commands.
+type tlsFlags struct {
+	enabled    bool
+	cert       string
+	key        string
+	ca         string
+	serverName string
+	insecure   bool
+}
+
+// register defines the flags in the flag set. The meaning of some of them
+// depends on whether they are for a server.
+func (f *tlsFlags) register(fs *flag.FlagSet, server bool) {
+	fs.BoolVar(&f.enabled, "tls", false, "use TLS")
+
+	if server {
+		fs.StringVar(&f.cert, "cert", "", "the PEM `file` holding the server certificate (required with -tls)")
+		fs.StringVar(&f.key, "key", "", "the PEM `file` holding the server's private key (required with -tls)")
+		fs.StringVar(&f.ca, "ca", "", "the PEM `file` holding the CA certificates to verify client certificates with; if set, clients must present one")
+		return
+	}
+	fs.StringVar(&f.cert, "cert", "", "the PEM `file` holding a client certificate to present")
+	fs.StringVar(&f.key, "key", "", "the PEM `file` holding the client certificate's private key")
+	fs.StringVar(&f.ca, "ca", "", "the PEM `file` holding the CA certificates to verify the server with, instead of the system's")
+	fs.StringVar(&f.serverName, "server-name", "", "the `name` to verify the server certificate against, instead of the host")
+	fs.BoolVar(&f.insecure, "insecure", false, "do not verify the server certificate")
+}
+
+// config returns the TLS configuration described by the flags, or nil if TLS
+// is not enabled.
+func (f *tlsFlags) config(server bool) (*tls.Config, error) {
+	if !f.enabled {
+		if f.cert != "" || f.key != "" || f.ca != "" || f.serverName != "" || f.insecure {
+			return nil, errors.New("TLS flags given without -tls")
+		}
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: f.serverName, InsecureSkipVerify: f.insecure}
+
+	if (f.cert == "") != (f.key == "") {
+		return nil, errors.New("-cert and -key must be given together")
+	}
+	if server && f.cert == "" {
+		return nil, errors.New("-cert and -key are required with -tls")
+	}
+	if f.cert != "" {
+		cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if f.ca != "" {
+		data, err := ioutil.ReadFile(f.ca)
+
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", f.ca)
+		}
+		if server {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = pool
+		}
+	}
+	return config, nil
+}
+
+// pacer spaces out events so that they happen at no more than a given rate.
+// A nil pacer does not wait at all.
+type pacer struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time
+}
+
+// newPacer returns a pacer for the rate, in events per second, or nil if the
+// rate is not positive.
+func newPacer(rate float64) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait waits until the next event may happen, or the context is done.
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return ctx.Err()
+	}
+	p.lock.Lock()
+	now := time.Now()
+	at := p.next
+
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval)
+	p.lock.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// interruptContext returns a context that is cancelled when the process is
+// interrupted, so that commands can stop cleanly.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// the directory, and returns their paths.
+func writeTestCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certPath, keyPath
+}
+
+func TestSendListenTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+	port := strconv.Itoa(freePort(t))
+	done := make(chan int, 1)
+
+	// The same certificate serves as the server's, the client's and the CA.
+	go func() {
+		code, _, _ := runCommand("", "listen", "-host", "127.0.0.1", "-port", port, "-count", "2", "-quiet",
+			"-tls", "-cert", cert, "-key", key, "-ca", cert)
+		done <- code
+	}()
+	addr := net.JoinHostPort("127.0.0.1", port)
+	waitForListener(t, addr)
+
+	code, stdout, stderr := runCommand(testMessages, "send", "-host", addr, "-tls", "-ca", cert)
+	assert.Equal(t, exitError, code, "the server requires a client certificate")
+	assert.Empty(t, stdout)
+	assert.NotEmpty(t, stderr)
+
+	code, stdout, stderr = runCommand(testMessages, "send", "-host", addr, "-tls", "-ca", cert, "-cert", cert, "-key", key)
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, "1\tAA\n2\tAA\n", stdout)
+	assert.Empty(t, stderr)
+
+	select {
+	case code := <-done:
+		assert.Equal(t, exitOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listen did not stop after -count messages")
+	}
+}
+
+func TestTLSFlagsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := writeTestCert(t, dir)
+
+	tests := []struct {
+		name   string
+		flags  tlsFlags
+		server bool
+		nilCfg bool
+		err    bool
+	}{
+		{"disabled", tlsFlags{}, false, true, false},
+		{"flags without tls", tlsFlags{ca: cert}, false, true, true},
+		{"client", tlsFlags{enabled: true}, false, false, false},
+		{"client with ca", tlsFlags{enabled: true, ca: cert}, false, false, false},
+		{"client with certificate", tlsFlags{enabled: true, cert: cert, key: key}, false, false, false},
+		{"key without cert", tlsFlags{enabled: true, key: key}, false, true, true},
+		{"invalid ca", tlsFlags{enabled: true, ca: key}, false, true, true},
+		{"server", tlsFlags{enabled: true, cert: cert, key: key}, true, false, false},
+		{"server without cert", tlsFlags{enabled: true}, true, true, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.flags.config(tt.server)
+			assert.Equal(t, tt.err, err != nil, "%v", err)
+			assert.Equal(t, tt.nilCfg, config == nil)
+		})
+	}
+}
+
+func TestPacer(t *testing.T) {
+	var p *pacer
+	assert.Nil(t, p.wait(context.Background()))
+	assert.Nil(t, newPacer(0))
+
+	p = newPacer(100)
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, p.wait(context.Background()))
+	}
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The second event is a long way off, so only the context ends the wait.
+	p = newPacer(0.001)
+	assert.Nil(t, p.wait(context.Background()))
+	assert.Equal(t, context.Canceled, p.wait(ctx))
+}
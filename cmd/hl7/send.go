@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+func init() {
+	commands["send"] = &command{
+		usage: "-host host:port [-tls ...] [-timeout d] [-rate n] [file ...]",
+		short: "send messages over MLLP and print the acknowledgments",
+		long: `
+Send sends each message in the files (or stdin, if there are none, or for a
+file named "-") over MLLP, one at a time, waiting for each to be acknowledged
+before sending the next. For each message, it prints the control ID (MSH-10),
+the acknowledgment code and any text that came with it, separated by tabs.
+
+Sending carries on after a negative acknowledgment, but stops if a message
+cannot be delivered at all. Anything in the input that is too short to be a
+message is reported and skipped. The exit code is 1 if any message was not
+acknowledged with AA or CA, or was skipped.
+`,
+		run: runSend,
+	}
+}
+
+func runSend(e *env, args []string) int {
+	cmd := commands["send"]
+	fs := newFlagSet(e, "send", cmd)
+	host := fs.String("host", "", "the `host:port` to send the messages to")
+	connectTimeout := fs.Duration("connect-timeout", 10*time.Second, "how long to wait for the connection to be made")
+	timeout := fs.Duration("timeout", hl7.DefaultAckTimeout, "how long to wait for each acknowledgment")
+	retries := fs.Int("retries", 0, "the number of times to resend a message after a timeout, connection error or negative acknowledgment")
+	rate := fs.Float64("rate", 0, "the most messages to send per second (0 means no limit)")
+
+	var tlsOpts tlsFlags
+	tlsOpts.register(fs, false)
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *host == "" {
+		fmt.Fprintln(e.stderr, "hl7 send: -host is required")
+		return exitUsage
+	}
+	tlsConfig, err := tlsOpts.config(false)
+
+	if err != nil {
+		fmt.Fprintln(e.stderr, "hl7 send:", err)
+		return exitUsage
+	}
+	client := &hl7.Client{
+		Addr:         *host,
+		Dialer:       &net.Dialer{Timeout: *connectTimeout},
+		TLSConfig:    tlsConfig,
+		AckTimeout:   *timeout,
+		WriteTimeout: *timeout,
+		MaxRetries:   *retries,
+	}
+	defer client.Close()
+
+	var (
+		w      = bufio.NewWriter(e.stdout)
+		pace   = newPacer(*rate)
+		failed bool
+	)
+	defer w.Flush()
+
+	err = eachInput(e, fs.Args(), func(name string, r *hl7.Reader) error {
+		for i := 1; ; i++ {
+			msg, err := r.ReadMessage()
+
+			if err == io.EOF {
+				return nil
+			} else if err == hl7.ErrInvalidHeader {
+				failed = true
+				fmt.Fprintf(e.stderr, "hl7 send: %s: message %d: %v\n", name, i, err)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if err = pace.wait(e.ctx); err != nil {
+				return err
+			}
+			ack, err := client.Send(e.ctx, msg)
+			controlID := firstValue(msg, "MSH-10")
+
+			var nak *hl7.NegativeAckError
+
+			switch {
+			case errors.Is(err, hl7.ErrNoControlID):
+				failed = true
+				fmt.Fprintf(e.stderr, "hl7 send: %s: message %d: %v\n", name, i, err)
+				continue
+			case errors.As(err, &nak):
+				failed = true
+			case err != nil:
+				return fmt.Errorf("%s: message %d: %w", name, i, err)
+			}
+			if ack == nil {
+				// Enhanced mode, where no accept acknowledgment was asked for.
+				fmt.Fprintf(w, "%s\t-\n", controlID)
+			} else if ack.Text != "" {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", controlID, ack.Code, tsvEscaper.Replace(ack.Text))
+			} else {
+				fmt.Fprintf(w, "%s\t%s\n", controlID, ack.Code)
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		w.Flush()
+		fmt.Fprintln(e.stderr, "hl7 send:", err)
+		return exitError
+	}
+	if failed {
+		return exitError
+	}
+	return exitOK
+}
+
+// firstValue returns the first value at the path within the message, or "" if
+// there is none. The path must be valid.
+func firstValue(msg *hl7.Message, path string) string {
+	p, _ := parsePath(path)
+
+	if values := p.values(msg.Bytes()); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mylanconnolly/hl7/hl7test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []hl7test.Action
+		code   int
+		stdout string
+	}{
+		{"accepted", nil, exitOK, "1\tAA\n2\tAA\n"},
+		{"rejected", []hl7test.Action{hl7test.Ack("AE")}, exitError, "1\tAE\n2\tAA\n"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			s := hl7test.NewServer(nil)
+			defer s.Close()
+
+			s.Script(tt.script...)
+
+			code, stdout, stderr := runCommand(testMessages, "send", "-host", s.Addr)
+			assert.Equal(t, tt.code, code)
+			assert.Equal(t, tt.stdout, stdout)
+			assert.Empty(t, stderr)
+			assert.Len(t, s.Messages(), 2)
+		})
+	}
+}
+
+func TestSendTruncated(t *testing.T) {
+	s := hl7test.NewServer(nil)
+	defer s.Close()
+
+	code, stdout, stderr := runCommand(testTruncatedMessages, "send", "-host", s.Addr)
+	assert.Equal(t, exitError, code)
+	assert.Equal(t, "1\tAA\n3\tAA\n", stdout)
+	assert.Equal(t, "hl7 send: stdin: message 2: message does not begin with an MSH segment\n", stderr)
+	assert.Len(t, s.Messages(), 2)
+}
+
+func TestSendRate(t *testing.T) {
+	s := hl7test.NewServer(nil)
+	defer s.Close()
+
+	start := time.Now()
+	code, _, _ := runCommand(testMessages+testMessages, "send", "-host", s.Addr, "-rate", "20")
+	assert.Equal(t, exitOK, code)
+
+	// Four messages at 20 per second take at least three intervals of 50ms.
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+}
+
+func TestSendUnreachable(t *testing.T) {
+	s := hl7test.NewServer(nil)
+	addr := s.Addr
+	s.Close()
+
+	code, stdout, stderr := runCommand(testMessages, "send", "-host", addr, "-connect-timeout", "1s")
+	assert.Equal(t, exitError, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, "message 1")
+}
+
+func TestSendUsage(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stderr string
+	}{
+		{"no host", []string{"send"}, "-host is required"},
+		{"invalid timeout", []string{"send", "-host", "localhost:2575", "-timeout", "soon"}, "invalid value"},
+		{"tls flags without tls", []string{"send", "-host", "localhost:2575", "-insecure"}, "without -tls"},
+		{"cert without key", []string{"send", "-host", "localhost:2575", "-tls", "-cert", "cert.pem"}, "must be given together"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, stderr := runCommand("", tt.args...)
+			assert.Equal(t, exitUsage, code)
+			assert.Contains(t, stderr, tt.stderr)
+		})
+	}
+}
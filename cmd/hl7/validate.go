@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+// exitWarning is the exit code of the validate command when the worst problem
+// it found was a warning.
+const exitWarning = 3
+
+// Diagnostic severities, from least to most severe.
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+func init() {
+	commands["validate"] = &command{
+		usage: "[-version v] [-profile file] [-format text|json] [file ...]",
+		short: "check messages against an HL7 version or profile",
+		long: `
+Validate checks every message in the files (or stdin, if there are none, or for
+a file named "-"), and prints a diagnostic for each problem it finds, giving the
+file, the message number (from 1), the path within the message, the severity
+and a description. With -format json, each diagnostic is printed as a JSON
+object on its own line instead, with the keys file, message, segment,
+occurrence, path, severity and description.
+
+Every message is checked for a well-formed header and segment IDs, for the
+header fields that every message needs, and for values that do not suit the
+data types of the fields of the common segments (dates, times and numbers).
+With -version, MSH-12 must match the given version.
+
+A profile adds rules for a particular kind of message. It is a JSON file like
+this, where every key is optional, and the severity of a field rule defaults to
+"error":
+
+	{
+	  "version": "2.5.1",
+	  "messageTypes": ["ADT^A01", "ADT^A04"],
+	  "segments": {
+	    "PID": {
+	      "required": true,
+	      "max": 1,
+	      "fields": {
+	        "3": {"required": true, "maxRepetitions": 5},
+	        "5": {"required": true, "maxLength": 250},
+	        "8": {"values": ["F", "M", "O", "U"], "severity": "warning"},
+	        "19": {"pattern": "^\\d{3}-\\d{2}-\\d{4}$"}
+	      }
+	    }
+	  }
+	}
+
+The exit code reflects the worst severity found: 0 if there was nothing worse
+than info, 3 for warnings, and 1 for errors (or if an input could not be read).
+`,
+		run: runValidate,
+	}
+}
+
+// diagnostic is a problem found by the validate command.
+type diagnostic struct {
+	File        string `json:"file"`
+	Message     int    `json:"message"`
+	Segment     string `json:"segment,omitempty"`
+	Occurrence  int    `json:"occurrence,omitempty"`
+	Path        string `json:"path"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+}
+
+func (d diagnostic) String() string {
+	return fmt.Sprintf("%s: message %d: %s: %s: %s", d.File, d.Message, d.Path, d.Severity, d.Description)
+}
+
+// profile holds the rules for a particular kind of message. See the help for
+// the validate command for the format.
+type profile struct {
+	Version      string                 `json:"version"`
+	MessageTypes []string               `json:"messageTypes"`
+	Segments     map[string]segmentRule `json:"segments"`
+}
+
+type segmentRule struct {
+	Required bool                 `json:"required"`
+	Max      int                  `json:"max"`
+	Fields   map[string]fieldRule `json:"fields"`
+}
+
+type fieldRule struct {
+	Required       bool     `json:"required"`
+	MaxLength      int      `json:"maxLength"`
+	MaxRepetitions int      `json:"maxRepetitions"`
+	Values         []string `json:"values"`
+	Pattern        string   `json:"pattern"`
+	Severity       string   `json:"severity"`
+
+	pattern *regexp.Regexp
+}
+
+// loadProfile reads and checks a profile.
+func loadProfile(path string) (*profile, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+	var p profile
+
+	if err = json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for segment, srule := range p.Segments {
+		for key, frule := range srule.Fields {
+			if n, err := strconv.Atoi(key); err != nil || n < 1 {
+				return nil, fmt.Errorf("%s: %s: invalid field number %q", path, segment, key)
+			}
+			switch frule.Severity {
+			case "":
+				frule.Severity = severityError
+			case severityInfo, severityWarning, severityError:
+			default:
+				return nil, fmt.Errorf("%s: %s-%s: invalid severity %q", path, segment, key, frule.Severity)
+			}
+			if frule.Pattern != "" {
+				if frule.pattern, err = regexp.Compile(frule.Pattern); err != nil {
+					return nil, fmt.Errorf("%s: %s-%s: %w", path, segment, key, err)
+				}
+			}
+			srule.Fields[key] = frule
+		}
+	}
+	return &p, nil
+}
+
+// knownVersions are the HL7 v2 versions that may appear in MSH-12.
+var knownVersions = map[string]bool{
+	"2.1": true, "2.2": true, "2.3": true, "2.3.1": true, "2.4": true, "2.5": true, "2.5.1": true,
+	"2.6": true, "2.7": true, "2.7.1": true, "2.8": true, "2.8.1": true, "2.8.2": true, "2.9": true,
+}
+
+// Patterns for the primitive data types that are checked.
+var (
+	segmentIDRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9]{2}$`)
+	dateRegexp      = regexp.MustCompile(`^\d{4}(\d{2}(\d{2})?)?$`)
+	timeRegexp      = regexp.MustCompile(`^\d{4}(\d{2}(\d{2}(\d{2}(\d{2}(\d{2}(\.\d{1,4})?)?)?)?)?)?([+-]\d{4})?$`)
+	numberRegexp    = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`)
+	setIDRegexp     = regexp.MustCompile(`^[1-9]\d*$`)
+)
+
+// validator checks messages for the validate command.
+type validator struct {
+	version string
+	profile *profile
+}
+
+// validate returns the problems with the raw message data. The File and
+// Message of the diagnostics are left for the caller to fill in.
+func (v *validator) validate(data []byte) []diagnostic {
+	var diags []diagnostic
+
+	add := func(segment string, occurrence int, path, severity, format string, args ...interface{}) {
+		diags = append(diags, diagnostic{
+			Segment:     segment,
+			Occurrence:  occurrence,
+			Path:        path,
+			Severity:    severity,
+			Description: fmt.Sprintf(format, args...),
+		})
+	}
+	if len(data) < 8 || !bytes.HasPrefix(data, []byte("MSH")) {
+		add("MSH", 1, "MSH", severityError, "message does not begin with an MSH segment")
+		return diags
+	}
+	var (
+		fieldSep    = data[3]
+		compSep     = data[4]
+		repeat      = data[5]
+		occurrences = map[string]int{}
+	)
+	for i, line := range segmentLines(data) {
+		id := string(line)
+
+		if len(line) > 3 {
+			id = string(line[:3])
+		}
+		if !segmentIDRegexp.MatchString(id) || (len(line) > 3 && line[3] != fieldSep) {
+			add("", 0, fmt.Sprintf("segment %d", i+1), severityError, "invalid segment ID in %q", truncate(string(line), 20))
+			continue
+		}
+		occurrences[id]++
+		n := occurrences[id]
+
+		if id == "MSH" && (i > 0 || n > 1) {
+			add(id, n, segmentPath(id, n), severityError, "MSH segment after the start of the message")
+			continue
+		}
+		v.checkDataTypes(line, id, n, compSep, repeat, add)
+
+		if v.profile != nil {
+			v.checkFieldRules(line, id, n, repeat, add)
+		}
+	}
+	header := segmentLines(data)[0]
+	msgType, _ := lineField(header, 9)
+
+	for _, f := range []int{9, 10, 11, 12} {
+		if value, _ := lineField(header, f); len(value) == 0 {
+			add("MSH", 1, fmt.Sprintf("MSH-%d", f), severityError, "required field %s is missing", fieldName("MSH", f))
+		}
+	}
+	if value, _ := lineField(header, 7); len(value) == 0 {
+		add("MSH", 1, "MSH-7", severityWarning, "%s is missing", fieldName("MSH", 7))
+	}
+	versionField, _ := lineField(header, 12)
+	version := string(versionField)
+
+	if i := bytes.IndexByte(versionField, compSep); i >= 0 {
+		version = string(versionField[:i])
+	}
+	want := v.version
+
+	if want == "" && v.profile != nil {
+		want = v.profile.Version
+	}
+	switch {
+	case version == "":
+	case want != "" && version != want:
+		add("MSH", 1, "MSH-12", severityError, "version %s does not match %s", version, want)
+	case !knownVersions[version]:
+		add("MSH", 1, "MSH-12", severityWarning, "unknown version %s", version)
+	}
+	if v.profile != nil {
+		v.checkSegmentRules(occurrences, add)
+
+		if len(v.profile.MessageTypes) > 0 && !matchesMessageType(string(msgType), compSep, v.profile.MessageTypes) {
+			add("MSH", 1, "MSH-9", severityError, "message type %s is not one of %s", msgType, strings.Join(v.profile.MessageTypes, ", "))
+		}
+	}
+	return diags
+}
+
+// addFunc records a diagnostic.
+type addFunc func(segment string, occurrence int, path, severity, format string, args ...interface{})
+
+// checkDataTypes checks the values of the fields of the segment against the
+// primitive data types in the definitions, where they are known.
+func (v *validator) checkDataTypes(line []byte, id string, n int, compSep, repeat byte, add addFunc) {
+	for f, def := range segmentFields[id] {
+		if id == "MSH" && f < 2 {
+			continue
+		}
+		field, ok := lineField(line, f+1)
+
+		if !ok || len(field) == 0 {
+			continue
+		}
+		var pattern *regexp.Regexp
+
+		switch def.dataType {
+		case "DT":
+			pattern = dateRegexp
+		case "TS":
+			pattern = timeRegexp
+		case "NM":
+			pattern = numberRegexp
+		case "SI":
+			pattern = setIDRegexp
+		default:
+			continue
+		}
+		for _, rep := range bytes.Split(field, []byte{repeat}) {
+			// The time is the first component of a TS.
+			value := rep
+
+			if i := bytes.IndexByte(value, compSep); i >= 0 && def.dataType == "TS" {
+				value = value[:i]
+			}
+			if len(value) > 0 && !pattern.Match(value) {
+				add(id, n, fmt.Sprintf("%s-%d", segmentPath(id, n), f+1), severityError,
+					"%q is not a valid %s for %s", value, def.dataType, def.name)
+			}
+		}
+	}
+}
+
+// checkFieldRules checks the fields of the segment against the profile.
+func (v *validator) checkFieldRules(line []byte, id string, n int, repeat byte, add addFunc) {
+	srule, ok := v.profile.Segments[id]
+
+	if !ok {
+		return
+	}
+	keys := make([]int, 0, len(srule.Fields))
+
+	for key := range srule.Fields {
+		f, _ := strconv.Atoi(key)
+		keys = append(keys, f)
+	}
+	sort.Ints(keys)
+
+	for _, f := range keys {
+		rule := srule.Fields[strconv.Itoa(f)]
+		path := fmt.Sprintf("%s-%d", segmentPath(id, n), f)
+		field, _ := lineField(line, f)
+
+		if len(field) == 0 {
+			if rule.Required {
+				add(id, n, path, rule.Severity, "required field %s is missing", describeField(id, f))
+			}
+			continue
+		}
+		reps := bytes.Split(field, []byte{repeat})
+
+		if id == "MSH" && f <= 2 {
+			reps = [][]byte{field}
+		}
+		if rule.MaxRepetitions > 0 && len(reps) > rule.MaxRepetitions {
+			add(id, n, path, rule.Severity, "%d repetitions, at most %d allowed", len(reps), rule.MaxRepetitions)
+		}
+		for _, rep := range reps {
+			if rule.MaxLength > 0 && len(rep) > rule.MaxLength {
+				add(id, n, path, rule.Severity, "value is %d characters long, at most %d allowed", len(rep), rule.MaxLength)
+			}
+			if len(rule.Values) > 0 && !contains(rule.Values, string(rep)) {
+				add(id, n, path, rule.Severity, "%q is not one of %s", rep, strings.Join(rule.Values, ", "))
+			}
+			if rule.pattern != nil && !rule.pattern.Match(rep) {
+				add(id, n, path, rule.Severity, "%q does not match %s", rep, rule.Pattern)
+			}
+		}
+	}
+}
+
+// checkSegmentRules checks the number of times each segment occurs against the
+// profile.
+func (v *validator) checkSegmentRules(occurrences map[string]int, add addFunc) {
+	ids := make([]string, 0, len(v.profile.Segments))
+
+	for id := range v.profile.Segments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		rule := v.profile.Segments[id]
+		count := occurrences[id]
+
+		if rule.Required && count == 0 {
+			add(id, 0, id, severityError, "required segment %s is missing", describeSegment(id))
+		}
+		if rule.Max > 0 && count > rule.Max {
+			add(id, 0, id, severityError, "segment occurs %d times, at most %d allowed", count, rule.Max)
+		}
+	}
+}
+
+// matchesMessageType reports whether the message type (MSH-9) matches one of
+// the allowed types, which may leave out the message structure.
+func matchesMessageType(msgType string, compSep byte, allowed []string) bool {
+	parts := strings.Split(msgType, string(compSep))
+
+	for _, a := range allowed {
+		want := strings.Split(a, "^")
+
+		if len(want) > len(parts) {
+			continue
+		}
+		match := true
+
+		for i := range want {
+			if want[i] != parts[i] {
+				match = false
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentPath returns the segment ID, with the occurrence in brackets if it
+// is not the first, as accepted by the get command.
+func segmentPath(id string, occurrence int) string {
+	if occurrence > 1 {
+		return fmt.Sprintf("%s[%d]", id, occurrence)
+	}
+	return id
+}
+
+// describeField returns the name of the field, or its path if it is unknown.
+func describeField(id string, n int) string {
+	if name := fieldName(id, n); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", id, n)
+}
+
+// describeSegment returns the name of the segment, or its ID if it is unknown.
+func describeSegment(id string) string {
+	if name := segmentNames[id]; name != "" {
+		return fmt.Sprintf("%s (%s)", id, name)
+	}
+	return id
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate shortens s to at most n bytes, marking it if it was shortened.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func runValidate(e *env, args []string) int {
+	cmd := commands["validate"]
+	fs := newFlagSet(e, "validate", cmd)
+	version := fs.String("version", "", "the version that MSH-12 must match")
+	profilePath := fs.String("profile", "", "a JSON file of rules to check the messages against")
+	format := fs.String("format", "text", "the output format: text or json (one object per line)")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(e.stderr, "hl7 validate: invalid -format value %q: must be text or json\n", *format)
+		return exitUsage
+	}
+	v := &validator{version: *version}
+
+	if *profilePath != "" {
+		p, err := loadProfile(*profilePath)
+
+		if err != nil {
+			fmt.Fprintln(e.stderr, "hl7 validate:", err)
+			return exitUsage
+		}
+		v.profile = p
+	}
+	w := bufio.NewWriter(e.stdout)
+	defer w.Flush()
+
+	var (
+		messages int
+		counts   = map[string]int{}
+	)
+	report := func(name string, i int, diags []diagnostic) {
+		messages++
+
+		for _, d := range diags {
+			d.File = name
+			d.Message = i
+			counts[d.Severity]++
+
+			if *format == "json" {
+				data, _ := json.Marshal(d)
+				w.Write(append(data, '\n'))
+			} else {
+				fmt.Fprintln(w, d)
+			}
+		}
+	}
+	err := eachInput(e, fs.Args(), func(name string, r *hl7.Reader) error {
+		for i := 1; ; i++ {
+			msg, err := r.ReadMessage()
+
+			if err == io.EOF {
+				return nil
+			} else if err == hl7.ErrInvalidHeader {
+				// A fragment too short to be a message; the validator says the
+				// same about it as about any other message without a header.
+				report(name, i, v.validate(nil))
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			report(name, i, v.validate(msg.Bytes()))
+		}
+	})
+	if *format == "text" {
+		fmt.Fprintf(w, "%s, %s, %s\n",
+			plural(messages, "message"), plural(counts[severityError], "error"), plural(counts[severityWarning], "warning"))
+	}
+	if err != nil {
+		w.Flush()
+		fmt.Fprintln(e.stderr, "hl7 validate:", err)
+		return exitError
+	}
+	switch {
+	case counts[severityError] > 0:
+		return exitError
+	case counts[severityWarning] > 0:
+		return exitWarning
+	}
+	return exitOK
+}
+
+// plural returns the count followed by the noun, made plural if necessary.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testProfile = `{
+	"version": "2.5",
+	"messageTypes": ["ADT^A01"],
+	"segments": {
+		"PID": {
+			"required": true,
+			"max": 1,
+			"fields": {
+				"3": {"required": true, "maxRepetitions": 1},
+				"5": {"maxLength": 8},
+				"8": {"values": ["F", "M"], "severity": "warning"},
+				"19": {"required": true, "severity": "info"},
+				"7": {"pattern": "^19"}
+			}
+		},
+		"PV1": {"required": true}
+	}
+}`
+
+func TestValidatorValidate(t *testing.T) {
+	const header = "MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\r"
+
+	tests := []struct {
+		name    string
+		version string
+		profile bool
+		data    string
+		want    []string
+	}{
+		{"valid", "", false, header + "PID|1||123||DOE^JOHN||19620910|M\r", nil},
+		{"no header", "", false, "PID|1||123\r", []string{"MSH error"}},
+		{"invalid segment ID", "", false, header + "pid|1\r", []string{"segment 2 error"}},
+		{
+			"missing header fields",
+			"",
+			false,
+			"MSH|^~\\&|App|Fac||||||||\r",
+			[]string{"MSH-9 error", "MSH-10 error", "MSH-11 error", "MSH-12 error", "MSH-7 warning"},
+		},
+		{"unknown version", "", false, "MSH|^~\\&|||||20060529||ADT^A01|1|P|9.9\r", []string{"MSH-12 warning"}},
+		{"version mismatch", "2.3", false, header, []string{"MSH-12 error"}},
+		{"version match", "2.5", false, header, nil},
+		{
+			"data types",
+			"",
+			false,
+			header + "PID|x||123||DOE||1962-09-10|M\rOBX|1|NM|HT||1.80|||||||||20060529090131.1234-0500\rOBX|2|NM|WT||79||||abc\r",
+			[]string{"PID-1 error", "PID-7 error", "OBX[2]-9 error"},
+		},
+		{"valid profile", "", true, header + "PID|1||123||DOE||19620910|M|||||||||||123-45-6789\rPV1|1|I\r", nil},
+		{
+			"profile",
+			"",
+			true,
+			"MSH|^~\\&|||||20060529||ORU^R01|1|P|2.5.1\rPID|1||123~456||DOEDOEDOE||20060529|X\rPID|2\r",
+			[]string{
+				"PID-3 error", "PID-5 error", "PID-7 error", "PID-8 warning", "PID-19 info",
+				"PID[2]-3 error", "PID[2]-19 info",
+				"MSH-12 error", "PID error", "PV1 error", "MSH-9 error",
+			},
+		},
+	}
+
+	p, err := loadProfileData(t, testProfile)
+	assert.Nil(t, err)
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{version: tt.version}
+
+			if tt.profile {
+				v.profile = p
+			}
+			var got []string
+
+			for _, d := range v.validate([]byte(tt.data)) {
+				got = append(got, d.Path+" "+d.Severity)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// loadProfileData loads a profile from a temporary file holding the data.
+func loadProfileData(t *testing.T, data string) (*profile, error) {
+	path, remove := writeTestFile(t, "profile.json", data)
+	defer remove()
+
+	return loadProfile(path)
+}
+
+func TestLoadProfileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"invalid JSON", `{`, "unexpected end of JSON input"},
+		{"invalid field", `{"segments": {"PID": {"fields": {"x": {}}}}}`, `invalid field number "x"`},
+		{"invalid severity", `{"segments": {"PID": {"fields": {"3": {"severity": "fatal"}}}}}`, `invalid severity "fatal"`},
+		{"invalid pattern", `{"segments": {"PID": {"fields": {"3": {"pattern": "("}}}}}`, "missing closing )"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadProfileData(t, tt.data)
+
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		input  string
+		code   int
+		stdout []string
+	}{
+		{"valid", []string{"validate"}, testMessages, exitOK, []string{"2 messages, 0 errors, 0 warnings"}},
+		{
+			"errors",
+			[]string{"validate"},
+			testMessages + "MSH|^~\\&|||||x||ADT^A01|3|P|2.5\r",
+			exitError,
+			[]string{`stdin: message 3: MSH-7: error: "x" is not a valid TS for Date/Time of Message`, "3 messages, 1 error, 0 warnings"},
+		},
+		{
+			"warnings",
+			[]string{"validate"},
+			"MSH|^~\\&|||||||ADT^A01|3|P|2.5\r",
+			exitWarning,
+			[]string{"stdin: message 1: MSH-7: warning: Date/Time of Message is missing", "1 message, 0 errors, 1 warning"},
+		},
+		{
+			"truncated message",
+			[]string{"validate"},
+			"MSH|^~\\&|App|Fac|||20060529090131||ADT^A01|1|P|2.5\r" +
+				"MSH|^\r" +
+				"MSH|^~\\&|App|Fac|||x||ADT^A01|3|P|2.5\r",
+			exitError,
+			[]string{
+				"stdin: message 2: MSH: error: message does not begin with an MSH segment",
+				`stdin: message 3: MSH-7: error: "x" is not a valid TS for Date/Time of Message`,
+				"3 messages, 2 errors, 0 warnings",
+			},
+		},
+		{
+			"invalid segment ID",
+			[]string{"validate"},
+			"MSH|^~\\&|App|Fac|||x||ADT^A01|1|P|2.5\rpid|1\r",
+			exitError,
+			[]string{
+				`stdin: message 1: MSH-7: error: "x" is not a valid TS for Date/Time of Message`,
+				`stdin: message 1: segment 2: error: invalid segment ID in "pid|1"`,
+				"1 message, 2 errors, 0 warnings",
+			},
+		},
+		{
+			"json",
+			[]string{"validate", "-format", "json", "-version", "2.4"},
+			testMessages,
+			exitError,
+			[]string{
+				`{"file":"stdin","message":1,"segment":"MSH","occurrence":1,"path":"MSH-12","severity":"error","description":"version 2.5 does not match 2.4"}`,
+				`{"file":"stdin","message":2,"segment":"MSH","occurrence":1,"path":"MSH-12","severity":"error","description":"version 2.5 does not match 2.4"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			code, stdout, stderr := runCommand(tt.input, tt.args...)
+			assert.Equal(t, tt.code, code)
+			assert.Equal(t, strings.Join(tt.stdout, "\n")+"\n", stdout)
+			assert.Empty(t, stderr)
+		})
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	path, remove := writeTestFile(t, "profile.json", testProfile)
+	defer remove()
+
+	code, stdout, _ := runCommand(testMessages, "validate", "-format", "json", "-profile", path)
+	assert.Equal(t, exitError, code)
+
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var d diagnostic
+		assert.Nil(t, json.Unmarshal([]byte(line), &d), line)
+		assert.Equal(t, "stdin", d.File)
+	}
+	assert.Contains(t, stdout, `"path":"PV1","severity":"error","description":"required segment PV1 (Patient Visit) is missing"`)
+}
+
+func TestValidateUsage(t *testing.T) {
+	code, _, stderr := runCommand("", "validate", "-format", "xml")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "invalid -format value")
+
+	code, _, stderr = runCommand("", "validate", "-profile", "missing.json")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "missing.json")
+}
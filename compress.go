@@ -0,0 +1,169 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ErrCompressed is returned by IndexFile and OpenIndexedFile for compressed
+// files, whose messages can't be read at random.
+var ErrCompressed = errors.New("compressed files can't be indexed")
+
+// zlibProbeSize is how much of the input is decompressed to check that input
+// which begins like a zlib stream really is one.
+const zlibProbeSize = 512
+
+// NewDecompressingReader returns a Reader for input that may be compressed. If
+// it begins with the magic bytes of a gzip or zlib stream, it is decompressed
+// transparently; otherwise it is read as is. Concatenated gzip streams, as
+// produced by appending to a .gz file, are read one after another.
+//
+// Since the offsets of the messages are those within the decompressed data,
+// they cannot be used with NewReaderFromOffset or an IndexedFile on the
+// compressed input. (DirPoller, which checkpoints its progress, skips over
+// the decompressed data instead.)
+func NewDecompressingReader(reader io.Reader) (*Reader, error) {
+	// Closing the decompressor only releases it early, so it can be left to
+	// the garbage collector here.
+	r, _, err := decompress(reader)
+
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(r), nil
+}
+
+// OpenFile opens the HL7 file at the given path, decompressing it if it is
+// compressed (see NewDecompressingReader). The returned Closer must be closed
+// once the Reader is no longer needed.
+func OpenFile(path string) (*Reader, io.Closer, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	r, closer, err := decompress(file)
+
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if closer == nil {
+		return NewReader(r), file, nil
+	}
+	return NewReader(r), multiCloser{closer, file}, nil
+}
+
+// decompress wraps the reader in a decompressor if it begins with the magic
+// bytes of a gzip or zlib stream. The decompressor is returned as the Closer,
+// or nil if the input is not compressed.
+func decompress(reader io.Reader) (io.Reader, io.Closer, error) {
+	br := bufio.NewReader(reader)
+	magic, err := br.Peek(2)
+
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	switch {
+	case isGzip(magic):
+		z, err := gzip.NewReader(br)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		return z, z, nil
+	case isZlib(magic) && probeZlib(br):
+		z, err := zlib.NewReader(br)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		return z, z, nil
+	}
+	return br, nil, nil
+}
+
+// isGzip reports whether the data begins with the gzip magic bytes.
+func isGzip(magic []byte) bool {
+	return len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// isZlib reports whether the data begins with a zlib header: the deflate
+// compression method, a window size of at most 32K, and a header checksum that
+// is a multiple of 31. HL7 input, which begins with "MSH" or an MLLP start
+// block, never looks like this, but other junk at the start of a file might,
+// which is why probeZlib is used as well.
+func isZlib(magic []byte) bool {
+	return len(magic) >= 2 && magic[0]&0x0f == 8 && magic[0]>>4 <= 7 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0
+}
+
+// probeZlib reports whether the start of the input, which begins with a zlib
+// header, can actually be decompressed.
+func probeZlib(br *bufio.Reader) bool {
+	data, _ := br.Peek(zlibProbeSize)
+	z, err := zlib.NewReader(bytes.NewReader(data))
+
+	if err != nil {
+		return false
+	}
+	n, err := z.Read(make([]byte, 1))
+
+	return n > 0 || err == io.EOF
+}
+
+// openFromOffset opens the file at the given path, decompressing it if it is
+// compressed, and returns a Reader that resumes at the offset within the
+// (decompressed) data. Offsets in compressed files can only be reached by
+// decompressing everything before them, so that is what happens. The returned
+// Closer must be closed once the Reader is no longer needed.
+func openFromOffset(path string, offset int64) (*Reader, io.Closer, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	src, closer, err := decompress(file)
+
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if closer == nil {
+		r, err := NewReaderFromOffset(file, offset)
+
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return r, file, nil
+	}
+	if _, err = io.CopyN(ioutil.Discard, src, offset); err != nil {
+		closer.Close()
+		file.Close()
+		return nil, nil, err
+	}
+	r := NewReader(src)
+	r.scanner.offset = offset
+
+	return r, multiCloser{closer, file}, nil
+}
+
+// multiCloser closes each of its Closers in turn, and returns the first error.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,119 @@
+package hl7
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func zlibData(data []byte) []byte {
+	var buf bytes.Buffer
+
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+// readControlIDs returns the control IDs of all of the messages in the reader.
+func readControlIDs(t *testing.T, r *Reader) []string {
+	var ids []string
+
+	for {
+		msg, err := r.ReadMessage()
+
+		if err == io.EOF {
+			return ids
+		}
+		if !assert.Nil(t, err) {
+			return ids
+		}
+		ids = append(ids, string(indexField(headerFields(msg.Bytes()), 10)))
+	}
+}
+
+func TestNewDecompressingReader(t *testing.T) {
+	plain := pollerFile("1", "2", "3")
+
+	tests := []struct {
+		name string
+		data []byte
+		ids  []string
+	}{
+		{"plain", plain, []string{"1", "2", "3"}},
+		{"gzip", gzipData(plain), []string{"1", "2", "3"}},
+		{"concatenated gzip", append(gzipData(pollerFile("1")), gzipData(pollerFile("2", "3"))...), []string{"1", "2", "3"}},
+		{"zlib", zlibData(plain), []string{"1", "2", "3"}},
+		{"zlib header followed by junk", append([]byte{0x78, 0x01}, plain...), []string{"1", "2", "3"}},
+		{"empty", nil, nil},
+		{"one byte", []byte("\n"), nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewDecompressingReader(bytes.NewReader(tt.data))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.ids, readControlIDs(t, r))
+		})
+	}
+}
+
+func TestNewDecompressingReaderCorrupt(t *testing.T) {
+	_, err := NewDecompressingReader(bytes.NewReader([]byte{0x1f, 0x8b, 0x00}))
+	assert.NotNil(t, err)
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"batch.hl7", pollerFile("1", "2")},
+		{"batch.hl7.gz", gzipData(pollerFile("1", "2"))},
+		{"batch.hl7.z", zlibData(pollerFile("1", "2"))},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			assert.Nil(t, ioutil.WriteFile(path, tt.data, 0644))
+
+			r, closer, err := OpenFile(path)
+
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, []string{"1", "2"}, readControlIDs(t, r))
+			assert.Nil(t, closer.Close())
+		})
+	}
+
+	_, _, err = OpenFile(filepath.Join(dir, "missing.hl7"))
+	assert.True(t, os.IsNotExist(err))
+}
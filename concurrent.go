@@ -0,0 +1,239 @@
+package hl7
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ConcurrentOption is used to configure EachMessageConcurrent.
+type ConcurrentOption func(*concurrentConfig)
+
+type concurrentConfig struct {
+	ordered       bool
+	collectErrors bool
+}
+
+// Ordered makes EachMessageConcurrent call the MessageFunc one message at a
+// time, in the same order the messages appear in the input. Parsing still
+// happens concurrently, so this is mostly useful when the MessageFunc is cheap
+// compared to parsing, or when the order matters (applying ADT updates, for
+// example).
+func Ordered() ConcurrentOption {
+	return func(c *concurrentConfig) {
+		c.ordered = true
+	}
+}
+
+// CollectErrors makes EachMessageConcurrent carry on after a message fails to
+// parse or the MessageFunc returns an error. All of these errors are returned
+// together as MessageErrors once the input has been exhausted.
+func CollectErrors() ConcurrentOption {
+	return func(c *concurrentConfig) {
+		c.collectErrors = true
+	}
+}
+
+// job is a single message making its way through EachMessageConcurrent.
+type job struct {
+	index  int
+	offset int64
+	data   []byte
+	msg    *Message
+	err    error
+	done   chan struct{}
+}
+
+// EachMessageConcurrent is a concurrent version of EachMessage. A single
+// goroutine reads messages from the input, and the given number of workers
+// parse them and pass them into the MessageFunc. This means the MessageFunc
+// may be called from several goroutines at the same time unless the Ordered
+// option is used.
+//
+// By default, processing stops at the first error, which is returned as a
+// *MessageError. With the CollectErrors option, processing continues and all
+// of the errors are returned as MessageErrors. Errors reading from the input
+// always stop processing. If the context is cancelled, ctx.Err() is returned.
+func (r *Reader) EachMessageConcurrent(ctx context.Context, workers int, fn MessageFunc, opts ...ConcurrentOption) error {
+	var cfg concurrentConfig
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		jobs  = make(chan *job, workers)
+		order chan *job
+		errs  = &errorCollector{collect: cfg.collectErrors, cancel: cancel}
+	)
+	if cfg.ordered {
+		order = make(chan *job, workers)
+	}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		r.produceJobs(ctx, jobs, order, errs)
+	}()
+
+	handle := func(j *job) {
+		if j.err == nil {
+			j.err = fn(j.msg)
+		}
+		if j.err != nil {
+			errs.add(&MessageError{Index: j.index, Offset: j.offset, Err: j.err})
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j, ok := <-jobs:
+					if !ok {
+						return
+					}
+					j.msg, j.err = newMessageAt(j.data, j.offset)
+
+					if cfg.ordered {
+						close(j.done)
+					} else {
+						handle(j)
+					}
+				}
+			}
+		}()
+	}
+
+	if cfg.ordered {
+	deliver:
+		for {
+			select {
+			case <-ctx.Done():
+				break deliver
+			case j, ok := <-order:
+				if !ok {
+					break deliver
+				}
+				select {
+				case <-ctx.Done():
+					break deliver
+				case <-j.done:
+					handle(j)
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	return errs.result(parent)
+}
+
+// produceJobs reads messages from the input and hands them out to the workers
+// until the input is exhausted or the context is cancelled. In ordered mode,
+// each job is also queued on the order channel, so they can be delivered in
+// sequence.
+func (r *Reader) produceJobs(ctx context.Context, jobs, order chan<- *job, errs *errorCollector) {
+	defer close(jobs)
+
+	if order != nil {
+		defer close(order)
+	}
+	for i := 0; ; i++ {
+		r.lock.Lock()
+		data, offset, err := r.readRawContext(ctx)
+		r.lock.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		} else if err == io.EOF {
+			return
+		} else if err != nil {
+			errs.fail(err)
+			return
+		}
+		j := &job{index: i, offset: offset, data: data}
+
+		if order != nil {
+			j.done = make(chan struct{})
+
+			select {
+			case <-ctx.Done():
+				return
+			case order <- j:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- j:
+		}
+	}
+}
+
+// errorCollector gathers the errors encountered by EachMessageConcurrent.
+type errorCollector struct {
+	lock     sync.Mutex
+	collect  bool
+	cancel   context.CancelFunc
+	fatal    error
+	messages MessageErrors
+}
+
+// add records an error for a single message. Unless errors are being
+// collected, this stops all processing.
+func (c *errorCollector) add(err *MessageError) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.collect {
+		c.messages = append(c.messages, err)
+	} else if c.fatal == nil {
+		c.fatal = err
+		c.cancel()
+	}
+}
+
+// fail records an error that stops all processing.
+func (c *errorCollector) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.fatal == nil {
+		c.fatal = err
+		c.cancel()
+	}
+}
+
+func (c *errorCollector) result(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.fatal != nil {
+		return c.fatal
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(c.messages) > 0 {
+		sort.Slice(c.messages, func(i, j int) bool {
+			return c.messages[i].Index < c.messages[j].Index
+		})
+		return c.messages
+	}
+	return nil
+}
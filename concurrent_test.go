@@ -0,0 +1,227 @@
+package hl7
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// numberedMessages returns count messages whose control IDs (MSH-10) are
+// their zero-based position in the input.
+func numberedMessages(count int) string {
+	var b strings.Builder
+
+	for i := 0; i < count; i++ {
+		b.Write(testMessage(msh{controlID: fmt.Sprint(i)}).Bytes())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// controlID returns MSH-10 from the message.
+func controlID(t *testing.T, msg *Message) string {
+	seg, err := msg.ReadSegment()
+	assert.Nil(t, err)
+
+	id, _ := seg.GetSubComponent(9, 0, 0, 0)
+	return string(id)
+}
+
+func TestReaderEachMessageConcurrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		count   int
+		workers int
+		opts    []ConcurrentOption
+	}{
+		{"empty", 0, 4, nil},
+		{"one worker", 50, 1, nil},
+		{"many workers", 500, 8, nil},
+		{"zero workers", 10, 0, nil},
+		{"ordered", 500, 8, []ConcurrentOption{Ordered()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewReader(strings.NewReader(numberedMessages(tt.count)))
+
+			var (
+				lock sync.Mutex
+				seen []string
+			)
+			err := reader.EachMessageConcurrent(context.Background(), tt.workers, func(msg *Message) error {
+				id := controlID(t, msg)
+
+				lock.Lock()
+				seen = append(seen, id)
+				lock.Unlock()
+				return nil
+			}, tt.opts...)
+
+			assert.Nil(t, err)
+			assert.Len(t, seen, tt.count)
+		})
+	}
+
+	t.Run("ordered delivery", func(t *testing.T) {
+		reader := NewReader(strings.NewReader(numberedMessages(100)))
+		next := 0
+
+		err := reader.EachMessageConcurrent(context.Background(), 8, func(msg *Message) error {
+			assert.Equal(t, fmt.Sprint(next), controlID(t, msg))
+			next++
+			return nil
+		}, Ordered())
+
+		assert.Nil(t, err)
+		assert.Equal(t, 100, next)
+	})
+
+	t.Run("stops on first error", func(t *testing.T) {
+		reader := NewReader(strings.NewReader(numberedMessages(100)))
+		errFoo := errors.New("foo")
+
+		err := reader.EachMessageConcurrent(context.Background(), 4, func(msg *Message) error {
+			return errFoo
+		})
+
+		var msgErr *MessageError
+		assert.True(t, errors.As(err, &msgErr))
+		assert.True(t, errors.Is(err, errFoo))
+	})
+
+	t.Run("collects errors", func(t *testing.T) {
+		reader := NewReader(strings.NewReader(numberedMessages(100)))
+
+		err := reader.EachMessageConcurrent(context.Background(), 4, func(msg *Message) error {
+			if id := controlID(t, msg); strings.HasSuffix(id, "7") {
+				return errors.New(id)
+			}
+			return nil
+		}, CollectErrors())
+
+		var errs MessageErrors
+		assert.True(t, errors.As(err, &errs))
+		assert.Len(t, errs, 10)
+
+		for i, err := range errs {
+			assert.Equal(t, i*10+7, err.Index)
+			assert.Equal(t, fmt.Sprint(err.Index), err.Err.Error())
+		}
+	})
+
+	t.Run("short fragment is reported", func(t *testing.T) {
+		reader := NewReader(strings.NewReader(numberedMessages(1) + "MSH|^\r\n" + numberedMessages(2)))
+		var count int32
+
+		err := reader.EachMessageConcurrent(context.Background(), 4, func(msg *Message) error {
+			atomic.AddInt32(&count, 1)
+			return nil
+		}, CollectErrors())
+
+		var errs MessageErrors
+		assert.True(t, errors.As(err, &errs))
+		assert.Len(t, errs, 1)
+		assert.Equal(t, 1, errs[0].Index)
+		assert.Equal(t, ErrInvalidHeader, errs[0].Err)
+		assert.Equal(t, int32(3), count)
+	})
+
+	t.Run("read error is propagated", func(t *testing.T) {
+		reader := NewReader(iotest.TimeoutReader(strings.NewReader("MSH|....")))
+
+		err := reader.EachMessageConcurrent(context.Background(), 4, func(msg *Message) error {
+			return nil
+		}, CollectErrors())
+
+		assert.Equal(t, iotest.ErrTimeout, err)
+	})
+
+	t.Run("context cancellation", func(t *testing.T) {
+		reader := NewReader(strings.NewReader(numberedMessages(1000)))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		err := reader.EachMessageConcurrent(ctx, 4, func(msg *Message) error {
+			cancel()
+			time.Sleep(time.Millisecond)
+			return nil
+		}, Ordered())
+
+		assert.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("input is not read after returning", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		// Writing slowly, a byte at a time, means the producer is usually in the
+		// middle of reading a message when the context is cancelled.
+		go func() {
+			for _, b := range []byte(numberedMessages(100)) {
+				if _, err := client.Write([]byte{b}); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Microsecond)
+			}
+		}()
+		input := &countingConn{Conn: server}
+		reader := NewReader(input)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		err := reader.EachMessageConcurrent(ctx, 4, func(msg *Message) error {
+			cancel()
+			return nil
+		})
+		reads := atomic.LoadInt64(&input.reads)
+		time.Sleep(10 * time.Millisecond)
+
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, reads, atomic.LoadInt64(&input.reads))
+	})
+
+	t.Run("cancellation while blocked on input", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		reader := NewReader(pr)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := reader.EachMessageConcurrent(ctx, 4, func(msg *Message) error {
+			return nil
+		})
+
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		// The read that was interrupted is finished by the next one, so
+		// nothing is lost.
+		go func() {
+			pw.Write([]byte(numberedMessages(1)))
+			pw.Close()
+		}()
+		msg, err := reader.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "0", controlID(t, msg))
+	})
+}
+
+// countingConn counts the calls to Read.
+type countingConn struct {
+	net.Conn
+	reads int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,257 @@
+package hl7
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DuplicateDetector remembers the messages that have been processed recently,
+// so that ones that arrive again (typically because the sender did not get
+// the acknowledgment and resent them) can be recognized. Messages are
+// identified by their sending application (MSH-3), sending facility (MSH-4)
+// and control ID (MSH-10). Only the most recently used keys are kept, up to a
+// fixed number.
+//
+// It can be used directly when reading messages:
+//
+//	err := reader.EachMessage(func(msg *hl7.Message) error {
+//		if _, dup := detector.Seen(msg); dup {
+//			return nil
+//		}
+//		if err := process(msg); err != nil {
+//			return err
+//		}
+//		return detector.Record(msg, nil)
+//	})
+//
+// or with a Server, using Middleware.
+type DuplicateDetector struct {
+	size int
+
+	lock    sync.Mutex
+	entries *list.List
+	index   map[string]*list.Element
+	file    *os.File // The file the window is persisted to, if any.
+	path    string
+	lines   int // The number of keys in the file.
+}
+
+type seenMessage struct {
+	key  string
+	resp *Message
+}
+
+// NewDuplicateDetector returns a DuplicateDetector that remembers the last
+// size messages in memory. A size less than 1 is treated as 1.
+func NewDuplicateDetector(size int) *DuplicateDetector {
+	if size < 1 {
+		size = 1
+	}
+	return &DuplicateDetector{size: size, entries: list.New(), index: map[string]*list.Element{}}
+}
+
+// OpenDuplicateDetector returns a DuplicateDetector that also persists the
+// keys of the messages it has seen to a file, so that duplicates are still
+// recognized after a restart. The file is created if it does not exist, and
+// is compacted from time to time so it does not grow without bound. Responses
+// are only kept in memory, so duplicates of messages seen before a restart
+// are acknowledged afresh (see Middleware).
+func OpenDuplicateDetector(path string, size int) (*DuplicateDetector, error) {
+	d := NewDuplicateDetector(size)
+	d.path = path
+	file, err := os.Open(path)
+
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+
+		for scanner.Scan() {
+			d.add(scanner.Text(), nil)
+			d.lines++
+		}
+		err = scanner.Err()
+		file.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Seen reports whether the message has been recorded already, along with the
+// response that was recorded with it, if any.
+func (d *DuplicateDetector) Seen(msg *Message) (*Message, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	e, ok := d.index[duplicateKey(msg)]
+
+	if !ok {
+		return nil, false
+	}
+	d.entries.MoveToFront(e)
+	return e.Value.(*seenMessage).resp, true
+}
+
+// Record remembers that the message has been processed, along with the
+// response that was sent for it (which may be nil). If the detector is backed
+// by a file, the key is synced to it before Record returns.
+func (d *DuplicateDetector) Record(msg *Message, resp *Message) error {
+	key := duplicateKey(msg)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, existing := d.index[key]
+	d.add(key, resp)
+
+	if d.path == "" || existing {
+		return nil
+	}
+	if d.file == nil {
+		// Reopening the file failed during the last compaction.
+		if err := d.open(); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(d.file, key); err != nil {
+		return err
+	}
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	if d.lines++; d.lines > 2*d.size {
+		return d.compact()
+	}
+	return nil
+}
+
+// Middleware returns middleware that acknowledges messages that have already
+// been accepted without calling the handler again. The original response is
+// sent if it is still remembered; otherwise a new AA acknowledgment is
+// generated. Messages are recorded once the handler accepts them (with AA),
+// so ones that failed can be retried.
+func (d *DuplicateDetector) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			if resp, ok := d.Seen(msg); ok {
+				if resp != nil {
+					return resp, nil
+				}
+				return msg.Ack(AckAccept, nil)
+			}
+			resp, err := next.ServeHL7(ctx, msg)
+
+			if err == nil && resp != nil && responseCode(resp) == AckAccept {
+				if err := d.Record(msg, resp); err != nil {
+					return resp, err
+				}
+			}
+			return resp, err
+		})
+	}
+}
+
+// Close closes the file backing the detector, if there is one.
+func (d *DuplicateDetector) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.file == nil {
+		d.path = ""
+		return nil
+	}
+	err := d.file.Close()
+	d.file, d.path = nil, ""
+
+	return err
+}
+
+// add adds the key to the front of the list, evicting the least recently used
+// keys if there are too many. The lock must be held.
+func (d *DuplicateDetector) add(key string, resp *Message) {
+	if e, ok := d.index[key]; ok {
+		if resp != nil {
+			e.Value.(*seenMessage).resp = resp
+		}
+		d.entries.MoveToFront(e)
+		return
+	}
+	d.index[key] = d.entries.PushFront(&seenMessage{key: key, resp: resp})
+
+	for d.entries.Len() > d.size {
+		e := d.entries.Back()
+		d.entries.Remove(e)
+		delete(d.index, e.Value.(*seenMessage).key)
+	}
+}
+
+// compact rewrites the file with just the keys that are currently remembered,
+// least recently used first. The lock must be held.
+func (d *DuplicateDetector) compact() error {
+	tmp := d.path + ".tmp"
+	file, err := os.Create(tmp)
+
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	for e := d.entries.Back(); e != nil; e = e.Prev() {
+		fmt.Fprintln(w, e.Value.(*seenMessage).key)
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The old file has to be closed before it is replaced on some platforms.
+	// Whether or not that works, the file at the path is reopened, so a
+	// failure here doesn't stop keys from being recorded afterwards (if it
+	// can't be reopened now, Record tries again).
+	d.file.Close()
+	d.file = nil
+
+	if err = os.Rename(tmp, d.path); err != nil {
+		os.Remove(tmp)
+	} else {
+		d.lines = d.entries.Len()
+		err = syncDir(filepath.Dir(d.path))
+	}
+	if oerr := d.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+// open opens the file for appending keys. The lock must be held.
+func (d *DuplicateDetector) open() error {
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+	d.file = file
+	return nil
+}
+
+// duplicateKey identifies a message for the purposes of duplicate detection.
+func duplicateKey(msg *Message) string {
+	h := headerFields(msg.data)
+	return fmt.Sprintf("%s\t%s\t%s", indexField(h, 3), indexField(h, 4), indexField(h, 10))
+}
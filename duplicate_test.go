@@ -0,0 +1,162 @@
+package hl7
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateDetector(t *testing.T) {
+	d := NewDuplicateDetector(2)
+
+	_, seen := d.Seen(testMessage(msh{app: "A", controlID: "1"}))
+	assert.False(t, seen)
+
+	ack := testMessage(msh{msgType: "ACK", controlID: "A1"}, "MSA|AA|1")
+	assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: "1"}), ack))
+	assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: "2"}), nil))
+
+	resp, seen := d.Seen(testMessage(msh{app: "A", controlID: "1"}))
+	assert.True(t, seen)
+	assert.Equal(t, ack, resp)
+
+	// The same control ID from another application is a different message.
+	_, seen = d.Seen(testMessage(msh{app: "B", controlID: "1"}))
+	assert.False(t, seen)
+
+	// A-1 was used more recently than A-2, so A-2 is evicted.
+	assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: "3"}), nil))
+
+	for id, want := range map[string]bool{"1": true, "2": false, "3": true} {
+		_, seen = d.Seen(testMessage(msh{app: "A", controlID: id}))
+		assert.Equal(t, want, seen, id)
+	}
+}
+
+func TestDuplicateDetectorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duplicates")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seen")
+	d, err := OpenDuplicateDetector(path, 3)
+	assert.Nil(t, err)
+
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: fmt.Sprint(i)}), nil))
+	}
+	assert.Nil(t, d.Close())
+
+	// The file is compacted once it has more than twice as many keys as are
+	// remembered.
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.Count(string(data), "\n") <= 6)
+
+	d, err = OpenDuplicateDetector(path, 3)
+	assert.Nil(t, err)
+	defer d.Close()
+
+	for i := 1; i <= 10; i++ {
+		_, seen := d.Seen(testMessage(msh{app: "A", controlID: fmt.Sprint(i)}))
+		assert.Equal(t, i > 7, seen, i)
+	}
+}
+
+func TestDuplicateDetectorFailedCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duplicates")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seen")
+	d, err := OpenDuplicateDetector(path, 1)
+	assert.Nil(t, err)
+	defer d.Close()
+
+	assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: "1"}), nil))
+	assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: "2"}), nil))
+
+	// Compacting fails while the file can't be replaced.
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, os.MkdirAll(filepath.Join(path, "blocker"), 0755))
+	assert.NotNil(t, d.Record(testMessage(msh{app: "A", controlID: "3"}), nil))
+
+	// Once the problem goes away, recording carries on.
+	assert.Nil(t, os.RemoveAll(path))
+	assert.Nil(t, d.Record(testMessage(msh{app: "A", controlID: "4"}), nil))
+	assert.Nil(t, d.Close())
+
+	d, err = OpenDuplicateDetector(path, 1)
+	assert.Nil(t, err)
+	defer d.Close()
+
+	_, seen := d.Seen(testMessage(msh{app: "A", controlID: "4"}))
+	assert.True(t, seen)
+}
+
+func TestDuplicateDetectorMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duplicates")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seen")
+	d, err := OpenDuplicateDetector(path, 10)
+	assert.Nil(t, err)
+
+	var calls int
+
+	h := HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		calls++
+		return ackHandler(ctx, msg)
+	})
+	first, err := d.Middleware()(h).ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+
+	resp, err := d.Middleware()(h).ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+	assert.Equal(t, first, resp)
+	assert.Equal(t, 1, calls)
+	d.Close()
+
+	// After a restart, the duplicate is acknowledged afresh.
+	d, err = OpenDuplicateDetector(path, 10)
+	assert.Nil(t, err)
+	defer d.Close()
+
+	resp, err = d.Middleware()(h).ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+
+	ack, err := ParseAck(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, AckAccept, ack.Code)
+	assert.Equal(t, "1", ack.ControlID)
+}
+
+func TestDuplicateDetectorEachMessage(t *testing.T) {
+	var (
+		buf       bytes.Buffer
+		d         = NewDuplicateDetector(10)
+		processed []string
+	)
+	for _, id := range []string{"1", "2", "1", "3", "2"} {
+		buf.Write(testMessage(msh{app: "A", controlID: id}).Bytes())
+		buf.WriteString("\n")
+	}
+	err := NewReader(&buf).EachMessage(func(msg *Message) error {
+		if _, dup := d.Seen(msg); dup {
+			return nil
+		}
+		processed = append(processed, string(indexField(headerFields(msg.Bytes()), 10)))
+		return d.Record(msg, nil)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, processed)
+}
@@ -0,0 +1,166 @@
+package hl7
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Acknowledgment conditions, as found in MSH-15 (accept acknowledgment type)
+// and MSH-16 (application acknowledgment type). If either of these fields is
+// valued, the message uses the enhanced acknowledgment mode, where the
+// receiver first sends an accept acknowledgment (CA, CE or CR) once it has
+// safely received the message, and later an application acknowledgment (AA,
+// AE or AR) once the message has been processed. Otherwise the original
+// acknowledgment mode is used, where there is only an application
+// acknowledgment.
+const (
+	AckAlways    = "AL" // Always send the acknowledgment.
+	AckNever     = "NE" // Never send the acknowledgment.
+	AckOnError   = "ER" // Only send the acknowledgment for errors and rejections.
+	AckOnSuccess = "SU" // Only send the acknowledgment when successful.
+)
+
+// ErrNotExpected is returned by AckWaiter.Wait for control IDs that were not
+// registered using Expect.
+var ErrNotExpected = errors.New("control ID was not expected")
+
+// AcceptAckType returns the accept acknowledgment type (MSH-15).
+func (m *Message) AcceptAckType() string {
+	return firstComponent(indexField(headerFields(m.data), 15), m.compSep)
+}
+
+// ApplicationAckType returns the application acknowledgment type (MSH-16).
+func (m *Message) ApplicationAckType() string {
+	return firstComponent(indexField(headerFields(m.data), 16), m.compSep)
+}
+
+// EnhancedMode reports whether the message uses the enhanced acknowledgment
+// mode, meaning that MSH-15 or MSH-16 is valued.
+func (m *Message) EnhancedMode() bool {
+	return m.AcceptAckType() != "" || m.ApplicationAckType() != ""
+}
+
+// shouldAck reports whether an acknowledgment should be sent under the given
+// condition (from MSH-15 or MSH-16). An empty condition is treated as AL, since
+// it only matters in enhanced mode, where at least one of the two is valued.
+func shouldAck(condition string, success bool) bool {
+	switch condition {
+	case AckNever:
+		return false
+	case AckOnError:
+		return !success
+	case AckOnSuccess:
+		return success
+	default:
+		return true
+	}
+}
+
+// deferredAck returns a copy of the application acknowledgment that asks for
+// an accept acknowledgment but no application acknowledgment (MSH-15 AL and
+// MSH-16 NE), as is expected when it is sent on a separate connection. If the
+// acknowledgment is already in enhanced mode, it is returned as is.
+func deferredAck(ack *Message) (*Message, error) {
+	if ack.EnhancedMode() {
+		return ack, nil
+	}
+	ack, err := setHeaderField(ack, 15, AckAlways)
+
+	if err != nil {
+		return nil, err
+	}
+	return setHeaderField(ack, 16, AckNever)
+}
+
+// AckSender sends a message and waits for its acknowledgment. It is used by a
+// Server to send application acknowledgments for messages in enhanced mode on
+// a separate connection, back to the original sender, and by a Queue to
+// deliver messages. A *Client satisfies this interface.
+type AckSender interface {
+	Send(ctx context.Context, msg *Message) (*AckResult, error)
+}
+
+// AckWaiter is used by senders in enhanced mode to wait for application
+// acknowledgments that arrive on a separate connection. It is a Handler, so it
+// can be used with a Server listening for the acknowledgments (or called from
+// another handler). The control ID of each message must be registered with
+// Expect before it is sent, so no acknowledgment is missed.
+type AckWaiter struct {
+	lock    sync.Mutex
+	waiting map[string]chan *AckResult
+}
+
+// Expect registers the control ID of a message that is about to be sent, so
+// its application acknowledgment can be picked up by Wait. The control ID is
+// only forgotten once Wait returns, so Expect should only be called for
+// messages whose acknowledgment is going to be waited for.
+func (w *AckWaiter) Expect(controlID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.waiting == nil {
+		w.waiting = map[string]chan *AckResult{}
+	}
+	if _, ok := w.waiting[controlID]; !ok {
+		w.waiting[controlID] = make(chan *AckResult, 1)
+	}
+}
+
+// Wait waits for the application acknowledgment for the message with the
+// given control ID, which must have been registered with Expect.
+func (w *AckWaiter) Wait(ctx context.Context, controlID string) (*AckResult, error) {
+	w.lock.Lock()
+	ch, ok := w.waiting[controlID]
+	w.lock.Unlock()
+
+	if !ok {
+		return nil, ErrNotExpected
+	}
+	defer w.forget(controlID)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ack := <-ch:
+		return ack, nil
+	}
+}
+
+// ServeHL7 passes acknowledgments on to whoever is waiting for them. Anything
+// else (including acknowledgments nobody is waiting for) is ignored. Nothing
+// is returned, since acknowledgments are not themselves acknowledged.
+func (w *AckWaiter) ServeHL7(ctx context.Context, msg *Message) (*Message, error) {
+	w.Deliver(msg)
+	return nil, nil
+}
+
+// Deliver passes the application acknowledgment on to whoever is waiting for
+// it, and reports whether anyone was. Accept acknowledgments are ignored.
+func (w *AckWaiter) Deliver(msg *Message) bool {
+	ack, err := ParseAck(msg)
+
+	if err != nil || ack.Code == AckCommitAccept || ack.Code == AckCommitError || ack.Code == AckCommitReject {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ch, ok := w.waiting[ack.ControlID]
+
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- ack:
+	default:
+	}
+	return true
+}
+
+func (w *AckWaiter) forget(controlID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.waiting, controlID)
+}
@@ -0,0 +1,295 @@
+package hl7
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ackHandler acknowledges messages with AA, or AE if the control ID is "fail".
+var ackHandler = HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+	if string(indexField(headerFields(msg.Bytes()), 10)) == "fail" {
+		return msg.Ack(AckError, nil)
+	}
+	return msg.Ack(AckAccept, nil)
+})
+
+func TestMessageAckTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         *Message
+		accept      string
+		application string
+		enhanced    bool
+	}{
+		{"original mode", testMessage(msh{controlID: "1"}), "", "", false},
+		{"both valued", testMessage(msh{controlID: "1", acceptAck: AckAlways, appAck: AckOnError}), AckAlways, AckOnError, true},
+		{"accept only", testMessage(msh{controlID: "1", acceptAck: AckNever}), AckNever, "", true},
+		{"application only", testMessage(msh{controlID: "1", appAck: AckOnSuccess}), "", AckOnSuccess, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.accept, tt.msg.AcceptAckType())
+			assert.Equal(t, tt.application, tt.msg.ApplicationAckType())
+			assert.Equal(t, tt.enhanced, tt.msg.EnhancedMode())
+		})
+	}
+}
+
+func TestShouldAck(t *testing.T) {
+	tests := []struct {
+		condition string
+		success   bool
+		want      bool
+	}{
+		{AckAlways, true, true},
+		{AckAlways, false, true},
+		{"", true, true},
+		{AckNever, true, false},
+		{AckNever, false, false},
+		{AckOnError, true, false},
+		{AckOnError, false, true},
+		{AckOnSuccess, true, true},
+		{AckOnSuccess, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%v", tt.condition, tt.success), func(t *testing.T) {
+			assert.Equal(t, tt.want, shouldAck(tt.condition, tt.success))
+		})
+	}
+}
+
+func TestAckWaiter(t *testing.T) {
+	var w AckWaiter
+
+	w.Expect("1")
+	assert.False(t, w.Deliver(testMessage(msh{msgType: "ACK", controlID: "A1"}, "MSA|CA|1")))
+	assert.False(t, w.Deliver(testMessage(msh{msgType: "ACK", controlID: "A2"}, "MSA|AA|2")))
+	assert.False(t, w.Deliver(testMessage(msh{controlID: "1"})))
+	assert.True(t, w.Deliver(testMessage(msh{msgType: "ACK", controlID: "A1"}, "MSA|AE|1")))
+
+	ack, err := w.Wait(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, AckError, ack.Code)
+
+	// The control ID is forgotten once the wait is over.
+	_, err = w.Wait(context.Background(), "1")
+	assert.Equal(t, ErrNotExpected, err)
+
+	w.Expect("3")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = w.Wait(ctx, "3")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestServerEnhancedMode(t *testing.T) {
+	s := &Server{Handler: ackHandler}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	tests := []struct {
+		name  string
+		data  string
+		codes []string
+	}{
+		{"original mode", "MSH|^~\\&|||||||ADT^A01|1|P|2.5\rPID|1\r", []string{AckAccept}},
+		{"always", "MSH|^~\\&|||||||ADT^A01|1|P|2.5|||AL|AL\rPID|1\r", []string{AckCommitAccept, AckAccept}},
+		{"defaults to always", "MSH|^~\\&|||||||ADT^A01|1|P|2.5||||AL\rPID|1\r", []string{AckCommitAccept, AckAccept}},
+		{"never", "MSH|^~\\&|||||||ADT^A01|1|P|2.5|||NE|NE\rPID|1\r", nil},
+		{"application on success", "MSH|^~\\&|||||||ADT^A01|1|P|2.5|||NE|SU\rPID|1\r", []string{AckAccept}},
+		{"application on error", "MSH|^~\\&|||||||ADT^A01|1|P|2.5|||NE|ER\rPID|1\r", nil},
+		{"application error", "MSH|^~\\&|||||||ADT^A01|fail|P|2.5|||NE|ER\rPID|1\r", []string{AckError}},
+		{"accept on error", "MSH|^~\\&|||||||ADT^A01|1|P|2.5|||ER|AL\rPID|1\r", []string{AckAccept}},
+		{"rejected", "MSH|^~\\&|||||||ADT^A01|1|P|2.5|||ER|AL\rPI\r", []string{AckCommitReject}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			assert.Nil(t, err)
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			w, r := NewMLLPWriter(conn), NewMLLPReader(conn)
+
+			// An original mode message is sent afterwards, so we know when all
+			// of the acknowledgments for the first one have arrived.
+			assert.Nil(t, w.WriteFrame([]byte(tt.data)))
+			assert.Nil(t, w.WriteMessage(testMessage(msh{controlID: "end"})))
+
+			var codes []string
+
+			for {
+				msg, err := r.ReadMessage()
+
+				if !assert.Nil(t, err) {
+					return
+				}
+				ack, err := ParseAck(msg)
+				assert.Nil(t, err)
+
+				if ack.ControlID == "end" {
+					break
+				}
+				codes = append(codes, ack.Code)
+			}
+			assert.Equal(t, tt.codes, codes)
+		})
+	}
+}
+
+func TestApplicationAcks(t *testing.T) {
+	// The sender listens for application acknowledgments on its own server.
+	waiter := &AckWaiter{}
+	sender := &Server{Handler: waiter}
+	senderAddr, _ := startServer(t, sender)
+	defer sender.Close()
+
+	acks := &Client{Addr: senderAddr}
+	defer acks.Close()
+
+	receiver := &Server{Handler: ackHandler, ApplicationAcks: acks}
+	receiverAddr, _ := startServer(t, receiver)
+	defer receiver.Close()
+
+	client := &Client{Addr: receiverAddr, ApplicationAcks: waiter}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("accept acknowledgment", func(t *testing.T) {
+		ack, err := client.Send(ctx, testMessage(msh{controlID: "1", acceptAck: AckAlways, appAck: AckAlways}))
+		assert.Nil(t, err)
+		assert.Equal(t, AckCommitAccept, ack.Code)
+
+		ack, err = waiter.Wait(ctx, "1")
+		assert.Nil(t, err)
+		assert.Equal(t, AckAccept, ack.Code)
+	})
+
+	t.Run("no accept acknowledgment", func(t *testing.T) {
+		ack, err := client.Send(ctx, testMessage(msh{controlID: "2", acceptAck: AckNever, appAck: AckAlways}))
+		assert.Nil(t, err)
+		assert.Nil(t, ack)
+
+		ack, err = waiter.Wait(ctx, "2")
+		assert.Nil(t, err)
+		assert.Equal(t, AckAccept, ack.Code)
+	})
+
+	t.Run("same connection", func(t *testing.T) {
+		receiver := &Server{Handler: ackHandler}
+		addr, _ := startServer(t, receiver)
+		defer receiver.Close()
+
+		client := &Client{Addr: addr, ApplicationAcks: waiter}
+		defer client.Close()
+
+		ack, err := client.Send(ctx, testMessage(msh{controlID: "3", acceptAck: AckAlways, appAck: AckAlways}))
+		assert.Nil(t, err)
+		assert.Equal(t, AckCommitAccept, ack.Code)
+
+		// The application acknowledgment is read while waiting for the next
+		// accept acknowledgment.
+		_, err = client.Send(ctx, testMessage(msh{controlID: "4", acceptAck: AckAlways, appAck: AckNever}))
+		assert.Nil(t, err)
+
+		ack, err = waiter.Wait(ctx, "3")
+		assert.Nil(t, err)
+		assert.Equal(t, AckAccept, ack.Code)
+
+		// Nothing is registered for a message without an application
+		// acknowledgment, since it would never be waited for.
+		_, err = waiter.Wait(ctx, "4")
+		assert.Equal(t, ErrNotExpected, err)
+	})
+}
+
+// blockingAckSender records the control IDs acknowledged by the messages it is
+// asked to send, but doesn't return until release is closed or the context is
+// done.
+type blockingAckSender struct {
+	sent    chan string
+	release chan struct{}
+}
+
+func (b *blockingAckSender) Send(ctx context.Context, msg *Message) (*AckResult, error) {
+	ack, _ := ParseAck(msg)
+	b.sent <- ack.ControlID
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-b.release:
+		return &AckResult{Code: AckCommitAccept}, nil
+	}
+}
+
+func TestServerApplicationAcksInBackground(t *testing.T) {
+	sender := &blockingAckSender{sent: make(chan string, 2), release: make(chan struct{})}
+	s := &Server{Handler: ackHandler, ApplicationAcks: sender, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	w, r := NewMLLPWriter(conn), NewMLLPReader(conn)
+
+	// The second message is accepted while the application acknowledgment
+	// for the first is still being sent.
+	for _, id := range []string{"1", "2"} {
+		assert.Nil(t, w.WriteMessage(testMessage(msh{controlID: id, acceptAck: AckAlways, appAck: AckAlways})))
+
+		msg, err := r.ReadMessage()
+		assert.Nil(t, err)
+
+		ack, err := ParseAck(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, AckCommitAccept, ack.Code)
+		assert.Equal(t, id, ack.ControlID)
+	}
+	sent := []string{<-sender.sent, <-sender.sent}
+	assert.ElementsMatch(t, []string{"1", "2"}, sent)
+
+	// Shutdown waits for the acknowledgments to be sent.
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+
+	close(sender.release)
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
+
+func TestDeferredAck(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"original mode", "MSH|^~\\&|||||||ACK|1|P|2.5\rMSA|AA|1", "MSH|^~\\&|||||||ACK|1|P|2.5|||AL|NE\rMSA|AA|1"},
+		{"extra fields", "MSH|^~\\&|||||||ACK|1|P|2.5|||||", "MSH|^~\\&|||||||ACK|1|P|2.5|||AL|NE|"},
+		{"enhanced mode", "MSH|^~\\&|||||||ACK|1|P|2.5|||NE|NE\rMSA|AA|1", "MSH|^~\\&|||||||ACK|1|P|2.5|||NE|NE\rMSA|AA|1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := NewMessage([]byte(tt.data))
+			assert.Nil(t, err)
+
+			got, err := deferredAck(msg)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, string(got.Bytes()))
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package hl7
+
+import "context"
+
+// Handler is used to respond to HL7 messages received by a Server. This is
+// modeled on http.Handler.
+//
+// ServeHL7 is called once for each message received, and the message that is
+// returned (typically an acknowledgment) is sent back to the sender. If the
+// returned message is nil, nothing is sent, unless an error is returned too,
+// in which case the sender gets a negative acknowledgment (AE) so that it does
+// not have to wait for one to time out.
+//
+// The context is cancelled if the server is closed while the message is being
+// handled (see Server.Close). Nothing is read from the connection in the
+// meantime, so the sender hanging up is not noticed until the handler returns.
+type Handler interface {
+	ServeHL7(ctx context.Context, msg *Message) (*Message, error)
+}
+
+// HandlerFunc is an adapter that allows ordinary functions to be used as a
+// Handler.
+type HandlerFunc func(ctx context.Context, msg *Message) (*Message, error)
+
+// ServeHL7 calls f(ctx, msg).
+func (f HandlerFunc) ServeHL7(ctx context.Context, msg *Message) (*Message, error) {
+	return f(ctx, msg)
+}
@@ -80,3 +80,33 @@ func parseRepetition(numStr, repeatStr string) string {
 
 	return strings.Repeat(repeatStr, count)
 }
+
+// escapeString is used to replace the delimiters in the string with the
+// corresponding HL7 escape sequences, so that it can be used as the value of a
+// field. This is roughly the inverse of FormatString.
+func escapeString(str string, fieldSep, compSep, repeat, escape, subCompSep byte) string {
+	if strings.IndexAny(str, string([]byte{fieldSep, compSep, repeat, escape, subCompSep, CR, LF})) < 0 {
+		return str
+	}
+	var b strings.Builder
+
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; c {
+		case escape:
+			b.WriteString(string(escape) + "E" + string(escape))
+		case fieldSep:
+			b.WriteString(string(escape) + "F" + string(escape))
+		case compSep:
+			b.WriteString(string(escape) + "S" + string(escape))
+		case subCompSep:
+			b.WriteString(string(escape) + "T" + string(escape))
+		case repeat:
+			b.WriteString(string(escape) + "R" + string(escape))
+		case CR, LF:
+			b.WriteString(string(escape) + ".br" + string(escape))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
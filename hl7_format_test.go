@@ -56,3 +56,29 @@ func TestParseRepetition(t *testing.T) {
 		})
 	}
 }
+
+func TestEscapeString(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"no delimiters", "Hello world", "Hello world"},
+		{"pipes", "Hello|world", `Hello\F\world`},
+		{"upcarets", "Hello^world", `Hello\S\world`},
+		{"ampersands", "Hello&world", `Hello\T\world`},
+		{"tildes", "Hello~world", `Hello\R\world`},
+		{"escapes", `Hello\world`, `Hello\E\world`},
+		{"newlines", "Hello\r\nworld", `Hello\.br\\.br\world`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := escapeString(tt.input, '|', '^', '~', '\\', '&')
+			assert.Equal(t, tt.want, got)
+
+			if tt.name != "newlines" {
+				assert.Equal(t, tt.input, FormatString(got))
+			}
+		})
+	}
+}
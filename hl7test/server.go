@@ -0,0 +1,262 @@
+// Package hl7test provides utilities for testing code that sends HL7 messages
+// over MLLP, in the spirit of net/http/httptest.
+package hl7test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mylanconnolly/hl7"
+)
+
+// Action describes how a Server responds to a single message. The steps that
+// are set are carried out in the order the fields are listed, so for example
+// an Action with Garbage and Code set sends some garbage followed by a proper
+// acknowledgment. The zero Action sends nothing at all.
+type Action struct {
+	Delay   time.Duration // How long to wait before responding.
+	Garbage []byte        // Bytes to write as is, without MLLP framing.
+	Frame   []byte        // An MLLP frame to send, which need not be HL7.
+	Code    string        // An acknowledgment code to respond with, such as hl7.AckAccept.
+	Drop    bool          // Whether to close the connection afterwards.
+}
+
+// Ack returns an Action that acknowledges the message with the given code.
+func Ack(code string) Action {
+	return Action{Code: code}
+}
+
+// Drop returns an Action that closes the connection without responding.
+func Drop() Action {
+	return Action{Drop: true}
+}
+
+// Server is an MLLP server listening on the loopback interface, for use in
+// tests. It records every message it receives. Responses can be scripted
+// using Script; once the script runs out (or if there is none), messages are
+// passed to the handler instead.
+type Server struct {
+	Addr     string       // The address the server is listening on, in host:port form.
+	Listener net.Listener // The listener the server is accepting connections on.
+
+	handler hl7.Handler
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	lock     sync.Mutex
+	received []*hl7.Message
+	script   []Action
+	conns    map[net.Conn]struct{}
+	notify   chan struct{}
+	closed   bool
+}
+
+// NewServer starts and returns a new Server. If handler is nil, every message
+// is acknowledged with AA. The caller should call Close when finished, to shut
+// it down.
+func NewServer(handler hl7.Handler) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("hl7test: failed to listen on a port: " + err.Error())
+		}
+	}
+	if handler == nil {
+		handler = hl7.HandlerFunc(func(ctx context.Context, msg *hl7.Message) (*hl7.Message, error) {
+			return msg.Ack(hl7.AckAccept, nil)
+		})
+	}
+	s := &Server{
+		Addr:     l.Addr().String(),
+		Listener: l,
+		handler:  handler,
+		conns:    map[net.Conn]struct{}{},
+		notify:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+
+	go s.serve()
+
+	return s
+}
+
+// Script queues up actions to take in response to the next messages, one
+// action per message, across all connections.
+func (s *Server) Script(actions ...Action) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.script = append(s.script, actions...)
+}
+
+// Messages returns the messages received so far, in the order they arrived.
+func (s *Server) Messages() []*hl7.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]*hl7.Message(nil), s.received...)
+}
+
+// WaitForMessages waits until at least n messages have been received, and
+// returns them. It gives up and returns what there is when the context is
+// done.
+func (s *Server) WaitForMessages(ctx context.Context, n int) []*hl7.Message {
+	for {
+		s.lock.Lock()
+		received, notify := s.received, s.notify
+		s.lock.Unlock()
+
+		if len(received) >= n {
+			return append([]*hl7.Message(nil), received...)
+		}
+		select {
+		case <-ctx.Done():
+			return append([]*hl7.Message(nil), received...)
+		case <-notify:
+		}
+	}
+}
+
+// CloseClientConnections closes any open connections to the server.
+func (s *Server) CloseClientConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close shuts down the server and blocks until all connections have been
+// closed.
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	s.Listener.Close()
+	s.cancel()
+	s.CloseClientConnections()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.Listener.Accept()
+
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	var (
+		r = hl7.NewMLLPReader(conn)
+		w = hl7.NewMLLPWriter(conn)
+	)
+	for {
+		msg, err := r.ReadMessage()
+
+		if err == hl7.ErrInvalidHeader || err == hl7.ErrTruncatedFrame || err == hl7.ErrFrameTooLarge {
+			continue
+		} else if err != nil {
+			return
+		}
+		action, scripted := s.record(msg)
+
+		if !scripted {
+			resp, err := s.handler.ServeHL7(s.ctx, msg)
+
+			if err == nil && resp != nil {
+				err = w.WriteMessage(resp)
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if !s.perform(conn, w, msg, action) {
+			return
+		}
+	}
+}
+
+// record adds the message to the list of those received, and returns the next
+// scripted action, if there is one.
+func (s *Server) record(msg *hl7.Message) (Action, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.received = append(s.received, msg)
+	close(s.notify)
+	s.notify = make(chan struct{})
+
+	if len(s.script) == 0 {
+		return Action{}, false
+	}
+	action := s.script[0]
+	s.script = s.script[1:]
+
+	return action, true
+}
+
+// perform carries out the action, and reports whether the connection should
+// be kept open.
+func (s *Server) perform(conn net.Conn, w *hl7.MLLPWriter, msg *hl7.Message, action Action) bool {
+	if action.Delay > 0 {
+		select {
+		case <-time.After(action.Delay):
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+	if action.Garbage != nil {
+		if _, err := conn.Write(action.Garbage); err != nil {
+			return false
+		}
+	}
+	if action.Frame != nil {
+		if err := w.WriteFrame(action.Frame); err != nil {
+			return false
+		}
+	}
+	if action.Code != "" {
+		ack, err := msg.Ack(action.Code, nil)
+
+		if err != nil {
+			return false
+		}
+		if err = w.WriteMessage(ack); err != nil {
+			return false
+		}
+	}
+	return !action.Drop
+}
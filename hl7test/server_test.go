@@ -0,0 +1,120 @@
+package hl7test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylanconnolly/hl7"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMessage(controlID string) *hl7.Message {
+	msg, _ := hl7.NewMessage([]byte(fmt.Sprintf("MSH|^~\\&|||||||ADT^A01|%s|P|2.5\rPID|1\r", controlID)))
+	return msg
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	client := &hl7.Client{Addr: s.Addr, AckTimeout: 100 * time.Millisecond}
+	defer client.Close()
+
+	s.Script(
+		Ack(hl7.AckError),
+		Action{Delay: 10 * time.Millisecond, Garbage: []byte("junk"), Frame: []byte("not HL7"), Code: hl7.AckAccept},
+		Drop(),
+		Action{},
+	)
+
+	tests := []struct {
+		name    string
+		code    string
+		wantErr bool
+	}{
+		{"scripted error", hl7.AckError, true},
+		{"garbage then accept", hl7.AckAccept, false},
+		{"dropped connection", "", true},
+		{"no response", "", true},
+		{"handler", hl7.AckAccept, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack, err := client.Send(context.Background(), testMessage(fmt.Sprint(i)))
+			assert.Equal(t, tt.wantErr, err != nil)
+
+			if tt.code != "" {
+				assert.Equal(t, tt.code, ack.Code)
+			}
+		})
+	}
+
+	msgs := s.Messages()
+
+	if assert.Len(t, msgs, len(tests)) {
+		for i, msg := range msgs {
+			assert.True(t, strings.Contains(string(msg.Bytes()), fmt.Sprintf("|%d|P|", i)))
+		}
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	s := NewServer(hl7.HandlerFunc(func(ctx context.Context, msg *hl7.Message) (*hl7.Message, error) {
+		return msg.Ack(hl7.AckReject, nil)
+	}))
+	defer s.Close()
+
+	client := &hl7.Client{Addr: s.Addr}
+	defer client.Close()
+
+	ack, err := client.Send(context.Background(), testMessage("1"))
+	assert.NotNil(t, err)
+	assert.Equal(t, hl7.AckReject, ack.Code)
+}
+
+func TestServerWaitForMessages(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	s.Script(Action{})
+
+	go func() {
+		client := &hl7.Client{Addr: s.Addr, AckTimeout: 10 * time.Millisecond}
+		defer client.Close()
+
+		client.Send(context.Background(), testMessage("1"))
+		client.Send(context.Background(), testMessage("2"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Len(t, s.WaitForMessages(ctx, 2), 2)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Len(t, s.WaitForMessages(ctx, 3), 2)
+}
+
+func TestServerCloseClientConnections(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	client := &hl7.Client{Addr: s.Addr, AckTimeout: time.Second}
+	defer client.Close()
+
+	s.Script(Action{Delay: time.Second, Code: hl7.AckAccept})
+
+	go func() {
+		s.WaitForMessages(context.Background(), 1)
+		s.CloseClientConnections()
+	}()
+	start := time.Now()
+	_, err := client.Send(context.Background(), testMessage("1"))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
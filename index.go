@@ -0,0 +1,346 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IndexExt is the extension of the sidecar index files written by IndexFile
+// and read by OpenIndexedFile.
+const IndexExt = ".idx"
+
+// indexMagic is written at the beginning of every index file, the last byte
+// being the version of the format.
+var indexMagic = []byte("HL7IDX\x00\x01")
+
+var (
+	// ErrInvalidIndex is used to represent the case where an index could not
+	// be decoded.
+	ErrInvalidIndex = errors.New("invalid index")
+
+	// ErrStaleIndex is used to represent the case where the file an index was
+	// built from has changed since.
+	ErrStaleIndex = errors.New("index does not match file")
+)
+
+// IndexEntry describes where a single message can be found within a file,
+// along with a few fields from its header that are commonly searched on.
+type IndexEntry struct {
+	Offset    int64  // The byte offset of the message within the file.
+	Length    int64  // The length of the message in bytes.
+	Type      string // The message type (MSH-9), such as "ADT^A01".
+	ControlID string // The message control ID (MSH-10).
+	Time      string // The date/time of the message (MSH-7), as written.
+}
+
+// BuildIndex reads every message from the reader and writes an index entry
+// for each one to w. The number of messages indexed is returned.
+//
+// The index is a compact binary format: message offsets are stored relative
+// to the end of the previous message, and all of the integers are varints.
+// The total length of the input and the number of entries are written at the
+// end, so the index can be checked against the file it describes.
+func BuildIndex(reader *Reader, w io.Writer) (int, error) {
+	var (
+		bw      = bufio.NewWriter(w)
+		scratch = make([]byte, binary.MaxVarintLen64)
+		prevEnd int64
+		count   int
+	)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(scratch, v)
+		bw.Write(scratch[:n])
+	}
+	writeBytes := func(b []byte) {
+		writeUvarint(uint64(len(b)))
+		bw.Write(b)
+	}
+	bw.Write(indexMagic)
+
+	for {
+		reader.lock.Lock()
+		data, offset, err := reader.readRawContext(context.Background())
+		reader.lock.Unlock()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, err
+		}
+		fields := headerFields(data)
+
+		writeUvarint(uint64(offset - prevEnd))
+		writeUvarint(uint64(len(data)))
+		writeBytes(indexField(fields, 9))
+		writeBytes(indexField(fields, 10))
+		writeBytes(indexField(fields, 7))
+
+		prevEnd = offset + int64(len(data))
+		count++
+	}
+	trailer := make([]byte, 16)
+	binary.BigEndian.PutUint64(trailer, uint64(reader.scanner.offset))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(count))
+	bw.Write(trailer)
+
+	return count, bw.Flush()
+}
+
+func indexField(fields [][]byte, n int) []byte {
+	if n < len(fields) {
+		return fields[n]
+	}
+	return nil
+}
+
+// IndexFile builds an index for the HL7 file at the given path, and writes it
+// next to the file with IndexExt appended to the name. The index is written to
+// a temporary file first and then renamed, so a crash never leaves a partial
+// index behind. Compressed files can't be indexed, and ErrCompressed is
+// returned for them.
+func IndexFile(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	src, closer, err := decompress(file)
+
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		closer.Close()
+		return fmt.Errorf("%s: %w", path, ErrCompressed)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = BuildIndex(NewReader(src), tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path+IndexExt)
+}
+
+// ReadIndex decodes an index written by BuildIndex. The second return value
+// is the length of the input the index was built from.
+func ReadIndex(r io.Reader) ([]IndexEntry, int64, error) {
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < len(indexMagic)+16 || !bytes.Equal(data[:len(indexMagic)], indexMagic) {
+		return nil, 0, ErrInvalidIndex
+	}
+	trailer := data[len(data)-16:]
+	size := int64(binary.BigEndian.Uint64(trailer))
+	count := binary.BigEndian.Uint64(trailer[8:])
+
+	// Every entry takes at least two bytes, so a larger count can't be right,
+	// and would otherwise be used to allocate the entries.
+	if count > uint64(len(data))/2 || size < 0 {
+		return nil, 0, ErrInvalidIndex
+	}
+	var (
+		buf     = bytes.NewReader(data[len(indexMagic) : len(data)-16])
+		entries = make([]IndexEntry, 0, count)
+		prevEnd int64
+	)
+	readBytes := func() (string, error) {
+		n, err := binary.ReadUvarint(buf)
+
+		if err != nil || n > uint64(buf.Len()) {
+			return "", ErrInvalidIndex
+		}
+		b := make([]byte, n)
+		buf.Read(b)
+
+		return string(b), nil
+	}
+
+	for buf.Len() > 0 {
+		var (
+			entry IndexEntry
+			err   error
+		)
+		delta, err1 := binary.ReadUvarint(buf)
+		length, err2 := binary.ReadUvarint(buf)
+
+		if err1 != nil || err2 != nil {
+			return nil, 0, ErrInvalidIndex
+		}
+		// Each entry must lie within the input, or reading the message would
+		// try to allocate whatever length the index claims.
+		if remaining := uint64(size - prevEnd); delta > remaining || length > remaining-delta {
+			return nil, 0, ErrInvalidIndex
+		}
+		entry.Offset = prevEnd + int64(delta)
+		entry.Length = int64(length)
+
+		if entry.Type, err = readBytes(); err != nil {
+			return nil, 0, err
+		}
+		if entry.ControlID, err = readBytes(); err != nil {
+			return nil, 0, err
+		}
+		if entry.Time, err = readBytes(); err != nil {
+			return nil, 0, err
+		}
+		prevEnd = entry.Offset + entry.Length
+		entries = append(entries, entry)
+	}
+	if uint64(len(entries)) != count {
+		return nil, 0, ErrInvalidIndex
+	}
+	return entries, size, nil
+}
+
+// IndexedFile provides random access to the messages within a file, using an
+// index built by BuildIndex. Only the index is held in memory; messages are
+// read from the file when they are requested.
+type IndexedFile struct {
+	reader      io.ReaderAt
+	closer      io.Closer
+	entries     []IndexEntry
+	byControlID map[string][]int
+}
+
+// NewIndexedFile returns an IndexedFile that reads messages from r, using the
+// index read from index.
+func NewIndexedFile(r io.ReaderAt, index io.Reader) (*IndexedFile, error) {
+	entries, _, err := ReadIndex(index)
+
+	if err != nil {
+		return nil, err
+	}
+	return newIndexedFile(r, entries), nil
+}
+
+func newIndexedFile(r io.ReaderAt, entries []IndexEntry) *IndexedFile {
+	f := IndexedFile{
+		reader:      r,
+		entries:     entries,
+		byControlID: map[string][]int{},
+	}
+	for i, entry := range entries {
+		f.byControlID[entry.ControlID] = append(f.byControlID[entry.ControlID], i)
+	}
+	return &f
+}
+
+// OpenIndexedFile opens the HL7 file at the given path along with its sidecar
+// index (see IndexFile). ErrStaleIndex is returned if the size of the file no
+// longer matches the index, and ErrCompressed if the file is compressed.
+func OpenIndexedFile(path string) (*IndexedFile, error) {
+	index, err := os.Open(path + IndexExt)
+
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	entries, size, err := ReadIndex(index)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", index.Name(), err)
+	}
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, closer, _ := decompress(io.NewSectionReader(file, 0, info.Size())); closer != nil {
+		closer.Close()
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, ErrCompressed)
+	}
+	if info.Size() != size {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", index.Name(), ErrStaleIndex)
+	}
+	f := newIndexedFile(file, entries)
+	f.closer = file
+
+	return f, nil
+}
+
+// Close closes the underlying file, if it was opened by OpenIndexedFile.
+func (f *IndexedFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// Len returns the number of messages in the file.
+func (f *IndexedFile) Len() int {
+	return len(f.entries)
+}
+
+// Entry returns the index entry of the message at the given zero-based
+// position.
+func (f *IndexedFile) Entry(idx int) (IndexEntry, bool) {
+	if idx < 0 || idx >= len(f.entries) {
+		return IndexEntry{}, false
+	}
+	return f.entries[idx], true
+}
+
+// Message reads the message at the given zero-based position from the file.
+func (f *IndexedFile) Message(idx int) (*Message, error) {
+	entry, ok := f.Entry(idx)
+
+	if !ok {
+		return nil, fmt.Errorf("message %d out of range (%d messages)", idx, len(f.entries))
+	}
+	data := make([]byte, entry.Length)
+
+	if _, err := f.reader.ReadAt(data, entry.Offset); err != nil {
+		return nil, err
+	}
+	return newMessageAt(data, entry.Offset)
+}
+
+// MessagesByControlID reads every message with the given control ID (MSH-10)
+// from the file, in the order they appear. Control IDs are supposed to be
+// unique, but in practice they are often reused by senders, so there may be
+// more than one.
+func (f *IndexedFile) MessagesByControlID(id string) ([]*Message, error) {
+	var msgs []*Message
+
+	for _, idx := range f.byControlID[id] {
+		msg, err := f.Message(idx)
+
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,152 @@
+package hl7
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const indexTestData = "MSH|^~\\&|A|B|C|D|20200101120000||ADT^A01|1|P|2.5\rPID|1\r\n" +
+	"MSH|^~\\&|A|B|C|D|20200101120100||ORU^R01|2|P|2.5\rOBX|1\r\n" +
+	"\r\n" +
+	"MSH|^~\\&|A|B|C|D|20200101120200||ADT^A08|1|P|2.5\rPID|2\r\n" +
+	"MSH|^~\\&\r\n"
+
+func TestBuildIndex(t *testing.T) {
+	var buf bytes.Buffer
+
+	count, err := BuildIndex(NewReader(strings.NewReader(indexTestData)), &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+
+	entries, size, err := ReadIndex(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(indexTestData)), size)
+	assert.Equal(t, []IndexEntry{
+		{Offset: 0, Length: 54, Type: "ADT^A01", ControlID: "1", Time: "20200101120000"},
+		{Offset: 56, Length: 54, Type: "ORU^R01", ControlID: "2", Time: "20200101120100"},
+		{Offset: 114, Length: 54, Type: "ADT^A08", ControlID: "1", Time: "20200101120200"},
+		{Offset: 170, Length: 8},
+	}, entries)
+}
+
+// rawIndex returns an index made of the encoded entries and the trailer.
+func rawIndex(entries []byte, size, count uint64) []byte {
+	data := append(append([]byte{}, indexMagic...), entries...)
+	data = append(data, make([]byte, 16)...)
+	binary.BigEndian.PutUint64(data[len(data)-16:], size)
+	binary.BigEndian.PutUint64(data[len(data)-8:], count)
+
+	return data
+}
+
+func TestReadIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", []byte("HL7IDX\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{"wrong count", append(append([]byte{}, indexMagic...), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)},
+		{"huge count", append(append([]byte{}, indexMagic...), 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)},
+		{"truncated entry", append(append([]byte{}, indexMagic...), 0, 8, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)},
+		{"negative size", rawIndex(nil, 1<<63, 0)},
+		{"entry past the end", rawIndex([]byte{0, 20, 0, 0, 0}, 10, 1)},
+		{"entry after the end", rawIndex([]byte{20, 0, 0, 0, 0}, 10, 1)},
+		{"second entry past the end", rawIndex([]byte{0, 8, 0, 0, 0, 1, 2, 0, 0, 0}, 10, 2)},
+		{"huge length", rawIndex([]byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0, 0, 0}, 10, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ReadIndex(bytes.NewReader(tt.data))
+			assert.Equal(t, ErrInvalidIndex, err)
+		})
+	}
+}
+
+func TestIndexedFile(t *testing.T) {
+	var index bytes.Buffer
+
+	_, err := BuildIndex(NewReader(strings.NewReader(indexTestData)), &index)
+	assert.Nil(t, err)
+
+	f, err := NewIndexedFile(strings.NewReader(indexTestData), &index)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, f.Len())
+
+	t.Run("by position", func(t *testing.T) {
+		msg, err := f.Message(1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(56), msg.Offset())
+
+		seg, err := msg.ReadSegment()
+		assert.Nil(t, err)
+		id, _ := seg.GetSubComponent(9, 0, 0, 0)
+		assert.Equal(t, "2", string(id))
+
+		_, err = f.Message(4)
+		assert.Error(t, err)
+		_, err = f.Message(-1)
+		assert.Error(t, err)
+	})
+
+	t.Run("by control ID", func(t *testing.T) {
+		msgs, err := f.MessagesByControlID("1")
+		assert.Nil(t, err)
+		assert.Len(t, msgs, 2)
+		assert.Equal(t, int64(0), msgs[0].Offset())
+		assert.Equal(t, int64(114), msgs[1].Offset())
+
+		msgs, err = f.MessagesByControlID("3")
+		assert.Nil(t, err)
+		assert.Len(t, msgs, 0)
+	})
+}
+
+func TestOpenIndexedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hl7")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "messages.hl7")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(indexTestData), 0644))
+	assert.Nil(t, IndexFile(path))
+
+	f, err := OpenIndexedFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, f.Len())
+
+	entry, ok := f.Entry(2)
+	assert.True(t, ok)
+	assert.Equal(t, "ADT^A08", entry.Type)
+	assert.Nil(t, f.Close())
+
+	// Appending to the file makes the index stale.
+	assert.Nil(t, ioutil.WriteFile(path, []byte(indexTestData+indexTestData), 0644))
+	_, err = OpenIndexedFile(path)
+	assert.True(t, errors.Is(err, ErrStaleIndex))
+
+	_, err = OpenIndexedFile(filepath.Join(dir, "missing.hl7"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Compressed files can't be indexed, nor opened with an index built from
+	// their contents.
+	compressed := filepath.Join(dir, "messages.hl7.gz")
+	assert.Nil(t, ioutil.WriteFile(compressed, gzipData([]byte(indexTestData)), 0644))
+	assert.True(t, errors.Is(IndexFile(compressed), ErrCompressed))
+
+	var buf bytes.Buffer
+	_, err = BuildIndex(NewReader(strings.NewReader(indexTestData)), &buf)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(compressed+IndexExt, buf.Bytes(), 0644))
+
+	_, err = OpenIndexedFile(compressed)
+	assert.True(t, errors.Is(err, ErrCompressed))
+}
@@ -3,6 +3,8 @@ package hl7
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 	"unicode"
@@ -16,8 +18,19 @@ const (
 	NB = '\x00' // Null byte
 )
 
+var (
+	// ErrInvalidHeader is used to represent the case where a message does not
+	// begin with an MSH segment.
+	ErrInvalidHeader = errors.New("message does not begin with an MSH segment")
+
+	// ErrInvalidSegment is used to represent the case where a segment does not
+	// begin with a valid three character segment ID.
+	ErrInvalidSegment = errors.New("invalid segment ID")
+)
+
 // Message is used to describe the parsed message.
 type Message struct {
+	data       []byte
 	segments   map[string][]Segment
 	reader     *bufio.Reader
 	lock       sync.Mutex
@@ -26,6 +39,32 @@ type Message struct {
 	subCompSep byte
 	repeat     byte
 	escape     byte
+
+	// The byte offsets of the beginning and end of the message within the
+	// input it was read from. These are only set for messages read using a
+	// Reader.
+	offset    int64
+	endOffset int64
+}
+
+// Bytes returns the raw data of the message, as it was passed to NewMessage.
+// The returned slice must not be modified.
+func (m *Message) Bytes() []byte {
+	return m.data
+}
+
+// Offset returns the byte offset within the input at which the message
+// begins. This is only meaningful for messages returned by a Reader.
+func (m *Message) Offset() int64 {
+	return m.offset
+}
+
+// EndOffset returns the byte offset within the input just past the end of the
+// message. This is only meaningful for messages returned by a Reader, and it
+// is the value to save as a checkpoint once the message has been committed
+// (see NewReaderFromOffset).
+func (m *Message) EndOffset() int64 {
+	return m.endOffset
 }
 
 // Parse is used to parse the segments within the message so that they can be
@@ -84,6 +123,42 @@ func (m *Message) ReadSegment() (Segment, error) {
 	return newSegment(m.fieldSep, m.compSep, m.subCompSep, m.repeat, m.escape, buf), nil
 }
 
+// Segment returns the first segment of the given type within the message.
+// Unlike ReadSegment and Parse, this works directly on the raw message data,
+// so it can be used at any time without affecting them.
+func (m *Message) Segment(stype string) (Segment, bool) {
+	if segments := m.findSegments(stype, 1); len(segments) > 0 {
+		return segments[0], true
+	}
+	return nil, false
+}
+
+// Segments returns all of the segments of the given type within the message,
+// in the order they appear. Like Segment, this does not affect ReadSegment or
+// Parse.
+func (m *Message) Segments(stype string) []Segment {
+	return m.findSegments(stype, -1)
+}
+
+// findSegments returns up to max segments of the given type (or all of them,
+// if max is negative).
+func (m *Message) findSegments(stype string, max int) []Segment {
+	var segments []Segment
+
+	for _, line := range bytes.FieldsFunc(m.data, func(r rune) bool { return r == CR || r == LF }) {
+		if max >= 0 && len(segments) >= max {
+			break
+		}
+		if !bytes.HasPrefix(line, []byte(stype)) {
+			continue
+		}
+		if len(line) == len(stype) || line[len(stype)] == m.fieldSep {
+			segments = append(segments, newSegment(m.fieldSep, m.compSep, m.subCompSep, m.repeat, m.escape, line))
+		}
+	}
+	return segments
+}
+
 // NewMessage takes a byte slice and returns a Message that is ready to use.
 func NewMessage(data []byte) (*Message, error) {
 	// The message must have at least 8 bytes in order to catch all of the
@@ -94,6 +169,7 @@ func NewMessage(data []byte) (*Message, error) {
 	reader := bytes.NewBuffer(data)
 
 	m := Message{
+		data:       data,
 		reader:     bufio.NewReader(reader),
 		fieldSep:   data[3],
 		compSep:    data[4],
@@ -103,3 +179,97 @@ func NewMessage(data []byte) (*Message, error) {
 	}
 	return &m, nil
 }
+
+// newMessageAt returns a new Message that records the offset within the input
+// at which it was found.
+func newMessageAt(data []byte, offset int64) (*Message, error) {
+	// NewMessage returns io.EOF for data too short to hold a header, but a
+	// fragment like that in the middle of the input is not the end of it.
+	if len(data) < 8 {
+		return nil, ErrInvalidHeader
+	}
+	m, err := NewMessage(data)
+
+	if err != nil {
+		return nil, err
+	}
+	m.offset = offset
+	m.endOffset = offset + int64(len(data))
+
+	return m, nil
+}
+
+// headerFields splits the MSH segment of the raw message data into its fields,
+// numbered so that fields[n] is MSH-n. Since MSH-1 is the field separator
+// itself, fields[1] is always just that one byte. Nil is returned if the data
+// is too short to contain a header.
+func headerFields(data []byte) [][]byte {
+	if len(data) < 4 {
+		return nil
+	}
+	end := bytes.IndexAny(data, "\r\n")
+
+	if end < 0 {
+		end = len(data)
+	}
+	parts := bytes.Split(data[:end], data[3:4])
+	fields := make([][]byte, len(parts)+1)
+	fields[0] = parts[0]
+	fields[1] = data[3:4]
+	copy(fields[2:], parts[1:])
+
+	return fields
+}
+
+// setHeaderField returns a copy of the message with MSH-n set to the value,
+// which is used as is (so it may contain component separators). Empty fields
+// are added if the header is too short to have MSH-n.
+func setHeaderField(msg *Message, n int, value string) (*Message, error) {
+	data := msg.Bytes()
+	fields := headerFields(data)
+
+	if len(fields) < 3 || n < 3 {
+		return nil, ErrInvalidHeader
+	}
+	end := bytes.IndexAny(data, "\r\n")
+
+	if end < 0 {
+		end = len(data)
+	}
+	for len(fields) <= n {
+		fields = append(fields, nil)
+	}
+	fields[n] = []byte(value)
+
+	var buf bytes.Buffer
+
+	// MSH-1 is the separator between the fields, so it is not written itself.
+	buf.Write(fields[0])
+	buf.WriteByte(msg.fieldSep)
+	buf.Write(bytes.Join(fields[2:], []byte{msg.fieldSep}))
+	buf.Write(data[end:])
+
+	return NewMessage(buf.Bytes())
+}
+
+// checkMessage performs some basic sanity checks on the raw message data: it
+// must begin with an MSH segment, and every segment must begin with a three
+// character segment ID made up of upper case letters and digits.
+func checkMessage(data []byte) error {
+	if len(data) < 8 || !bytes.HasPrefix(data, []byte("MSH")) {
+		return ErrInvalidHeader
+	}
+	fieldSep := data[3]
+
+	for i, line := range bytes.FieldsFunc(data, func(r rune) bool { return r == CR || r == LF }) {
+		if len(line) < 3 || (len(line) > 3 && line[3] != fieldSep) {
+			return fmt.Errorf("%w: segment %d: %q", ErrInvalidSegment, i+1, line)
+		}
+		for _, b := range line[:3] {
+			if (b < 'A' || b > 'Z') && (b < '0' || b > '9') {
+				return fmt.Errorf("%w: segment %d: %q", ErrInvalidSegment, i+1, line)
+			}
+		}
+	}
+	return nil
+}
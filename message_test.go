@@ -3,11 +3,43 @@ package hl7
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// msh holds the header fields of a message built by testMessage. Fields that
+// are left empty are empty in the message, except for the message type, which
+// defaults to ADT^A01.
+type msh struct {
+	app       string // MSH-3
+	facility  string // MSH-4
+	msgType   string // MSH-9
+	controlID string // MSH-10
+	seq       string // MSH-13
+	acceptAck string // MSH-15
+	appAck    string // MSH-16
+}
+
+// testMessage returns a version 2.5 message with the header fields, followed
+// by the segments, or by a PID segment if there are none.
+func testMessage(h msh, segments ...string) *Message {
+	if h.msgType == "" {
+		h.msgType = "ADT^A01"
+	}
+	if len(segments) == 0 {
+		segments = []string{"PID|1"}
+	}
+	header := fmt.Sprintf("MSH|^~\\&|%s|%s|||||%s|%s|P|2.5|%s||%s|%s",
+		h.app, h.facility, h.msgType, h.controlID, h.seq, h.acceptAck, h.appAck)
+
+	msg, _ := NewMessage([]byte(strings.TrimRight(header, "|") + "\r" + strings.Join(segments, "\r") + "\r"))
+	return msg
+}
+
 func TestNewMessage(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -22,6 +54,7 @@ func TestNewMessage(t *testing.T) {
 			"Minimal example",
 			[]byte(`MSH|^~\&`),
 			&Message{
+				data:       []byte(`MSH|^~\&`),
 				reader:     bufio.NewReader(bytes.NewBuffer([]byte(`MSH|^~\&`))),
 				fieldSep:   '|',
 				compSep:    '^',
@@ -35,6 +68,7 @@ func TestNewMessage(t *testing.T) {
 			"Custom separators",
 			[]byte("MSH....."),
 			&Message{
+				data:       []byte("MSH....."),
 				reader:     bufio.NewReader(bytes.NewBuffer([]byte("MSH....."))),
 				fieldSep:   '.',
 				compSep:    '.',
@@ -124,3 +158,119 @@ func TestMessageReadSegment(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"valid", "MSH|^~\\&|\rPID|1\r\nPV1", nil},
+		{"too short", "MSH|^~", ErrInvalidHeader},
+		{"no header", "PID|^~\\&|", ErrInvalidHeader},
+		{"lower case segment", "MSH|^~\\&|\rpid|1", ErrInvalidSegment},
+		{"short segment", "MSH|^~\\&|\rPI", ErrInvalidSegment},
+		{"long segment ID", "MSH|^~\\&|\rPIDX|1", ErrInvalidSegment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMessage([]byte(tt.data))
+			assert.True(t, errors.Is(err, tt.want))
+		})
+	}
+}
+
+func TestHeaderFields(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"minimal", "MSH|^~\\&", []string{"MSH", "|", "^~\\&"}},
+		{"custom separator", "MSH#^~\\&#A#B", []string{"MSH", "#", "^~\\&", "A", "B"}},
+		{
+			"multiple segments",
+			"MSH|^~\\&|App|Fac||||ADT^A01|123\rPID|1",
+			[]string{"MSH", "|", "^~\\&", "App", "Fac", "", "", "", "ADT^A01", "123"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+
+			for _, field := range headerFields([]byte(tt.data)) {
+				got = append(got, string(field))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMessageSegments(t *testing.T) {
+	data := "MSH|^~\\&|App\rPID|1\rOBX|1|A\r\nOBX|2|B\rOBXX|3\rOB"
+
+	tests := []struct {
+		name  string
+		stype string
+		want  []string
+	}{
+		{"header", "MSH", []string{"MSH"}},
+		{"one segment", "PID", []string{"1"}},
+		{"two segments", "OBX", []string{"1", "2"}},
+		{"missing segment", "PV1", nil},
+		{"partial segment ID", "OB", []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := NewMessage([]byte(data))
+
+			var got []string
+
+			for _, seg := range msg.Segments(tt.stype) {
+				value, _ := seg.GetSubComponent(1, 0, 0, 0)
+				if tt.stype == "MSH" {
+					value, _ = seg.GetSubComponent(0, 0, 0, 0)
+				}
+				got = append(got, string(value))
+			}
+			assert.Equal(t, tt.want, got)
+
+			seg, ok := msg.Segment(tt.stype)
+			assert.Equal(t, len(tt.want) > 0, ok)
+			assert.Equal(t, ok, seg != nil)
+
+			// Neither of these should affect reading the segments one by one.
+			first, err := msg.ReadSegment()
+			assert.Nil(t, err)
+			assert.Equal(t, "MSH", first.Type())
+		})
+	}
+}
+
+func TestSetHeaderField(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		field   int
+		value   string
+		want    string
+		wantErr error
+	}{
+		{"replace", "MSH|^~\\&|A|B|||||ADT^A01|1|P|2.5|7\rPID|1", 13, "8", "MSH|^~\\&|A|B|||||ADT^A01|1|P|2.5|8\rPID|1", nil},
+		{"extend", "MSH|^~\\&|A|B|||||ADT^A01|1|P|2.5\rPID|1", 15, "AL", "MSH|^~\\&|A|B|||||ADT^A01|1|P|2.5|||AL\rPID|1", nil},
+		{"first field", "MSH|^~\\&|A|B", 3, "X^Y", "MSH|^~\\&|X^Y|B", nil},
+		{"separators", "MSH|^~\\&|A|B", 2, "", "", ErrInvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := NewMessage([]byte(tt.data))
+			got, err := setHeaderField(msg, tt.field, tt.value)
+			assert.Equal(t, tt.wantErr, err)
+
+			if err == nil {
+				assert.Equal(t, tt.want, string(got.Bytes()))
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package hl7
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// errCodeInternal is the code from HL7 table 0357 for an application internal
+// error.
+const errCodeInternal = "207"
+
+// Middleware wraps a Handler to add behavior before or after it runs.
+type Middleware func(Handler) Handler
+
+// Chain wraps the handler with the middlewares. The first middleware is the
+// outermost one, so it runs first when a message arrives.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Recover returns middleware that recovers from panics in the handler, logs
+// them along with a stack trace, and responds with AR (with an ERR segment
+// giving code 207, application internal error) instead. If logger is nil, the
+// log package's standard logger is used.
+func Recover(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) (resp *Message, err error) {
+			defer func() {
+				p := recover()
+
+				if p == nil {
+					return
+				}
+				logPrintf(logger, "hl7: panic handling %s: %v\n%s", describeMessage(msg), p, debug.Stack())
+
+				resp, err = msg.Ack(AckReject, &AckOptions{Errors: []AckIssue{{
+					Code: errCodeInternal,
+					Text: "Application internal error",
+				}}})
+			}()
+			return next.ServeHL7(ctx, msg)
+		})
+	}
+}
+
+// Logging returns middleware that logs each message once it has been handled,
+// with its type, control ID, how long it took and the acknowledgment code (or
+// error) that resulted. If logger is nil, the log package's standard logger is
+// used.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			start := time.Now()
+			resp, err := next.ServeHL7(ctx, msg)
+			elapsed := time.Since(start)
+
+			switch {
+			case err != nil:
+				logPrintf(logger, "hl7: %s: error after %v: %v", describeMessage(msg), elapsed, err)
+			case resp == nil:
+				logPrintf(logger, "hl7: %s: no response after %v", describeMessage(msg), elapsed)
+			case responseCode(resp) == "":
+				logPrintf(logger, "hl7: %s: responded after %v", describeMessage(msg), elapsed)
+			default:
+				logPrintf(logger, "hl7: %s: %s after %v", describeMessage(msg), responseCode(resp), elapsed)
+			}
+			return resp, err
+		})
+	}
+}
+
+// HandlerStats describes a single call to a handler, as reported by Metrics.
+type HandlerStats struct {
+	MessageType string        // The message type and trigger event, such as "ADT^A01".
+	ControlID   string        // The control ID of the message (MSH-10).
+	Code        string        // The acknowledgment code of the response, if any.
+	Duration    time.Duration // How long the handler took.
+	Err         error         // The error returned by the handler, if any.
+}
+
+// Metrics returns middleware that times each call to the handler and passes
+// the result to record, which can feed it to whatever metrics system is in
+// use. Record is called synchronously, so it should not block.
+func Metrics(record func(HandlerStats)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			start := time.Now()
+			resp, err := next.ServeHL7(ctx, msg)
+			_, msgType, trigger := routingFields(msg)
+
+			stats := HandlerStats{
+				MessageType: msgType,
+				ControlID:   string(indexField(headerFields(msg.data), 10)),
+				Duration:    time.Since(start),
+				Err:         err,
+			}
+			if trigger != "" {
+				stats.MessageType += "^" + trigger
+			}
+			if resp != nil {
+				stats.Code = responseCode(resp)
+			}
+			record(stats)
+
+			return resp, err
+		})
+	}
+}
+
+// Validate returns middleware that checks each message before the handler
+// runs. If validate reports any issues with a severity of "E" (or no
+// severity), the message is not passed on to the handler, and the response is
+// AE with an ERR segment for each issue. Warnings and informational issues do
+// not stop the message.
+func Validate(validate func(msg *Message) []AckIssue) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			issues := validate(msg)
+
+			for _, issue := range issues {
+				if issue.Severity == "" || issue.Severity == "E" {
+					return msg.Ack(AckError, &AckOptions{Errors: issues})
+				}
+			}
+			return next.ServeHL7(ctx, msg)
+		})
+	}
+}
+
+// SuppressDuplicates returns middleware that remembers the last size
+// messages that were accepted, and acknowledges them again without calling the
+// handler if they arrive a second time. This is shorthand for the Middleware
+// method of a new in-memory DuplicateDetector, so a size less than 1 is
+// treated as 1.
+func SuppressDuplicates(size int) Middleware {
+	return NewDuplicateDetector(size).Middleware()
+}
+
+// describeMessage returns the message type and control ID, for logging.
+func describeMessage(msg *Message) string {
+	h := headerFields(msg.data)
+	return fmt.Sprintf("%s message %q", indexField(h, 9), indexField(h, 10))
+}
+
+// responseCode returns the acknowledgment code of a response, or an empty
+// string if it is not an acknowledgment.
+func responseCode(resp *Message) string {
+	ack, err := ParseAck(resp)
+
+	if err != nil {
+		return ""
+	}
+	return ack.Code
+}
+
+func logPrintf(logger *log.Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
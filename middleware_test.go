@@ -0,0 +1,159 @@
+package hl7
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+				order = append(order, name)
+				return next.ServeHL7(ctx, msg)
+			})
+		}
+	}
+	h := Chain(echoHandler, mark("first"), mark("second"), mark("third"))
+
+	_, err := h.ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second", "third"}, order)
+}
+
+func TestRecover(t *testing.T) {
+	var logs bytes.Buffer
+
+	h := Recover(log.New(&logs, "", 0))(HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		panic("oops")
+	}))
+	resp, err := h.ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+
+	ack, err := ParseAck(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, AckReject, ack.Code)
+	assert.Equal(t, "1", ack.ControlID)
+
+	if assert.Len(t, ack.Errors, 1) {
+		assert.Equal(t, "207", ack.Errors[0].Code)
+	}
+	assert.True(t, strings.Contains(logs.String(), `panic handling ADT^A01 message "1": oops`))
+}
+
+func TestLogging(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler Handler
+		want    string
+	}{
+		{"acknowledged", ackHandler, `hl7: ADT^A01 message "1": AA after `},
+		{"not an acknowledgment", echoHandler, `hl7: ADT^A01 message "1": responded after `},
+		{"no response", HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			return nil, nil
+		}), `hl7: ADT^A01 message "1": no response after `},
+		{"error", HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			return nil, errors.New("oops")
+		}), `hl7: ADT^A01 message "1": error after `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			Logging(log.New(&logs, "", 0))(tt.handler).ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+			assert.True(t, strings.HasPrefix(logs.String(), tt.want), logs.String())
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var stats []HandlerStats
+
+	h := Metrics(func(s HandlerStats) { stats = append(stats, s) })(ackHandler)
+
+	h.ServeHL7(context.Background(), testMessage(msh{controlID: "1"}))
+	h.ServeHL7(context.Background(), testMessage(msh{controlID: "fail"}))
+
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, "ADT^A01", stats[0].MessageType)
+		assert.Equal(t, "1", stats[0].ControlID)
+		assert.Equal(t, AckAccept, stats[0].Code)
+		assert.Equal(t, AckError, stats[1].Code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	requirePID := func(msg *Message) []AckIssue {
+		if _, ok := msg.Segment("PID"); !ok {
+			return []AckIssue{{Location: "PID", Code: "100", Text: "Segment sequence error"}}
+		}
+		if _, ok := msg.Segment("PV1"); !ok {
+			return []AckIssue{{Location: "PV1", Code: "100", Severity: "W"}}
+		}
+		return nil
+	}
+	h := Validate(requirePID)(ackHandler)
+
+	tests := []struct {
+		name string
+		data string
+		code string
+	}{
+		{"valid", "MSH|^~\\&|||||||ADT^A01|1|P|2.5\rPID|1\rPV1|1", AckAccept},
+		{"warning", "MSH|^~\\&|||||||ADT^A01|1|P|2.5\rPID|1", AckAccept},
+		{"error", "MSH|^~\\&|||||||ADT^A01|1|P|2.5\rPV1|1", AckError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _ := NewMessage([]byte(tt.data))
+			resp, err := h.ServeHL7(context.Background(), msg)
+			assert.Nil(t, err)
+
+			ack, err := ParseAck(resp)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, ack.Code)
+		})
+	}
+}
+
+func TestSuppressDuplicates(t *testing.T) {
+	var calls int32
+
+	h := SuppressDuplicates(2)(HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		atomic.AddInt32(&calls, 1)
+		return ackHandler(ctx, msg)
+	}))
+	send := func(id string) string {
+		resp, err := h.ServeHL7(context.Background(), testMessage(msh{controlID: id}))
+		assert.Nil(t, err)
+
+		ack, err := ParseAck(resp)
+		assert.Nil(t, err)
+		return string(indexField(headerFields(ack.Message.Bytes()), 10))
+	}
+
+	first := send("1")
+	assert.Equal(t, first, send("1"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Errors are not remembered, so the message can be retried.
+	send("fail")
+	send("fail")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Only the last two accepted messages are remembered.
+	send("2")
+	send("3")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+	assert.NotEqual(t, first, send("1"))
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+}
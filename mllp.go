@@ -0,0 +1,234 @@
+package hl7
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Constants describing the bytes used to frame messages with the Minimal Lower
+// Layer Protocol (MLLP). Each message is sent as SB, the message data, EB and
+// then a carriage return.
+const (
+	SB = '\x0b' // Start block
+	EB = '\x1c' // End block
+)
+
+// DefaultMaxFrameSize is the default limit on the size of a single MLLP frame.
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+var (
+	// ErrFrameTooLarge is used to represent the case where an MLLP frame is
+	// larger than the maximum frame size. The rest of the frame is discarded.
+	ErrFrameTooLarge = errors.New("mllp: frame too large")
+
+	// ErrTruncatedFrame is used to represent the case where an MLLP frame was
+	// started, but the input ended (or another frame started) before the end
+	// of the frame was found.
+	ErrTruncatedFrame = errors.New("mllp: truncated frame")
+)
+
+// frameEnd is the sequence of bytes that ends an MLLP frame.
+var frameEnd = []byte{EB, CR}
+
+// MLLPReader is used to read messages framed using MLLP, which is how HL7 is
+// usually sent over TCP connections.
+//
+// Anything between frames is ignored, so the reader is able to resynchronize
+// after garbage or a truncated frame. Errors for individual frames (such as
+// ErrFrameTooLarge and ErrTruncatedFrame) are not fatal; the next call picks up
+// at the next frame.
+type MLLPReader struct {
+	// MaxFrameSize is the largest frame that will be accepted. If it is zero,
+	// DefaultMaxFrameSize is used. It can't be raised beyond a little under
+	// 256MB, which is the most the reader will buffer. This should be set
+	// before reading.
+	MaxFrameSize int
+
+	scanner    *scanner
+	lock       sync.Mutex
+	discarding bool
+
+	// searched is how much of an incomplete frame has already been searched
+	// for its end, so that only the new data is searched when more arrives.
+	searched int
+}
+
+// NewMLLPReader is used to return a new MLLPReader that is ready to use.
+func NewMLLPReader(reader io.Reader) *MLLPReader {
+	r := MLLPReader{}
+	r.scanner = newScanner(reader, r.scanFrames)
+
+	return &r
+}
+
+// ReadMessage is used to read the message in the next frame.
+//
+// If the input is exhausted, io.EOF is returned. A frame that is too short to
+// contain a message header results in ErrInvalidHeader.
+func (r *MLLPReader) ReadMessage() (*Message, error) {
+	data, offset, err := r.readFrame()
+
+	if err != nil {
+		return nil, err
+	}
+	return newMessageAt(data, offset)
+}
+
+// ReadFrame is used to read the contents of the next frame without parsing
+// them.
+func (r *MLLPReader) ReadFrame() ([]byte, error) {
+	data, _, err := r.readFrame()
+	return data, err
+}
+
+// EachMessage is the MLLP equivalent of Reader.EachMessage.
+func (r *MLLPReader) EachMessage(fn MessageFunc) error {
+	for {
+		msg, err := r.ReadMessage()
+
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err = fn(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *MLLPReader) readFrame() ([]byte, int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	token, offset, err := r.scanner.scan()
+
+	if err != nil {
+		return nil, offset, err
+	}
+	data := make([]byte, len(token))
+	copy(data, token)
+
+	return data, offset, nil
+}
+
+func (r *MLLPReader) maxFrameSize() int {
+	// The frame has to be rejected before the buffer is full, leaving room for
+	// the start byte and the one past the limit that shows it is too large.
+	// Otherwise the scanner would fail before anything was discarded.
+	if limit := maxMessageSize - 3; r.MaxFrameSize > limit {
+		return limit
+	}
+	if r.MaxFrameSize > 0 {
+		return r.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+// scanFrames is a bufio.SplitFunc that returns the contents of MLLP frames.
+func (r *MLLPReader) scanFrames(data []byte, atEOF bool) (int, []byte, error) {
+	if r.discarding {
+		// We are skipping the rest of a frame that was too large, so throw
+		// everything away until the frame ends or a new one begins.
+		if i := bytes.IndexByte(data, SB); i >= 0 {
+			if j := bytes.Index(data[:i], frameEnd); j >= 0 {
+				i = j + len(frameEnd)
+			}
+			r.discarding = false
+			return i, nil, nil
+		}
+		if j := bytes.Index(data, frameEnd); j >= 0 {
+			r.discarding = false
+			return j + len(frameEnd), nil, nil
+		}
+		// Hold on to a trailing EB, in case it is the first half of frameEnd.
+		if n := len(data); n > 0 && data[n-1] == EB && !atEOF {
+			return n - 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+	start := bytes.IndexByte(data, SB)
+
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	frame := data[start+1:]
+
+	// An incomplete frame is left at the front of the data, so if the last
+	// call got part of the way through it, the search carries on from there.
+	from := 0
+
+	if start == 0 && r.searched <= len(frame) {
+		from = r.searched
+	}
+	r.searched = 0
+	end := indexFrom(frame, frameEnd, from)
+
+	// If another frame begins before this one ends, this one was cut short.
+	if next := indexFrom(frame, []byte{SB}, from); next >= 0 && (end < 0 || next < end) {
+		return start + 1 + next, nil, ErrTruncatedFrame
+	}
+	if end >= 0 {
+		if end > r.maxFrameSize() {
+			return start + 1 + end + len(frameEnd), nil, ErrFrameTooLarge
+		}
+		return start + 1 + end + len(frameEnd), frame[:end], nil
+	}
+	if atEOF {
+		return len(data), nil, ErrTruncatedFrame
+	}
+	if len(frame) > r.maxFrameSize()+1 {
+		r.discarding = true
+		return len(data), nil, ErrFrameTooLarge
+	}
+	// The last byte could be the EB of a frameEnd that has not all arrived.
+	if len(frame) > 0 {
+		r.searched = len(frame) - 1
+	}
+	return start, nil, nil
+}
+
+// indexFrom is the same as bytes.Index, except that the search starts at the
+// given position.
+func indexFrom(s, sep []byte, from int) int {
+	if i := bytes.Index(s[from:], sep); i >= 0 {
+		return from + i
+	}
+	return -1
+}
+
+// MLLPWriter is used to write messages framed using MLLP. It is safe to use
+// from multiple goroutines; each frame is written with a single call to the
+// underlying writer.
+type MLLPWriter struct {
+	writer io.Writer
+	lock   sync.Mutex
+	buf    []byte
+}
+
+// NewMLLPWriter is used to return a new MLLPWriter that is ready to use.
+func NewMLLPWriter(writer io.Writer) *MLLPWriter {
+	return &MLLPWriter{writer: writer}
+}
+
+// WriteMessage is used to write the message as a single MLLP frame.
+func (w *MLLPWriter) WriteMessage(msg *Message) error {
+	return w.WriteFrame(msg.Bytes())
+}
+
+// WriteFrame is used to write the data as a single MLLP frame. The data must
+// not contain any of the framing bytes.
+func (w *MLLPWriter) WriteFrame(data []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buf = append(w.buf[:0], SB)
+	w.buf = append(w.buf, data...)
+	w.buf = append(w.buf, EB, CR)
+
+	_, err := w.writer.Write(w.buf)
+	return err
+}
@@ -0,0 +1,142 @@
+package hl7
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMLLPReaderReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		max     int
+		results []interface{}
+	}{
+		{"empty", "", 0, nil},
+		{"one frame", "\x0bMSH|^~\\&|1\r\x1c\r", 0, []interface{}{"MSH|^~\\&|1\r"}},
+		{"two frames", "\x0bMSH|1\x1c\r\x0bMSH|2\x1c\r", 0, []interface{}{"MSH|1", "MSH|2"}},
+		{"garbage between frames", "junk\x0bMSH|1\x1c\r\r\n\x00junk\x0bMSH|2\x1c\rjunk", 0, []interface{}{"MSH|1", "MSH|2"}},
+		{"empty frame", "\x0b\x1c\r", 0, []interface{}{""}},
+		{"end block without CR", "\x0bMSH|1\x1cMSH|2\x1c\r", 0, []interface{}{"MSH|1\x1cMSH|2"}},
+		{"truncated at EOF", "\x0bMSH|1\x1c\r\x0bMSH|2", 0, []interface{}{"MSH|1", ErrTruncatedFrame}},
+		{"truncated by next frame", "\x0bMSH|1\x0bMSH|2\x1c\r", 0, []interface{}{ErrTruncatedFrame, "MSH|2"}},
+		{"too large", "\x0bMSH|1\x1c\r\x0bMSH|22222\x1c\r\x0bMSH|3\x1c\r", 5, []interface{}{"MSH|1", ErrFrameTooLarge, "MSH|3"}},
+		{"too large (incomplete)", "\x0bMSH|1\x1c\r\x0bMSH|22222", 5, []interface{}{"MSH|1", ErrFrameTooLarge}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, reader := range []io.Reader{strings.NewReader(tt.data), iotest.OneByteReader(strings.NewReader(tt.data))} {
+				r := NewMLLPReader(reader)
+				r.MaxFrameSize = tt.max
+
+				for _, want := range tt.results {
+					got, err := r.ReadFrame()
+
+					if wantErr, ok := want.(error); ok {
+						assert.Equal(t, wantErr, err)
+					} else {
+						assert.Nil(t, err)
+						assert.Equal(t, want, string(got))
+					}
+				}
+				_, err := r.ReadFrame()
+				assert.Equal(t, io.EOF, err)
+			}
+		})
+	}
+}
+
+func TestMLLPReaderMaxFrameSize(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		want int
+	}{
+		{"default", 0, DefaultMaxFrameSize},
+		{"set", 1024, 1024},
+		{"beyond the buffer limit", 1 << 30, maxMessageSize - 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewMLLPReader(strings.NewReader(""))
+			r.MaxFrameSize = tt.max
+			assert.Equal(t, tt.want, r.maxFrameSize())
+		})
+	}
+}
+
+func TestMLLPReaderEachMessage(t *testing.T) {
+	data := "\x0bMSH|^~\\&|1\r\x1c\r\x0bMSH|^~\\&|2\r\x1c\r"
+	var offsets []int64
+
+	err := NewMLLPReader(strings.NewReader(data)).EachMessage(func(msg *Message) error {
+		offsets = append(offsets, msg.Offset())
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 15}, offsets)
+
+	err = NewMLLPReader(strings.NewReader("\x0bMSH\x1c\r")).EachMessage(func(msg *Message) error {
+		return nil
+	})
+	assert.Equal(t, ErrInvalidHeader, err)
+}
+
+func TestMLLPWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := NewMLLPWriter(&buf)
+	msg, _ := NewMessage([]byte("MSH|^~\\&|1\r"))
+
+	assert.Nil(t, w.WriteMessage(msg))
+	assert.Nil(t, w.WriteFrame([]byte("MSH|^~\\&|2\r")))
+	assert.Equal(t, "\x0bMSH|^~\\&|1\r\x1c\r\x0bMSH|^~\\&|2\r\x1c\r", buf.String())
+
+	// Whatever is written should be readable again.
+	r := NewMLLPReader(&buf)
+
+	for _, want := range []string{"MSH|^~\\&|1\r", "MSH|^~\\&|2\r"} {
+		msg, err := r.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(msg.Bytes()))
+	}
+}
+
+// smallReads limits each read to n bytes, like a network connection that
+// delivers a large frame one segment at a time.
+type smallReads struct {
+	r io.Reader
+	n int
+}
+
+func (s smallReads) Read(p []byte) (int, error) {
+	if len(p) > s.n {
+		p = p[:s.n]
+	}
+	return s.r.Read(p)
+}
+
+// BenchmarkMLLPReaderLargeFrame reports the throughput of the reader for a
+// frame that arrives in many small reads, which should not mean searching the
+// start of the frame again for every one of them.
+func BenchmarkMLLPReaderLargeFrame(b *testing.B) {
+	data := append(append([]byte{SB}, benchmarkData(8*1024*1024)...), EB, CR)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader := NewMLLPReader(smallReads{r: bytes.NewReader(data), n: 1460})
+
+		if _, err := reader.ReadFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
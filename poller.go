@@ -0,0 +1,321 @@
+package hl7
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPollInterval is used by DirPoller when Interval is not set.
+const DefaultPollInterval = 5 * time.Second
+
+// The subdirectories used by DirPoller, and the suffixes of the files it keeps
+// in the "state" subdirectory for each file it is processing.
+const (
+	pollerProcessingDir = "processing"
+	pollerProcessedDir  = "processed"
+	pollerErrorDir      = "error"
+	pollerStateDir      = "state"
+	checkpointExt       = ".checkpoint"
+	errorReportExt      = ".errors"
+)
+
+// DirPoller watches a directory that other systems drop files of HL7 messages
+// into, and passes each message to a Handler.
+//
+// Each new file is first moved into the "processing" subdirectory, so it is
+// only ever picked up once. Once every message in it has been handled, it is
+// moved to the "processed" subdirectory, or to the "error" subdirectory if
+// any message could not be parsed, the handler returned an error, or the
+// handler responded with AE or AR. In the latter case, a report listing the
+// failed messages is written next to it, with ".errors" appended to its name.
+// All of the moves are renames, so the subdirectories must be on the same
+// filesystem as the directory itself. Files compressed with gzip or zlib are
+// decompressed transparently (see NewDecompressingReader).
+//
+// Progress through each file is checkpointed after every message, so if the
+// process is restarted part way through a file, processing resumes after the
+// last message that was handled, rather than starting the file again. The
+// checkpoints (and reports in progress) are kept in the "state"
+// subdirectory.
+type DirPoller struct {
+	Dir     string  // The directory to watch.
+	Handler Handler // The handler to invoke for each message.
+
+	// Interval is how long to wait between looking for new files. Zero means
+	// DefaultPollInterval.
+	Interval time.Duration
+
+	// MinAge is how long a file must have gone without being modified before
+	// it is picked up, to avoid reading files that are still being written.
+	// Zero means files are picked up as soon as they are seen, which is only
+	// safe if the other system writes them under a temporary name and renames
+	// them when finished. Files whose names begin with "." are always ignored.
+	MinAge time.Duration
+
+	// ErrorLog is used to log errors processing files. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+}
+
+// Run processes any files that were interrupted by a restart, and then polls
+// the directory for new files until the context is done.
+func (p *DirPoller) Run(ctx context.Context) error {
+	interval := p.Interval
+
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	for {
+		if _, err := p.Poll(ctx); err != nil && ctx.Err() == nil {
+			logPrintf(p.ErrorLog, "hl7: error polling %s: %v", p.Dir, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Poll makes a single pass over the directory: it finishes any files left in
+// the "processing" subdirectory by an earlier run, then processes any new
+// files, oldest first. It returns the number of files that were processed.
+func (p *DirPoller) Poll(ctx context.Context) (int, error) {
+	processing := filepath.Join(p.Dir, pollerProcessingDir)
+
+	for _, sub := range []string{pollerProcessingDir, pollerProcessedDir, pollerErrorDir, pollerStateDir} {
+		if err := os.MkdirAll(filepath.Join(p.Dir, sub), 0755); err != nil {
+			return 0, err
+		}
+	}
+	interrupted, err := p.interrupted()
+
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+
+	for _, name := range interrupted {
+		if err := p.processFile(ctx, filepath.Join(processing, name)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	infos, err := ioutil.ReadDir(p.Dir)
+
+	if err != nil {
+		return count, err
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	for _, info := range infos {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if p.MinAge > 0 && time.Since(info.ModTime()) < p.MinAge {
+			continue
+		}
+		path := uniquePath(processing, info.Name())
+
+		if err := os.Rename(filepath.Join(p.Dir, info.Name()), path); err != nil {
+			if os.IsNotExist(err) {
+				// Somebody else got to it first.
+				continue
+			}
+			return count, err
+		}
+		if err := p.processFile(ctx, path); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// interrupted returns the names of the files in the "processing" directory,
+// which were being processed when an earlier run stopped. Checkpoints and
+// reports that were left behind after their file was moved are cleaned up.
+func (p *DirPoller) interrupted() ([]string, error) {
+	var (
+		processing = filepath.Join(p.Dir, pollerProcessingDir)
+		state      = filepath.Join(p.Dir, pollerStateDir)
+		names      []string
+		existing   = map[string]bool{}
+	)
+	infos, err := ioutil.ReadDir(processing)
+
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+			existing[info.Name()] = true
+		}
+	}
+	if infos, err = ioutil.ReadDir(state); err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+
+		switch {
+		case strings.HasSuffix(name, checkpointExt+".tmp"):
+			os.Remove(filepath.Join(state, name))
+		case strings.HasSuffix(name, checkpointExt):
+			if !existing[strings.TrimSuffix(name, checkpointExt)] {
+				os.Remove(filepath.Join(state, name))
+			}
+		case strings.HasSuffix(name, errorReportExt):
+			if !existing[strings.TrimSuffix(name, errorReportExt)] {
+				os.Rename(filepath.Join(state, name), filepath.Join(p.Dir, pollerErrorDir, name))
+			}
+		}
+	}
+	return names, nil
+}
+
+// processFile passes the messages in the file to the handler, starting from
+// the checkpoint if there is one, and then moves the file to the "processed"
+// or "error" directory.
+func (p *DirPoller) processFile(ctx context.Context, path string) error {
+	var (
+		index      int
+		offset     int64
+		state      = filepath.Join(p.Dir, pollerStateDir, filepath.Base(path))
+		checkpoint = state + checkpointExt
+		report     = state + errorReportExt
+	)
+	if data, err := ioutil.ReadFile(checkpoint); err == nil {
+		if _, err = fmt.Sscan(string(data), &offset, &index); err != nil {
+			return fmt.Errorf("hl7: invalid checkpoint %s: %w", checkpoint, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	r, file, err := openFromOffset(path, offset)
+
+	if err != nil {
+		return err
+	}
+	for ; ; index++ {
+		r.lock.Lock()
+		data, offset, err := r.readRawContext(ctx)
+		r.lock.Unlock()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return err
+		}
+		msg, err := parseChecked(data, offset)
+
+		if err == nil {
+			err = p.handle(ctx, msg)
+		}
+		if ctx.Err() != nil {
+			// The message may not have been handled, so it is left to be
+			// tried again next time.
+			file.Close()
+			return ctx.Err()
+		}
+		if err != nil {
+			line := (&MessageError{Index: index, Offset: offset, Err: err}).Error() + "\n"
+
+			if err = appendFileSync(report, []byte(line)); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		progress := fmt.Sprintf("%d %d\n", offset+int64(len(data)), index+1)
+
+		if err = writeFileSync(checkpoint+".tmp", []byte(progress)); err != nil {
+			file.Close()
+			return err
+		}
+		if err = os.Rename(checkpoint+".tmp", checkpoint); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	dest := pollerProcessedDir
+
+	if _, err := os.Stat(report); err == nil {
+		dest = pollerErrorDir
+	}
+	name := filepath.Base(uniquePath(filepath.Join(p.Dir, dest), filepath.Base(path)))
+
+	if err = os.Rename(path, filepath.Join(p.Dir, dest, name)); err != nil {
+		return err
+	}
+	if dest == pollerErrorDir {
+		logPrintf(p.ErrorLog, "hl7: errors processing %s, moved to %s", filepath.Base(path), filepath.Join(p.Dir, dest, name))
+
+		if err = os.Rename(report, filepath.Join(p.Dir, dest, name+errorReportExt)); err != nil {
+			return err
+		}
+	}
+	if err = os.Remove(checkpoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// handle passes the message to the handler, and turns negative
+// acknowledgments into errors.
+func (p *DirPoller) handle(ctx context.Context, msg *Message) error {
+	resp, err := p.Handler.ServeHL7(ctx, msg)
+
+	if err != nil || resp == nil {
+		return err
+	}
+	if ack, err := ParseAck(resp); err == nil && (ack.Code == AckError || ack.Code == AckReject) {
+		return &NegativeAckError{Ack: ack}
+	}
+	return nil
+}
+
+// uniquePath returns the path of a file with the given name in the directory,
+// adding a timestamp to the name if there is already a file with that name.
+func uniquePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.%s", name, time.Now().UTC().Format("20060102T150405.000000000")))
+}
+
+// appendFileSync appends the data to the file, creating it if it does not
+// exist, and syncs it to disk.
+func appendFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
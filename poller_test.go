@@ -0,0 +1,213 @@
+package hl7
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pollerFile returns the contents of a file holding the messages, which are
+// test messages with the given control IDs, or are used as is if they do not
+// begin with "MSH".
+func pollerFile(messages ...string) []byte {
+	var buf bytes.Buffer
+
+	for _, m := range messages {
+		if strings.HasPrefix(m, "MSH") {
+			buf.WriteString(m)
+		} else {
+			buf.Write(testMessage(msh{controlID: m}).Bytes())
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func TestDirPoller(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		handled  []string
+		dest     string
+		failures int
+	}{
+		{"all accepted", pollerFile("1", "2", "3"), []string{"1", "2", "3"}, pollerProcessedDir, 0},
+		{"rejected", pollerFile("1", "fail", "3"), []string{"1", "fail", "3"}, pollerErrorDir, 1},
+		{"unparseable", pollerFile("1", "MSH|^~\\&|\rbad segment\r", "3"), []string{"1", "3"}, pollerErrorDir, 1},
+		{"empty", nil, nil, pollerProcessedDir, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "poller")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "batch.hl7"), tt.data, 0644))
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".partial"), tt.data, 0644))
+
+			var handled []string
+
+			p := &DirPoller{Dir: dir, Handler: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+				handled = append(handled, string(indexField(headerFields(msg.Bytes()), 10)))
+				return ackHandler(ctx, msg)
+			})}
+			n, err := p.Poll(context.Background())
+			assert.Nil(t, err)
+			assert.Equal(t, 1, n)
+			assert.Equal(t, tt.handled, handled)
+
+			_, err = os.Stat(filepath.Join(dir, tt.dest, "batch.hl7"))
+			assert.Nil(t, err)
+			_, err = os.Stat(filepath.Join(dir, ".partial"))
+			assert.Nil(t, err)
+
+			leftover, _ := ioutil.ReadDir(filepath.Join(dir, pollerProcessingDir))
+			assert.Empty(t, leftover)
+			leftover, _ = ioutil.ReadDir(filepath.Join(dir, pollerStateDir))
+			assert.Empty(t, leftover)
+
+			report, err := ioutil.ReadFile(filepath.Join(dir, pollerErrorDir, "batch.hl7"+errorReportExt))
+
+			if tt.failures == 0 {
+				assert.True(t, os.IsNotExist(err))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.failures, strings.Count(string(report), "\n"))
+				assert.Contains(t, string(report), "message 1")
+			}
+
+			// Nothing is processed twice.
+			handled = nil
+			n, err = p.Poll(context.Background())
+			assert.Nil(t, err)
+			assert.Equal(t, 0, n)
+			assert.Empty(t, handled)
+		})
+	}
+}
+
+func TestDirPollerResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.hl7"), pollerFile("1", "fail", "3", "4"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.hl7"), pollerFile("5"), 0644))
+
+	var handled []string
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &DirPoller{Dir: dir, Handler: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		id := string(indexField(headerFields(msg.Bytes()), 10))
+		handled = append(handled, id)
+
+		// Simulate a shutdown part way through the first file.
+		if id == "3" && ctx.Err() == nil {
+			cancel()
+		}
+		return ackHandler(ctx, msg)
+	})}
+	_, err = p.Poll(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"1", "fail", "3"}, handled)
+
+	_, err = os.Stat(filepath.Join(dir, pollerStateDir, "a.hl7"+checkpointExt))
+	assert.Nil(t, err)
+
+	// The message that was interrupted is handled again, but none before it.
+	handled = nil
+	n, err := p.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"3", "4", "5"}, handled)
+
+	report, err := ioutil.ReadFile(filepath.Join(dir, pollerErrorDir, "a.hl7"+errorReportExt))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(report), "\n"))
+
+	_, err = os.Stat(filepath.Join(dir, pollerProcessedDir, "b.hl7"))
+	assert.Nil(t, err)
+}
+
+func TestDirPollerNameCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	p := &DirPoller{Dir: dir, Handler: ackHandler}
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "batch.hl7"), pollerFile("1"), 0644))
+		n, err := p.Poll(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+	}
+	processed, _ := ioutil.ReadDir(filepath.Join(dir, pollerProcessedDir))
+	assert.Len(t, processed, 2)
+}
+
+func TestDirPollerStateLikeNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Files whose names look like the poller's own state are still processed
+	// as input, even when they are interrupted.
+	names := []string{"a.hl7", "a.hl7" + checkpointExt, "a.hl7" + errorReportExt}
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, pollerProcessingDir), 0755))
+
+	for _, name := range names {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, pollerProcessingDir, name), pollerFile("1"), 0644))
+	}
+	p := &DirPoller{Dir: dir, Handler: ackHandler}
+	n, err := p.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, len(names), n)
+
+	for _, name := range names {
+		_, err = os.Stat(filepath.Join(dir, pollerProcessedDir, name))
+		assert.Nil(t, err, name)
+	}
+}
+
+func TestDirPollerCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.hl7.gz"), gzipData(pollerFile("1", "2", "3")), 0644))
+
+	var handled []string
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &DirPoller{Dir: dir, Handler: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		id := string(indexField(headerFields(msg.Bytes()), 10))
+		handled = append(handled, id)
+
+		if id == "2" && ctx.Err() == nil {
+			cancel()
+		}
+		return ackHandler(ctx, msg)
+	})}
+	_, err = p.Poll(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// Resuming skips over the decompressed data before the checkpoint.
+	n, err := p.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"1", "2", "2", "3"}, handled)
+
+	_, err = os.Stat(filepath.Join(dir, pollerProcessedDir, "a.hl7.gz"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,555 @@
+package hl7
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by Queue when the corresponding fields are not set.
+const (
+	DefaultMaxAttempts    = 10
+	DefaultMaxSegmentSize = 64 * 1024 * 1024
+)
+
+const (
+	queueSegmentExt = ".mllp"
+	queueCursorFile = "cursor"
+	queueDeadDir    = "dead"
+)
+
+// ErrQueueClosed is returned when using a Queue after it has been closed.
+var ErrQueueClosed = errors.New("hl7: queue closed")
+
+// Queue is a durable first-in, first-out queue of outbound messages, stored in
+// a directory. Messages are appended to segment files as MLLP frames, and each
+// one is synced to disk before Enqueue returns. Run delivers them in order,
+// and a message is only removed from the queue once it has been acknowledged
+// positively, so messages survive the process restarting or the receiver
+// being down. Segment files are deleted once every message in them has been
+// delivered.
+//
+// Messages that still fail after MaxAttempts attempts are moved to the "dead"
+// subdirectory, along with a file describing the last error, so they do not
+// hold up the rest of the queue.
+//
+// Only one Queue should use a directory at a time.
+type Queue struct {
+	// MaxAttempts is the number of attempts at delivering a message before
+	// giving up on it. Zero means DefaultMaxAttempts.
+	MaxAttempts int
+
+	// RetryBackoff is how long to wait after a failed attempt. It doubles after
+	// each attempt at the same message, up to MaxRetryBackoff. Zero means
+	// DefaultRetryBackoff and DefaultMaxRetryBackoff respectively.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// MaxSegmentSize is the size at which a new segment file is started. Zero
+	// means DefaultMaxSegmentSize.
+	MaxSegmentSize int64
+
+	// ErrorLog is used to log failed delivery attempts. If nil, the log
+	// package's standard logger is used.
+	ErrorLog *log.Logger
+
+	dir    string
+	notify chan struct{}
+
+	lock     sync.Mutex
+	closed   bool
+	file     *os.File // The segment file being appended to.
+	writeSeg int
+	writeOff int64
+	readSeg  int
+	readOff  int64
+	attempts int // Failed attempts at delivering the message at the head.
+	count    int // The number of messages in the queue.
+}
+
+// OpenQueue opens the queue stored in the directory, creating it if it does
+// not exist. If the process stopped part way through writing a message, the
+// incomplete message is discarded.
+func OpenQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, queueDeadDir), 0755); err != nil {
+		return nil, err
+	}
+	q := &Queue{dir: dir, notify: make(chan struct{}, 1)}
+	segments, err := q.segments()
+
+	if err != nil {
+		return nil, err
+	}
+	if err = q.readCursor(); err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = []int{1}
+	}
+	if q.readSeg < segments[0] {
+		q.readSeg, q.readOff = segments[0], 0
+	}
+	q.writeSeg = segments[len(segments)-1]
+
+	for _, seg := range segments {
+		if seg < q.readSeg {
+			continue
+		}
+		from := int64(0)
+
+		if seg == q.readSeg {
+			from = q.readOff
+		}
+		n, end, err := countFrames(q.segmentPath(seg), from)
+
+		if err != nil {
+			return nil, err
+		}
+		q.count += n
+
+		if seg == q.writeSeg {
+			q.writeOff = end
+		}
+	}
+	q.file, err = os.OpenFile(q.segmentPath(q.writeSeg), os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+	// Anything after the last complete frame is the remains of an interrupted
+	// write, which is cut off so new messages are appended after the last good
+	// one.
+	if err = q.file.Truncate(q.writeOff); err != nil {
+		q.file.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Enqueue adds the message to the end of the queue. Once it returns, the
+// message has been synced to disk.
+func (q *Queue) Enqueue(msg *Message) error {
+	data := msg.Bytes()
+	frame := make([]byte, 0, len(data)+3)
+	frame = append(frame, SB)
+	frame = append(frame, data...)
+	frame = append(frame, EB, CR)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.writeOff > 0 && q.writeOff+int64(len(frame)) > q.maxSegmentSize() {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := q.file.WriteAt(frame, q.writeOff); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.writeOff += int64(len(frame))
+	q.count++
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of messages waiting in the queue.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.count
+}
+
+// Run delivers the messages in the queue using the sender (typically a
+// *Client), in order, waiting for more to be enqueued once it is empty. It
+// returns when the context is done, or if the queue's files cannot be read or
+// updated. Only one call to Run should be active at a time.
+func (q *Queue) Run(ctx context.Context, sender AckSender) error {
+	backoff := q.RetryBackoff
+
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	delay := backoff
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, ok, err := q.peek()
+
+		if err != nil {
+			return err
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-q.notify:
+			}
+			continue
+		}
+		msg, err := NewMessage(data)
+
+		if err == nil {
+			_, err = sender.Send(ctx, msg)
+		}
+		if err == nil {
+			// The message was acknowledged, so it is removed even if the
+			// context has been cancelled in the meantime.
+			if err = q.pop(data); err != nil {
+				return err
+			}
+			delay = backoff
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logPrintf(q.ErrorLog, "hl7: failed to deliver queued message: %v", err)
+		dead, qerr := q.fail(data, err)
+
+		if qerr != nil {
+			return qerr
+		}
+		if dead {
+			delay = backoff
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > q.maxRetryBackoff() {
+			delay = q.maxRetryBackoff()
+		}
+	}
+}
+
+// Close closes the queue's files. Messages that have not been delivered are
+// kept for the next time the queue is opened.
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	return q.file.Close()
+}
+
+// peek returns the message at the head of the queue, if there is one.
+func (q *Queue) peek() ([]byte, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return nil, false, ErrQueueClosed
+	}
+	for {
+		if q.readSeg == q.writeSeg && q.readOff >= q.writeOff {
+			return nil, false, nil
+		}
+		data, err := readFrameAt(q.segmentPath(q.readSeg), q.readOff)
+
+		if err == io.EOF && q.readSeg < q.writeSeg {
+			// Everything in this segment has been delivered, so move on to the
+			// next one.
+			if err = q.advanceSegment(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return data, true, nil
+	}
+}
+
+// pop removes the message at the head of the queue, given its contents as
+// returned by peek.
+func (q *Queue) pop(data []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.readOff += int64(len(data) + 3)
+	q.attempts = 0
+	q.count--
+
+	return q.writeCursor()
+}
+
+// fail records a failed attempt at delivering the message at the head of the
+// queue. Once it has failed too many times, it is moved to the dead letter
+// directory and removed from the queue, and true is returned.
+func (q *Queue) fail(data []byte, cause error) (bool, error) {
+	q.lock.Lock()
+	q.attempts++
+	attempts := q.attempts
+	name := fmt.Sprintf("%08d-%012d", q.readSeg, q.readOff)
+	err := q.writeCursor()
+	q.lock.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+	if attempts < q.maxAttempts() {
+		return false, nil
+	}
+	dir := filepath.Join(q.dir, queueDeadDir)
+	report := fmt.Sprintf("%d attempts, last error: %v\n", attempts, cause)
+
+	if err = writeFileSync(filepath.Join(dir, name+".err"), []byte(report)); err != nil {
+		return false, err
+	}
+	if err = writeFileSync(filepath.Join(dir, name+".hl7"), data); err != nil {
+		return false, err
+	}
+	if err = syncDir(dir); err != nil {
+		return false, err
+	}
+	return true, q.pop(data)
+}
+
+// rotate starts a new segment file. The lock must be held.
+func (q *Queue) rotate() error {
+	file, err := os.OpenFile(q.segmentPath(q.writeSeg+1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+	if err = syncDir(q.dir); err != nil {
+		file.Close()
+		return err
+	}
+	if err = q.file.Close(); err != nil {
+		file.Close()
+		return err
+	}
+	q.file = file
+	q.writeSeg++
+	q.writeOff = 0
+
+	return nil
+}
+
+// advanceSegment moves the head of the queue to the next segment file, and
+// deletes the one that has been delivered. The lock must be held.
+func (q *Queue) advanceSegment() error {
+	done := q.readSeg
+	q.readSeg, q.readOff = q.readSeg+1, 0
+
+	if err := q.writeCursor(); err != nil {
+		return err
+	}
+	return os.Remove(q.segmentPath(done))
+}
+
+// writeCursor saves the position of the head of the queue. The lock must be
+// held.
+func (q *Queue) writeCursor() error {
+	data := fmt.Sprintf("%d %d %d\n", q.readSeg, q.readOff, q.attempts)
+	path := filepath.Join(q.dir, queueCursorFile)
+	tmp := path + ".tmp"
+
+	if err := writeFileSync(tmp, []byte(data)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+func (q *Queue) readCursor() error {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, queueCursorFile))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Sscan(string(data), &q.readSeg, &q.readOff, &q.attempts); err != nil {
+		return fmt.Errorf("hl7: invalid queue cursor: %w", err)
+	}
+	return nil
+}
+
+// segments returns the numbers of the segment files in the directory, in
+// order.
+func (q *Queue) segments() ([]int, error) {
+	infos, err := ioutil.ReadDir(q.dir)
+
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+
+	for _, info := range infos {
+		var seg int
+
+		if !strings.HasSuffix(info.Name(), queueSegmentExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(info.Name(), "%d"+queueSegmentExt, &seg); err == nil {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (q *Queue) segmentPath(seg int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%08d%s", seg, queueSegmentExt))
+}
+
+func (q *Queue) maxAttempts() int {
+	if q.MaxAttempts > 0 {
+		return q.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+func (q *Queue) maxRetryBackoff() time.Duration {
+	if q.MaxRetryBackoff > 0 {
+		return q.MaxRetryBackoff
+	}
+	return DefaultMaxRetryBackoff
+}
+
+func (q *Queue) maxSegmentSize() int64 {
+	if q.MaxSegmentSize > 0 {
+		return q.MaxSegmentSize
+	}
+	return DefaultMaxSegmentSize
+}
+
+// readFrameAt reads the MLLP frame at the offset in the file. io.EOF is
+// returned if there is nothing at the offset.
+func readFrameAt(path string, offset int64) ([]byte, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(file, offset, 1<<62))
+	data, _, err := readFrame(r)
+
+	return data, err
+}
+
+// countFrames counts the complete MLLP frames in the file, starting at the
+// offset, and returns the offset just after the last one. A missing file is
+// treated as empty.
+func countFrames(path string, offset int64) (int, int64, error) {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return 0, offset, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var (
+		r     = bufio.NewReader(io.NewSectionReader(file, offset, 1<<62))
+		count int
+	)
+	for {
+		_, n, err := readFrame(r)
+
+		if err != nil {
+			// Any error here is the end of the data that was written
+			// completely.
+			return count, offset, nil
+		}
+		count++
+		offset += int64(n)
+	}
+}
+
+// readFrame reads a single frame written by Enqueue, returning its contents
+// and its total length. io.EOF is returned if there is no more data, and
+// ErrTruncatedFrame if the frame is incomplete or malformed.
+func readFrame(r *bufio.Reader) ([]byte, int, error) {
+	b, err := r.ReadByte()
+
+	if err != nil {
+		return nil, 0, err
+	}
+	if b != SB {
+		return nil, 0, ErrTruncatedFrame
+	}
+	data, err := r.ReadBytes(EB)
+
+	if err != nil {
+		return nil, 0, ErrTruncatedFrame
+	}
+	if b, err = r.ReadByte(); err != nil || b != CR {
+		return nil, 0, ErrTruncatedFrame
+	}
+	return data[:len(data)-1], len(data) + 2, nil
+}
+
+// writeFileSync writes the file and syncs it to disk.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir syncs a directory, so that files that were just created or renamed
+// in it survive a crash. Windows does not support this, so it is skipped
+// there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,182 @@
+package hl7
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSender records the control IDs of the messages it is asked to send, and
+// fails for any listed in fail. Once done reports true, the context passed to
+// Run is cancelled.
+type testSender struct {
+	lock sync.Mutex
+	sent []string
+	fail map[string]bool
+	done func(sent []string) bool
+	stop context.CancelFunc
+}
+
+func (s *testSender) Send(ctx context.Context, msg *Message) (*AckResult, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := string(indexField(headerFields(msg.Bytes()), 10))
+	s.sent = append(s.sent, id)
+
+	if s.done != nil && s.done(s.sent) {
+		s.stop()
+	}
+	if s.fail[id] {
+		return nil, errors.New("failed")
+	}
+	return &AckResult{Code: AckAccept, ControlID: id}, nil
+}
+
+// runQueue runs the queue until done reports true, and returns the control IDs
+// of the messages that were sent.
+func runQueue(t *testing.T, q *Queue, fail map[string]bool, done func(sent []string) bool) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := &testSender{fail: fail, done: done, stop: cancel}
+	err := q.Run(ctx, s)
+	assert.Equal(t, context.Canceled, err)
+
+	return s.sent
+}
+
+func sentAll(n int) func([]string) bool {
+	return func(sent []string) bool { return len(sent) >= n }
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueue(dir)
+	assert.Nil(t, err)
+	defer q.Close()
+
+	// Each message gets a segment file to itself.
+	q.MaxSegmentSize = 10
+
+	for _, id := range []string{"1", "2", "3"} {
+		assert.Nil(t, q.Enqueue(testMessage(msh{controlID: id})))
+	}
+	assert.Equal(t, 3, q.Len())
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.mllp"))
+	assert.Len(t, segments, 3)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Enqueue(testMessage(msh{controlID: "4"}))
+	}()
+	assert.Equal(t, []string{"1", "2", "3", "4"}, runQueue(t, q, nil, sentAll(4)))
+	assert.Equal(t, 0, q.Len())
+
+	// Delivered segment files are deleted, except for the one still being
+	// written.
+	segments, _ = filepath.Glob(filepath.Join(dir, "*.mllp"))
+	assert.Len(t, segments, 1)
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueue(dir)
+	assert.Nil(t, err)
+
+	for _, id := range []string{"1", "2", "3"} {
+		assert.Nil(t, q.Enqueue(testMessage(msh{controlID: id})))
+	}
+	assert.Equal(t, []string{"1", "2"}, runQueue(t, q, nil, sentAll(2)))
+	assert.Nil(t, q.Close())
+	assert.Equal(t, ErrQueueClosed, q.Enqueue(testMessage(msh{controlID: "4"})))
+
+	// Simulate a crash part way through writing a message.
+	f, err := os.OpenFile(filepath.Join(dir, "00000001.mllp"), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	f.Write([]byte("\x0bMSH|^~\\&|||||||ADT^A01|5|P"))
+	f.Close()
+
+	q, err = OpenQueue(dir)
+	assert.Nil(t, err)
+	defer q.Close()
+
+	assert.Equal(t, 1, q.Len())
+	assert.Nil(t, q.Enqueue(testMessage(msh{controlID: "6"})))
+	assert.Equal(t, []string{"3", "6"}, runQueue(t, q, nil, sentAll(2)))
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueue(dir)
+	assert.Nil(t, err)
+	defer q.Close()
+
+	q.MaxAttempts = 3
+	q.RetryBackoff = time.Millisecond
+
+	for _, id := range []string{"1", "bad", "2"} {
+		assert.Nil(t, q.Enqueue(testMessage(msh{controlID: id})))
+	}
+	sent := runQueue(t, q, map[string]bool{"bad": true}, sentAll(5))
+	assert.Equal(t, []string{"1", "bad", "bad", "bad", "2"}, sent)
+
+	files, err := filepath.Glob(filepath.Join(dir, "dead", "*"))
+	assert.Nil(t, err)
+
+	if assert.Len(t, files, 2) {
+		data, _ := ioutil.ReadFile(files[0])
+		assert.Contains(t, string(data), "3 attempts, last error: failed")
+
+		data, _ = ioutil.ReadFile(files[1])
+		assert.Equal(t, testMessage(msh{controlID: "bad"}).Bytes(), data)
+	}
+}
+
+func TestQueueAttemptsSurviveRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueue(dir)
+	assert.Nil(t, err)
+
+	q.MaxAttempts = 3
+	q.RetryBackoff = time.Millisecond
+	assert.Nil(t, q.Enqueue(testMessage(msh{controlID: "bad"})))
+	assert.Nil(t, q.Enqueue(testMessage(msh{controlID: "1"})))
+
+	// The attempt that is cancelled is not counted, so two are recorded.
+	assert.Equal(t, []string{"bad", "bad", "bad"}, runQueue(t, q, map[string]bool{"bad": true}, sentAll(3)))
+	q.Close()
+
+	q, err = OpenQueue(dir)
+	assert.Nil(t, err)
+	defer q.Close()
+
+	q.MaxAttempts = 3
+	q.RetryBackoff = time.Millisecond
+
+	assert.Equal(t, []string{"bad", "1"}, runQueue(t, q, map[string]bool{"bad": true}, sentAll(2)))
+	assert.Equal(t, 0, q.Len())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "dead", "*"))
+	assert.Len(t, files, 2)
+}
@@ -1,23 +1,65 @@
 package hl7
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"os"
 	"sync"
-	"unicode"
+	"sync/atomic"
+	"time"
 )
 
-// Reader is the type used to read messages from an internal bufio.Reader.
+// Reader is the type used to read messages from an io.Reader. The input is
+// read in large chunks and split into messages in memory, and the buffers used
+// for this are shared between readers through a pool.
 type Reader struct {
-	reader *bufio.Reader
-	lock   sync.Mutex
+	scanner *scanner
+	lock    sync.Mutex
+
+	// pending is set when a read was started in the background on behalf of
+	// ReadMessageContext, and the context was cancelled before it finished.
+	// The result is picked up by the next read, so nothing is lost.
+	pending chan readResult
+
+	// deadline is the read deadline set with SetReadDeadline, which is
+	// restored after a read is interrupted.
+	deadline atomic.Value
+}
+
+// readResult is the result of a read that happened in the background.
+type readResult struct {
+	data   []byte
+	offset int64
+	err    error
+}
+
+// readDeadliner is implemented by readers that support read deadlines, such as
+// net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
 }
 
 // NewReader is used to return a new Reader that is ready to use.
 func NewReader(reader io.Reader) *Reader {
-	r := bufio.NewReader(reader)
-	return &Reader{reader: r}
+	return &Reader{scanner: newScanner(reader, new(messageSplitter).split)}
+}
+
+// NewReaderFromOffset is used to return a new Reader that resumes reading from
+// the given offset, which is typically the EndOffset of the last message that
+// was successfully processed. This allows a job that crashed partway through
+// a large file to pick up where it left off without reprocessing anything.
+//
+// The offsets of the messages returned by the Reader are relative to the
+// beginning of the input, not the checkpoint.
+func NewReaderFromOffset(reader io.ReadSeeker, offset int64) (*Reader, error) {
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := NewReader(reader)
+	r.scanner.offset = offset
+
+	return r, nil
 }
 
 type MessageFunc func(msg *Message) error
@@ -26,7 +68,8 @@ type MessageFunc func(msg *Message) error
 // if all you're doing is (for example) importing the messages' data into a
 // database or something. Each message is passed into the MessageFunc provided
 // and executed in order. The downside of this implementation is that it will
-// not happen concurrently, which could have some performance ramifications.
+// not happen concurrently, which could have some performance ramifications
+// (see EachMessageConcurrent if that is a problem).
 //
 // Errors returned from this will not include io.EOF, so when you're done
 // processing the work, only "real" errors are returned here, such as errors
@@ -47,59 +90,170 @@ func (r *Reader) EachMessage(fn MessageFunc) error {
 	}
 }
 
-func (r *Reader) readMessage() (*Message, error) {
-	var buf []byte
-
+// EachMessageContext is the same as EachMessage, except that it stops and
+// returns ctx.Err() when the context is cancelled, even if it is blocked
+// waiting on the input. See ReadMessageContext for how this works.
+func (r *Reader) EachMessageContext(ctx context.Context, fn MessageFunc) error {
 	for {
-		b, err := r.reader.ReadByte()
+		msg, err := r.ReadMessageContext(ctx)
 
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
-		// Skip all characters that don't look like they're the beginning of a
-		// message until we start storing bytes in the byte slice. This helps us
-		// cope with files that have leading whitespace for whatever reason.
-		if len(buf) == 0 && b != 'M' {
-			continue
+		if err = fn(msg); err != nil {
+			return err
 		}
-		// Multiple messages within a file can be delimited a variety of ways. This
-		// attempts to find all of the different ways I have encountered personally
-		// so far.
-		if unicode.IsSpace(rune(b)) {
-			// "Peek" ahead to the next four bytes. The difference between this and
-			// reading is that the four bytes will still be in the buffer after we
-			// peek, whereas reading consumes them. This allows us to look ahead at
-			// what is coming up, which we will use to see if a message is coming up.
-			p, err := r.reader.Peek(4)
+	}
+}
 
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return nil, err
-			}
-			if bytes.Equal(p, []byte("MSH|")) || bytes.Equal(p, []byte("\nMSH")) {
-				break
-			}
+func (r *Reader) readMessage(ctx context.Context) (*Message, error) {
+	data, offset, err := r.readRawContext(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+	return newMessageAt(data, offset)
+}
+
+// readRawContext is the same as readRaw, except that it gives up when the
+// context is cancelled. The lock must be held while calling this.
+func (r *Reader) readRawContext(ctx context.Context) ([]byte, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	if r.pending == nil {
+		if ctx.Done() == nil {
+			return r.readRaw()
 		}
-		buf = append(buf, b)
+		pending := make(chan readResult, 1)
+		r.pending = pending
+
+		go func() {
+			data, offset, err := r.readRaw()
+			pending <- readResult{data: data, offset: offset, err: err}
+		}()
+	}
+	select {
+	case res := <-r.pending:
+		r.pending = nil
+		return res.data, res.offset, res.err
+	case <-ctx.Done():
+	}
+	// If the reader supports deadlines, the blocked read can be interrupted by
+	// moving the deadline into the past, so it isn't left running. Some
+	// readers (like *os.File) implement the method but don't support it for
+	// all inputs, in which case the read carries on in the background.
+	d, ok := r.scanner.reader.(readDeadliner)
+
+	if !ok || d.SetReadDeadline(time.Unix(1, 0)) != nil {
+		return nil, 0, ctx.Err()
+	}
+	res := <-r.pending
+	r.pending = nil
+	deadline, _ := r.deadline.Load().(time.Time)
+	d.SetReadDeadline(deadline)
+
+	// The read may have finished before the deadline took effect, in which
+	// case there is no reason to throw the message away.
+	if res.err == nil {
+		return res.data, res.offset, nil
+	}
+	return nil, res.offset, ctx.Err()
+}
+
+// SetReadDeadline sets the read deadline of the underlying reader, which must
+// support deadlines (as a net.Conn does). Otherwise, os.ErrNoDeadline is
+// returned. A deadline set this way, rather than on the underlying reader
+// itself, is restored after ReadMessageContext interrupts a read when its
+// context is cancelled.
+func (r *Reader) SetReadDeadline(t time.Time) error {
+	d, ok := r.scanner.reader.(readDeadliner)
+
+	if !ok {
+		return os.ErrNoDeadline
 	}
+	r.deadline.Store(t)
+	return d.SetReadDeadline(t)
+}
 
-	if len(buf) == 0 {
-		return nil, io.EOF
+// readRaw returns a copy of the bytes of the next message, along with the
+// offset at which it begins.
+func (r *Reader) readRaw() ([]byte, int64, error) {
+	token, offset, err := r.scanner.scan()
+
+	if err != nil {
+		return nil, offset, err
 	}
+	// The token points into the scanner's buffer, which is reused for the
+	// following messages, so the message needs its own copy.
+	data := make([]byte, len(token))
+	copy(data, token)
 
-	return NewMessage(buf)
+	return data, offset, nil
 }
 
 // ReadMessage is used to read the next message in the internal reader.
 //
 // If the reader is empty (or at io.EOF), io.EOF is returned with an empty
-// message. Otherwise, error will always be nil.
+// message. A fragment of input too short to contain a message header results
+// in ErrInvalidHeader, and the next call carries on after it.
 func (r *Reader) ReadMessage() (*Message, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	return r.readMessage()
+	return r.readMessage(context.Background())
+}
+
+// ReadMessageContext is the same as ReadMessage, except that it returns
+// ctx.Err() as soon as the context is cancelled, even if it is blocked waiting
+// on the input.
+//
+// If the underlying reader supports read deadlines (such as a net.Conn), a
+// cancellation interrupts the blocked read by moving the deadline into the
+// past. The deadline is then set back to the one given to SetReadDeadline (or
+// cleared, if there is none), so a deadline that should survive cancellations
+// must be set with that method rather than on the reader itself. Otherwise the
+// read is left running in the background, and its result is returned by the
+// next call to one of the read methods. In both cases, the Reader can continue
+// to be used after a cancellation without losing any data. Deadlines are not
+// touched unless the context is cancelled while a read is blocked.
+func (r *Reader) ReadMessageContext(ctx context.Context) (*Message, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.readMessage(ctx)
+}
+
+// MessageError describes an error encountered while parsing or handling a
+// single message from a Reader.
+type MessageError struct {
+	Index  int   // The zero-based position of the message within the input.
+	Offset int64 // The byte offset at which the message begins.
+	Err    error // The error that was encountered.
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("message %d (offset %d): %v", e.Index, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// MessageErrors is a list of errors encountered for individual messages.
+type MessageErrors []*MessageError
+
+func (e MessageErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e[0].Error()
+	default:
+		return fmt.Sprintf("%v (and %d more errors)", e[0], len(e)-1)
+	}
 }
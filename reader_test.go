@@ -2,9 +2,15 @@ package hl7
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -48,6 +54,22 @@ func TestReaderReadMessage(t *testing.T) {
 		_, err := reader.ReadMessage()
 		assert.Error(t, err)
 	})
+
+	t.Run("short fragment is not the end of the input", func(t *testing.T) {
+		reader := NewReader(bytes.NewBufferString("MSH|....\rMSH|^\rMSH|....."))
+
+		_, err := reader.ReadMessage()
+		assert.Nil(t, err)
+		_, err = reader.ReadMessage()
+		assert.Equal(t, ErrInvalidHeader, err)
+
+		msg, err := reader.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "MSH|.....", string(msg.Bytes()))
+
+		_, err = reader.ReadMessage()
+		assert.Equal(t, io.EOF, err)
+	})
 }
 
 func TestReaderEachMessage(t *testing.T) {
@@ -106,3 +128,226 @@ func TestReaderEachMessage(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestReaderReadMessageContext(t *testing.T) {
+	t.Run("already cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		reader := NewReader(bytes.NewBufferString("MSH|...."))
+		_, err := reader.ReadMessageContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+
+		msg, err := reader.ReadMessage()
+		assert.Nil(t, err)
+		assert.NotNil(t, msg)
+	})
+
+	tests := []struct {
+		name string
+		pipe func() (io.ReadCloser, io.WriteCloser)
+	}{
+		{"reader with deadlines", func() (io.ReadCloser, io.WriteCloser) { return net.Pipe() }},
+		{"reader without deadlines", func() (io.ReadCloser, io.WriteCloser) { return io.Pipe() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w := tt.pipe()
+			defer r.Close()
+			defer w.Close()
+
+			reader := NewReader(r)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			_, err := reader.ReadMessageContext(ctx)
+			assert.Equal(t, context.DeadlineExceeded, err)
+
+			// Nothing should be lost after the cancellation.
+			go func() {
+				w.Write([]byte("MSH|^~\\&|1\rMSH|^~\\&|2\r"))
+				w.Close()
+			}()
+
+			for _, want := range []string{"1", "2"} {
+				msg, err := reader.ReadMessageContext(context.Background())
+				assert.Nil(t, err)
+
+				seg, _ := msg.ReadSegment()
+				got, _ := seg.GetSubComponent(2, 0, 0, 0)
+				assert.Equal(t, want, string(got))
+			}
+			_, err = reader.ReadMessage()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestReaderReadDeadline(t *testing.T) {
+	t.Run("deadline is kept when not cancelled", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer r.Close()
+		defer w.Close()
+
+		r.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, err := NewReader(r).ReadMessageContext(ctx)
+
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	})
+
+	t.Run("deadline is restored after cancellation", func(t *testing.T) {
+		r, w := net.Pipe()
+		defer r.Close()
+		defer w.Close()
+
+		reader := NewReader(r)
+		assert.Nil(t, reader.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := reader.ReadMessageContext(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		_, err = reader.ReadMessage()
+
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	})
+
+	t.Run("reader without deadlines", func(t *testing.T) {
+		reader := NewReader(strings.NewReader(""))
+		assert.Equal(t, os.ErrNoDeadline, reader.SetReadDeadline(time.Now()))
+	})
+}
+
+func TestReaderEachMessageContext(t *testing.T) {
+	t.Run("reads every message", func(t *testing.T) {
+		reader := NewReader(bytes.NewBufferString("MSH|....\rMSH|....."))
+		i := 0
+
+		err := reader.EachMessageContext(context.Background(), func(msg *Message) error {
+			i++
+			return nil
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, i)
+	})
+
+	t.Run("stops when cancelled", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		// A message is only complete once the next one starts, so the second
+		// message here is never delivered.
+		go server.Write([]byte("MSH|....\rMSH|....."))
+
+		reader := NewReader(client)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		i := 0
+
+		err := reader.EachMessageContext(ctx, func(msg *Message) error {
+			i++
+			return nil
+		})
+
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, 1, i)
+	})
+}
+
+func TestReaderMessageOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		offsets [][2]int64
+	}{
+		{"one message", "MSH|....", [][2]int64{{0, 8}}},
+		{"leading junk", "\r\n\x00MSH|....", [][2]int64{{3, 11}}},
+		{"two messages (CRLF)", "MSH|....\r\nMSH|.....\r\n", [][2]int64{{0, 8}, {10, 19}}},
+		{"two messages (FF)", "MSH|....\fMSH|.....\f", [][2]int64{{0, 8}, {9, 18}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewReader(bytes.NewBufferString(tt.data))
+
+			for _, want := range tt.offsets {
+				msg, err := reader.ReadMessage()
+				assert.Nil(t, err)
+				assert.Equal(t, want[0], msg.Offset())
+				assert.Equal(t, want[1], msg.EndOffset())
+			}
+		})
+	}
+}
+
+func TestNewReaderFromOffset(t *testing.T) {
+	data := "MSH|^~\\&|1\r\nMSH|^~\\&|2\r\nMSH|^~\\&|3\r\n"
+
+	// Process the first message and "commit" it.
+	reader := NewReader(strings.NewReader(data))
+	msg, err := reader.ReadMessage()
+	assert.Nil(t, err)
+	checkpoint := msg.EndOffset()
+
+	reader, err = NewReaderFromOffset(strings.NewReader(data), checkpoint)
+	assert.Nil(t, err)
+
+	var ids []string
+
+	err = reader.EachMessage(func(msg *Message) error {
+		seg, _ := msg.ReadSegment()
+		id, _ := seg.GetSubComponent(2, 0, 0, 0)
+		ids = append(ids, string(id))
+		assert.Equal(t, data[msg.Offset():msg.EndOffset()], "MSH|^~\\&|"+string(id))
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "3"}, ids)
+
+	t.Run("seek error is propagated", func(t *testing.T) {
+		_, err := NewReaderFromOffset(strings.NewReader(data), -1)
+		assert.Error(t, err)
+	})
+}
+
+// benchmarkData returns roughly size bytes worth of copies of the example
+// message, delimited the same way as the example file.
+func benchmarkData(size int) []byte {
+	msg := "MSH|^~\\&|MegaReg|XYZHospC|SuperOE|XYZImgCtr|20060529090131-0500||ADT^A01^ADT_A01|01052901|P|2.5\r" +
+		"EVN||200605290901||||200605290900\r" +
+		"PID|||56782445^^^UAReg^PI||KLEINSAMPLE^BARRY^Q^JR||19620910|M||2028-9^^HL70005^RA99113^^XYZ|260 GOODWIN CREST DRIVE^^BIRMINGHAM^AL^35209^^M|||||||0105I30001^^^99DEF^AN\r" +
+		"PV1||I|W^389^1^UABH^^^^3||||12345^MORGAN^REX^J^^^MD^0010^UAMC^L||67890^GRAINGER^LUCY^X^^^MD^0010^UAMC^L|MED|||||A0||13579^POTTER^SHERMAN^T^^^MD^0010^UAMC^L|||||||||||||||||||||||||||200605290900\r" +
+		"OBX|1|NM|^Body Height||1.80|m^Meter^ISO+|||||F\r" +
+		"OBX|2|NM|^Body Weight||79|kg^Kilogram^ISO+|||||F\r\n"
+
+	return bytes.Repeat([]byte(msg), size/len(msg)+1)
+}
+
+// BenchmarkReaderEachMessage reports the throughput of the reader in MB/s. The
+// input is held in memory so the numbers are not skewed by disk performance.
+func BenchmarkReaderEachMessage(b *testing.B) {
+	data := benchmarkData(32 * 1024 * 1024)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader := NewReader(bytes.NewReader(data))
+
+		if err := reader.EachMessage(func(msg *Message) error {
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package hl7
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Error codes from HL7 table 0357 used by Router when rejecting messages.
+const (
+	errCodeUnsupportedType  = "200"
+	errCodeUnsupportedEvent = "201"
+)
+
+// Router is a Handler that dispatches messages to other handlers based on
+// their message type and trigger event (MSH-9) and, optionally, their sending
+// facility (MSH-4). This is modeled on http.ServeMux, and the zero value is
+// ready to use.
+//
+// Patterns take the form "[facility/]type[^trigger]". The type, trigger and
+// facility are each matched using path.Match, so "ADT^A0*" matches ADT^A01
+// through ADT^A09 from any facility, "LAB/ORU^R01" only matches ORU^R01 from
+// the LAB facility, and "ADT" (with no trigger) matches every ADT event. The
+// facility is compared to the first component of MSH-4.
+//
+// If more than one pattern matches, the most specific one wins: patterns with
+// a facility win over those without, then patterns without wildcards win over
+// those with them, then longer patterns win over shorter ones.
+type Router struct {
+	// Default handles messages that do not match any pattern. If nil, they
+	// are rejected with AR, with an ERR segment giving code 200 (unsupported
+	// message type) or 201 (unsupported event code). Acknowledgments are
+	// never rejected, since they cannot be acknowledged in turn.
+	Default Handler
+
+	lock   sync.RWMutex
+	routes []*route
+}
+
+type route struct {
+	pattern  string
+	facility string // Empty if any facility matches.
+	msgType  string
+	trigger  string // Empty if any trigger event matches.
+	handler  Handler
+}
+
+// Handle registers the handler for the given pattern. It panics if the
+// pattern is invalid, or if a handler is already registered for it.
+func (r *Router) Handle(pattern string, handler Handler) {
+	if handler == nil {
+		panic("hl7: nil handler")
+	}
+	rt := &route{pattern: pattern, handler: handler}
+	p := pattern
+
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		rt.facility, p = p[:i], p[i+1:]
+	}
+	if i := strings.IndexByte(p, '^'); i >= 0 {
+		rt.msgType, rt.trigger = p[:i], p[i+1:]
+	} else {
+		rt.msgType = p
+	}
+	for _, part := range []string{rt.facility, rt.msgType, rt.trigger} {
+		if _, err := path.Match(part, ""); err != nil {
+			panic("hl7: invalid pattern " + pattern)
+		}
+	}
+	if rt.msgType == "" {
+		panic("hl7: invalid pattern " + pattern)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, existing := range r.routes {
+		if existing.pattern == pattern {
+			panic("hl7: multiple registrations for " + pattern)
+		}
+	}
+	r.routes = append(r.routes, rt)
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (r *Router) HandleFunc(pattern string, handler func(ctx context.Context, msg *Message) (*Message, error)) {
+	r.Handle(pattern, HandlerFunc(handler))
+}
+
+// Handler returns the handler to use for the message, along with the pattern
+// it was registered with. If no pattern matches, the default handler is
+// returned with an empty pattern.
+func (r *Router) Handler(msg *Message) (h Handler, pattern string) {
+	facility, msgType, trigger := routingFields(msg)
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var best *route
+
+	for _, rt := range r.routes {
+		if rt.matches(facility, msgType, trigger) && (best == nil || rt.moreSpecific(best)) {
+			best = rt
+		}
+	}
+	if best != nil {
+		return best.handler, best.pattern
+	}
+	if r.Default != nil {
+		return r.Default, ""
+	}
+	return HandlerFunc(r.reject), ""
+}
+
+// ServeHL7 dispatches the message to the handler whose pattern matches it most
+// closely.
+func (r *Router) ServeHL7(ctx context.Context, msg *Message) (*Message, error) {
+	h, _ := r.Handler(msg)
+	return h.ServeHL7(ctx, msg)
+}
+
+// reject is the default handler, used when no pattern matches the message.
+func (r *Router) reject(ctx context.Context, msg *Message) (*Message, error) {
+	facility, msgType, trigger := routingFields(msg)
+
+	if msgType == "ACK" {
+		return nil, nil
+	}
+	issue := AckIssue{
+		Location: "MSH^1^9",
+		Code:     errCodeUnsupportedType,
+		Text:     "Unsupported message type",
+		Message:  "Unsupported message type " + msgType,
+	}
+	r.lock.RLock()
+	for _, rt := range r.routes {
+		// If a pattern matches the message type, it is only the trigger event
+		// that is unsupported.
+		if matchPart(rt.facility, facility) && matchPart(rt.msgType, msgType) {
+			issue = AckIssue{
+				Location: "MSH^1^9^1^2",
+				Code:     errCodeUnsupportedEvent,
+				Text:     "Unsupported event code",
+				Message:  "Unsupported event code " + trigger + " for message type " + msgType,
+			}
+			break
+		}
+	}
+	r.lock.RUnlock()
+
+	return msg.Ack(AckReject, &AckOptions{Errors: []AckIssue{issue}})
+}
+
+// routingFields returns the parts of the header a Router matches on: the
+// sending facility (MSH-4.1), message type (MSH-9.1) and trigger event
+// (MSH-9.2).
+func routingFields(msg *Message) (facility, msgType, trigger string) {
+	h := headerFields(msg.data)
+	msh9 := indexField(h, 9)
+
+	return firstComponent(indexField(h, 4), msg.compSep), component(msh9, msg.compSep, 0), component(msh9, msg.compSep, 1)
+}
+
+func (rt *route) matches(facility, msgType, trigger string) bool {
+	return matchPart(rt.facility, facility) && matchPart(rt.msgType, msgType) && matchPart(rt.trigger, trigger)
+}
+
+// moreSpecific reports whether the route should be preferred over the other,
+// when both match.
+func (rt *route) moreSpecific(other *route) bool {
+	if (rt.facility != "") != (other.facility != "") {
+		return rt.facility != ""
+	}
+	if rt.literal() != other.literal() {
+		return rt.literal()
+	}
+	return len(rt.pattern) > len(other.pattern)
+}
+
+// literal reports whether the pattern names exactly one message type and
+// trigger event.
+func (rt *route) literal() bool {
+	return rt.trigger != "" && !strings.ContainsAny(rt.pattern, `*?[\`)
+}
+
+// matchPart matches one part of a pattern, where an empty pattern matches
+// anything.
+func matchPart(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
@@ -0,0 +1,98 @@
+package hl7
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	var r Router
+
+	for _, pattern := range []string{"ADT^A0*", "ADT^A08", "ORU^R01", "LAB/ORU^R01", "LAB*/ORU", "SIU"} {
+		pattern := pattern
+
+		r.HandleFunc(pattern, func(ctx context.Context, msg *Message) (*Message, error) {
+			return msg.Ack(AckAccept, &AckOptions{Text: pattern})
+		})
+	}
+
+	tests := []struct {
+		name     string
+		facility string
+		msgType  string
+		pattern  string
+		code     string
+		errCode  string
+	}{
+		{"wildcard", "", "ADT^A01^ADT_A01", "ADT^A0*", AckAccept, ""},
+		{"exact wins over wildcard", "", "ADT^A08^ADT_A01", "ADT^A08", AckAccept, ""},
+		{"exact", "HOSP", "ORU^R01", "ORU^R01", AckAccept, ""},
+		{"facility", "LAB^1.2.3^ISO", "ORU^R01", "LAB/ORU^R01", AckAccept, ""},
+		{"facility wildcard", "LAB2", "ORU^R01", "LAB*/ORU", AckAccept, ""},
+		{"any trigger", "", "SIU^S12", "SIU", AckAccept, ""},
+		{"unsupported event", "", "ADT^A40", "", AckReject, "201"},
+		{"unsupported type", "", "MDM^T02", "", AckReject, "200"},
+		{"acknowledgment", "", "ACK^A01", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testMessage(msh{facility: tt.facility, msgType: tt.msgType, controlID: "1"})
+			_, pattern := r.Handler(msg)
+			assert.Equal(t, tt.pattern, pattern)
+
+			resp, err := r.ServeHL7(context.Background(), msg)
+			assert.Nil(t, err)
+
+			if tt.code == "" {
+				assert.Nil(t, resp)
+				return
+			}
+			ack, err := ParseAck(resp)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, ack.Code)
+
+			if tt.pattern != "" {
+				assert.Equal(t, tt.pattern, ack.Text)
+			}
+			if tt.errCode != "" && assert.Len(t, ack.Errors, 1) {
+				assert.Equal(t, tt.errCode, ack.Errors[0].Code)
+			}
+		})
+	}
+}
+
+func TestRouterDefault(t *testing.T) {
+	r := Router{Default: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		return msg.Ack(AckError, nil)
+	})}
+	resp, err := r.ServeHL7(context.Background(), testMessage(msh{msgType: "ADT^A01", controlID: "1"}))
+	assert.Nil(t, err)
+
+	ack, err := ParseAck(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, AckError, ack.Code)
+}
+
+func TestRouterHandlePanics(t *testing.T) {
+	var r Router
+
+	r.Handle("ADT^A01", echoHandler)
+
+	tests := []struct {
+		name    string
+		pattern string
+		handler Handler
+	}{
+		{"duplicate", "ADT^A01", echoHandler},
+		{"nil handler", "ADT^A02", nil},
+		{"bad pattern", "ADT^[A", echoHandler},
+		{"no type", "LAB/", echoHandler},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Panics(t, func() { r.Handle(tt.pattern, tt.handler) })
+		})
+	}
+}
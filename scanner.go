@@ -0,0 +1,243 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"unicode"
+)
+
+const (
+	// defaultBufferSize is the size of the buffers handed out by bufferPool.
+	// Most messages comfortably fit within this, so the buffer rarely needs to
+	// grow.
+	defaultBufferSize = 64 * 1024
+
+	// maxMessageSize is the largest single message that will be buffered before
+	// giving up. This is mainly a safeguard against unbounded memory use when
+	// reading input that contains no message boundaries at all.
+	maxMessageSize = 256 * 1024 * 1024
+
+	// maxEmptyReads is the number of consecutive empty reads tolerated from the
+	// underlying reader before giving up with io.ErrNoProgress.
+	maxEmptyReads = 100
+)
+
+// ErrMessageTooLarge is returned when a single message is larger than the
+// largest buffer the reader is willing to allocate.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// bufferPool holds the read buffers used by scanners, so that creating a lot of
+// short-lived readers (one per file, for example) does not mean allocating a
+// new buffer every time.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, defaultBufferSize)
+		return &buf
+	},
+}
+
+// scanner reads tokens from an io.Reader using a bufio.SplitFunc. It is
+// similar to bufio.Scanner, but it reports the stream offset of each token, it
+// draws its buffer from bufferPool, and errors from the underlying reader
+// (other than io.EOF) are not sticky. The last point matters when the reader
+// is a network connection with a deadline, since the read can simply be
+// retried later without losing any buffered data.
+type scanner struct {
+	reader io.Reader
+	split  bufio.SplitFunc
+	pooled *[]byte
+	buf    []byte
+	start  int   // The first unconsumed byte in buf.
+	end    int   // The end of the valid data in buf.
+	offset int64 // The stream offset of buf[start].
+	eof    bool
+}
+
+func newScanner(reader io.Reader, split bufio.SplitFunc) *scanner {
+	return &scanner{reader: reader, split: split}
+}
+
+// scan returns the next token along with the stream offset at which it
+// begins. The token points into the internal buffer, so it is only valid until
+// the next call to scan.
+func (s *scanner) scan() ([]byte, int64, error) {
+	for {
+		if s.buf == nil {
+			if s.eof {
+				return nil, s.offset, io.EOF
+			}
+			s.acquire()
+		}
+		if s.end > s.start || s.eof {
+			data := s.buf[s.start:s.end]
+			advance, token, err := s.split(data, s.eof)
+
+			if err != nil {
+				// Unlike bufio.Scanner, errors from the split function are not fatal,
+				// and the bytes it advanced past are consumed. This lets the split
+				// function report a bad token and then carry on after it.
+				s.consume(advance)
+				return nil, s.offset, err
+			}
+			if token != nil {
+				// Split functions return a sub-slice of data, so the distance between
+				// the capacities is where the token begins.
+				offset := s.offset + int64(cap(data)-cap(token))
+				s.consume(advance)
+				return token, offset, nil
+			}
+			s.consume(advance)
+
+			if s.eof {
+				if s.start == s.end || advance == 0 {
+					s.release()
+					return nil, s.offset, io.EOF
+				}
+				continue
+			}
+		}
+		if err := s.fill(); err != nil {
+			return nil, s.offset, err
+		}
+	}
+}
+
+// consume marks n bytes at the front of the buffer as read.
+func (s *scanner) consume(n int) {
+	s.start += n
+	s.offset += int64(n)
+}
+
+// fill reads more data into the buffer, compacting or growing it first if
+// there is no room left.
+func (s *scanner) fill() error {
+	if s.start > 0 {
+		copy(s.buf, s.buf[s.start:s.end])
+		s.end -= s.start
+		s.start = 0
+	}
+	if s.end == len(s.buf) {
+		if len(s.buf) >= maxMessageSize {
+			return ErrMessageTooLarge
+		}
+		size := len(s.buf) * 2
+
+		if size > maxMessageSize {
+			size = maxMessageSize
+		}
+		buf := make([]byte, size)
+		end := copy(buf, s.buf[:s.end])
+		s.release()
+		s.buf, s.end = buf, end
+	}
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := s.reader.Read(s.buf[s.end:])
+		s.end += n
+
+		if err == io.EOF {
+			s.eof = true
+			return nil
+		}
+		if n > 0 || err != nil {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
+
+// acquire takes a buffer from the pool.
+func (s *scanner) acquire() {
+	s.pooled = bufferPool.Get().(*[]byte)
+	s.buf = *s.pooled
+	s.start, s.end = 0, 0
+}
+
+// release returns the pooled buffer (if we still hold it) to the pool. The
+// data in the buffer must no longer be needed.
+func (s *scanner) release() {
+	if s.pooled != nil {
+		bufferPool.Put(s.pooled)
+		s.pooled = nil
+	}
+	s.buf = nil
+	s.start, s.end = 0, 0
+}
+
+// messageSplitter splits its input into HL7 messages. It keeps track of how
+// far it got through an incomplete message, so that each part of a large
+// message is only searched once as it arrives.
+type messageSplitter struct {
+	// searched is the position within the incomplete message (which is left at
+	// the front of the data) from which the search for its end carries on.
+	searched int
+}
+
+// split is a bufio.SplitFunc that splits its input into HL7 messages.
+//
+// Everything up to the first "M" is treated as junk and discarded, which helps
+// us cope with files that have leading whitespace (or other noise between
+// messages) for whatever reason. Multiple messages within a file can be
+// delimited a variety of ways, so a message ends at any whitespace character
+// that is followed by either "MSH|" or "\nMSH", or at the end of the input.
+// Trailing whitespace is not included in the returned message.
+func (m *messageSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	start := bytes.IndexByte(data, 'M')
+
+	if start < 0 {
+		m.searched = 0
+		return len(data), nil, nil
+	}
+	i := start + 1
+
+	if start == 0 && m.searched > i && m.searched <= len(data) {
+		i = m.searched
+	}
+	m.searched = 0
+
+	for i < len(data) {
+		j := bytes.Index(data[i:], []byte("MSH"))
+
+		if j < 0 {
+			break
+		}
+		j += i
+
+		if j-2 > start && data[j-1] == LF && isSpace(data[j-2]) {
+			return j, trimRightSpace(data[start : j-2]), nil
+		}
+		if j+3 >= len(data) {
+			if !atEOF {
+				m.searched = j - start
+				return start, nil, nil
+			}
+			break
+		}
+		if data[j+3] == '|' && j-1 > start && isSpace(data[j-1]) {
+			return j, trimRightSpace(data[start : j-1]), nil
+		}
+		i = j + 1
+	}
+	if !atEOF {
+		// The last two bytes could be the start of an "MSH" that has not all
+		// arrived.
+		m.searched = len(data) - 2 - start
+		return start, nil, nil
+	}
+	return len(data), trimRightSpace(data[start:]), nil
+}
+
+func isSpace(b byte) bool {
+	return unicode.IsSpace(rune(b))
+}
+
+func trimRightSpace(data []byte) []byte {
+	end := len(data)
+
+	for end > 0 && isSpace(data[end-1]) {
+		end--
+	}
+	return data[:end]
+}
@@ -0,0 +1,125 @@
+package hl7
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageSplitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		atEOF   bool
+		advance int
+		token   string
+	}{
+		{"empty", "", true, 0, ""},
+		{"only junk", "\r\n  \x00", true, 5, ""},
+		{"only junk (not at EOF)", "\r\n  \x00", false, 5, ""},
+		{"leading junk", "\r\nMSH|....", true, 10, "MSH|...."},
+		{"leading junk (not at EOF)", "\r\nMSH|....", false, 2, ""},
+		{"trailing whitespace", "MSH|....\r\n", true, 10, "MSH|...."},
+		{"CR delimited", "MSH|....\rMSH|....", false, 9, "MSH|...."},
+		{"CRLF delimited", "MSH|....\r\nMSH|....", false, 10, "MSH|...."},
+		{"CR CR LF delimited", "MSH|....\r\r\nMSH|....", false, 11, "MSH|...."},
+		{"FF delimited", "MSH|....\fMSH|....", false, 9, "MSH|...."},
+		{"boundary needs more data", "MSH|....\rMSH", false, 0, ""},
+		{"boundary at EOF", "MSH|....\rMSH", true, 12, "MSH|....\rMSH"},
+		{"MSH without a field separator", "MSH|....\rMSH^...", true, 16, "MSH|....\rMSH^..."},
+		{"MSH without a preceding space", "MSH|....|MSH|...", true, 16, "MSH|....|MSH|..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			advance, token, err := new(messageSplitter).split([]byte(tt.data), tt.atEOF)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.advance, advance)
+			assert.Equal(t, tt.token, string(token))
+		})
+	}
+
+	t.Run("carries on where it left off", func(t *testing.T) {
+		var m messageSplitter
+
+		// The boundary arrives in pieces, each of which leaves the message
+		// incomplete.
+		data := "MSH|....\rMS"
+
+		for _, more := range []string{"", "H", "|"} {
+			data += more
+			advance, token, err := m.split([]byte(data), false)
+
+			if more == "|" {
+				assert.Nil(t, err)
+				assert.Equal(t, 9, advance)
+				assert.Equal(t, "MSH|....", string(token))
+			} else {
+				assert.Equal(t, 0, advance)
+				assert.Nil(t, token)
+			}
+		}
+	})
+}
+
+func TestScannerScan(t *testing.T) {
+	large := "MSH|^~\\&|" + strings.Repeat("x", 3*defaultBufferSize)
+
+	tests := []struct {
+		name    string
+		reader  io.Reader
+		tokens  []string
+		offsets []int64
+	}{
+		{"empty", strings.NewReader(""), nil, nil},
+		{"one message", strings.NewReader("MSH|...."), []string{"MSH|...."}, []int64{0}},
+		{
+			"leading junk",
+			strings.NewReader("\r\n\r\nMSH|....\rMSH|....."),
+			[]string{"MSH|....", "MSH|....."},
+			[]int64{4, 13},
+		},
+		{
+			"one byte at a time",
+			iotest.OneByteReader(strings.NewReader("MSH|....\r\nMSH|.....\r\n")),
+			[]string{"MSH|....", "MSH|....."},
+			[]int64{0, 10},
+		},
+		{
+			"larger than the buffer",
+			strings.NewReader(large + "\r" + large),
+			[]string{large, large},
+			[]int64{0, int64(len(large) + 1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScanner(tt.reader, new(messageSplitter).split)
+
+			for i := range tt.tokens {
+				token, offset, err := s.scan()
+
+				assert.Nil(t, err)
+				assert.Equal(t, tt.tokens[i], string(token))
+				assert.Equal(t, tt.offsets[i], offset)
+			}
+			_, _, err := s.scan()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+
+	t.Run("read errors are not sticky", func(t *testing.T) {
+		s := newScanner(iotest.TimeoutReader(bytes.NewBufferString("MSH|....")), new(messageSplitter).split)
+
+		_, _, err := s.scan()
+		assert.Equal(t, iotest.ErrTimeout, err)
+
+		token, _, err := s.scan()
+		assert.Nil(t, err)
+		assert.Equal(t, "MSH|....", string(token))
+	})
+}
@@ -0,0 +1,202 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SequenceTracker implements the HL7 sequence number protocol, in which each
+// message a sender sends carries the next number in a sequence in MSH-13, so
+// the receiver can tell when messages have been lost or sent twice. A
+// sequence number of -1 or 0 asks the receiver for the number it expects
+// next, which it returns in MSA-4.
+//
+// A SequenceTracker holds the next expected sequence number for each peer.
+// On the receiving side, Middleware checks incoming messages against it, and
+// peers are identified by their sending application and facility (MSH-3 and
+// MSH-4). On the sending side, it is used by a Client (see Client.Sequence) to
+// number outgoing messages, and peers are identified by the client's address.
+type SequenceTracker struct {
+	path string
+
+	lock     sync.Mutex
+	expected map[string]int64
+}
+
+// NewSequenceTracker returns a SequenceTracker that keeps the sequence numbers
+// in memory.
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{expected: map[string]int64{}}
+}
+
+// OpenSequenceTracker returns a SequenceTracker that persists the sequence
+// numbers to a file, so they survive a restart. The file is created if it does
+// not exist, and is rewritten (and synced to disk) each time a number changes.
+func OpenSequenceTracker(path string) (*SequenceTracker, error) {
+	t := NewSequenceTracker()
+	t.path = path
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndexByte(line, ' ')
+
+		if i < 0 {
+			return nil, fmt.Errorf("hl7: invalid sequence file line %q", line)
+		}
+		peer, err := strconv.Unquote(line[:i])
+
+		if err != nil {
+			return nil, fmt.Errorf("hl7: invalid sequence file line %q", line)
+		}
+		n, err := strconv.ParseInt(line[i+1:], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("hl7: invalid sequence file line %q", line)
+		}
+		t.expected[peer] = n
+	}
+	return t, scanner.Err()
+}
+
+// Expected returns the sequence number expected next from (or to be sent
+// next to) the peer, or zero if the peer is unknown.
+func (t *SequenceTracker) Expected(peer string) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.expected[peer]
+}
+
+// SetExpected sets the sequence number expected next from (or to be sent next
+// to) the peer.
+func (t *SequenceTracker) SetExpected(peer string, n int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.expected[peer] == n {
+		return nil
+	}
+	t.expected[peer] = n
+
+	if t.path == "" {
+		return nil
+	}
+	peers := make([]string, 0, len(t.expected))
+
+	for p := range t.expected {
+		peers = append(peers, p)
+	}
+	sort.Strings(peers)
+
+	var buf bytes.Buffer
+
+	for _, p := range peers {
+		fmt.Fprintf(&buf, "%q %d\n", p, t.expected[p])
+	}
+	tmp := t.path + ".tmp"
+
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(t.path))
+}
+
+// Middleware returns middleware that applies the sequence number protocol to
+// incoming messages that have a sequence number (MSH-13):
+//
+//   - A sequence number of -1 or 0 is answered with AA and the expected
+//     sequence number in MSA-4, without calling the handler.
+//   - The expected sequence number (or any number, for a peer that has not
+//     been seen before) is passed on to the handler. Unless the handler fails
+//     or responds with AE or AR, the expected sequence number is then advanced.
+//   - A number lower than expected is a duplicate, so it is acknowledged with
+//     AA and the expected sequence number, without calling the handler.
+//   - A number higher than expected means messages have been lost, so it is
+//     rejected with AE and the expected sequence number, so that the sender
+//     can resend from there.
+//
+// Messages without a sequence number are passed on to the handler as they
+// are.
+func (t *SequenceTracker) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+			n, ok := sequenceNumber(msg)
+
+			if !ok {
+				return next.ServeHL7(ctx, msg)
+			}
+			peer := sequencePeer(msg)
+			expected := t.Expected(peer)
+
+			switch {
+			case n <= 0:
+				if expected == 0 {
+					expected = 1
+				}
+				return msg.Ack(AckAccept, &AckOptions{ExpectedSequence: expected})
+			case expected != 0 && n < expected:
+				return msg.Ack(AckAccept, &AckOptions{
+					Text:             "Duplicate sequence number " + strconv.FormatInt(n, 10),
+					ExpectedSequence: expected,
+				})
+			case expected != 0 && n > expected:
+				return msg.Ack(AckError, &AckOptions{
+					Text:             fmt.Sprintf("Sequence number %d out of order, expected %d", n, expected),
+					ExpectedSequence: expected,
+				})
+			}
+			resp, err := next.ServeHL7(ctx, msg)
+
+			if err != nil {
+				return resp, err
+			}
+			if resp != nil {
+				if code := responseCode(resp); code == AckError || code == AckReject {
+					return resp, nil
+				}
+			}
+			return resp, t.SetExpected(peer, n+1)
+		})
+	}
+}
+
+// sequenceNumber returns the sequence number of the message (MSH-13), if it
+// has a valid one.
+func sequenceNumber(msg *Message) (int64, bool) {
+	field := firstComponent(indexField(headerFields(msg.data), 13), msg.compSep)
+
+	if field == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(field, 10, 64)
+	return n, err == nil
+}
+
+// sequencePeer identifies the sender of a message, for the purposes of the
+// sequence number protocol.
+func sequencePeer(msg *Message) string {
+	h := headerFields(msg.data)
+	return fmt.Sprintf("%s\t%s", indexField(h, 3), indexField(h, 4))
+}
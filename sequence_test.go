@@ -0,0 +1,156 @@
+package hl7
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceTrackerMiddleware(t *testing.T) {
+	var handled []string
+
+	h := NewSequenceTracker().Middleware()(HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		handled = append(handled, string(indexField(headerFields(msg.Bytes()), 10)))
+		return ackHandler(ctx, msg)
+	}))
+
+	tests := []struct {
+		name     string
+		msg      *Message
+		code     string
+		expected int64
+		handled  bool
+	}{
+		{"query before any messages", testMessage(msh{app: "A", controlID: "q1", seq: "-1"}), AckAccept, 1, false},
+		{"first message", testMessage(msh{app: "A", controlID: "1", seq: "1"}), AckAccept, 0, true},
+		{"duplicate", testMessage(msh{app: "A", controlID: "1", seq: "1"}), AckAccept, 2, false},
+		{"gap", testMessage(msh{app: "A", controlID: "3", seq: "3"}), AckError, 2, false},
+		{"handler error", testMessage(msh{app: "A", controlID: "fail", seq: "2"}), AckError, 0, true},
+		{"retried", testMessage(msh{app: "A", controlID: "2", seq: "2"}), AckAccept, 0, true},
+		{"query", testMessage(msh{app: "A", controlID: "q2", seq: "0"}), AckAccept, 3, false},
+		{"no sequence number", testMessage(msh{app: "A", controlID: "4"}), AckAccept, 0, true},
+		{"new peer", testMessage(msh{app: "B", controlID: "5", seq: "100"}), AckAccept, 0, true},
+		{"new peer query", testMessage(msh{app: "B", controlID: "q3", seq: "-1"}), AckAccept, 101, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			resp, err := h.ServeHL7(context.Background(), tt.msg)
+			assert.Nil(t, err)
+
+			ack, err := ParseAck(resp)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, ack.Code)
+			assert.Equal(t, tt.expected, ack.ExpectedSequence)
+			assert.Equal(t, tt.handled, len(handled) == 1)
+		})
+	}
+}
+
+func TestOpenSequenceTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sequence")
+	tr, err := OpenSequenceTracker(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, tr.SetExpected("APP\tFAC", 42))
+	assert.Nil(t, tr.SetExpected("host:2575", 7))
+
+	tr, err = OpenSequenceTracker(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), tr.Expected("APP\tFAC"))
+	assert.Equal(t, int64(7), tr.Expected("host:2575"))
+	assert.Equal(t, int64(0), tr.Expected("other"))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("garbage\n"), 0644))
+	_, err = OpenSequenceTracker(path)
+	assert.NotNil(t, err)
+}
+
+func TestClientSequence(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		received []string
+	)
+	receiver := NewSequenceTracker()
+	s := &Server{Handler: Chain(HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		lock.Lock()
+		received = append(received, string(indexField(headerFields(msg.Bytes()), 13)))
+		lock.Unlock()
+
+		return ackHandler(ctx, msg)
+	}), receiver.Middleware())}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	send := func(client *Client, id string) {
+		_, err := client.Send(ctx, testMessage(msh{controlID: id}))
+		assert.Nil(t, err)
+	}
+
+	// The client asks for the expected sequence number, then counts up from
+	// there.
+	client := &Client{Addr: addr, Sequence: NewSequenceTracker()}
+	defer client.Close()
+
+	send(client, "1")
+	send(client, "2")
+	send(client, "3")
+	assert.Equal(t, int64(4), client.Sequence.Expected(addr))
+
+	// A client that has lost track asks again.
+	client = &Client{Addr: addr, Sequence: NewSequenceTracker()}
+	defer client.Close()
+
+	send(client, "4")
+
+	// A client that is ahead of the receiver is told where to resend from.
+	client = &Client{Addr: addr, Sequence: NewSequenceTracker(), MaxRetries: 1, RetryBackoff: time.Millisecond}
+	client.Sequence.SetExpected(addr, 10)
+	defer client.Close()
+
+	send(client, "5")
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, received)
+}
+
+func TestClientSequenceWithDuplicates(t *testing.T) {
+	var handled int32
+
+	// The sequence number query must not be recorded as the message itself, or
+	// the message would be acknowledged from the cache without being handled.
+	s := &Server{Handler: Chain(HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		atomic.AddInt32(&handled, 1)
+		return ackHandler(ctx, msg)
+	}), NewDuplicateDetector(10).Middleware(), NewSequenceTracker().Middleware())}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &Client{Addr: addr, Sequence: NewSequenceTracker()}
+	defer client.Close()
+
+	ack, err := client.Send(ctx, testMessage(msh{controlID: "1"}))
+	assert.Nil(t, err)
+	assert.Equal(t, AckAccept, ack.Code)
+	assert.Equal(t, "1", ack.ControlID)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+}
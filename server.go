@@ -0,0 +1,611 @@
+package hl7
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by the Server's Serve and ListenAndServe methods
+// after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("hl7: server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// have become idle.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Server is used to receive MLLP framed messages over TCP, pass them to a
+// Handler and send back the responses. This is modeled on http.Server, and
+// the zero value (with a Handler) is ready to use.
+//
+// Messages using the enhanced acknowledgment mode are supported: the server
+// sends the accept acknowledgment itself, and the handler's response is
+// treated as the application acknowledgment.
+type Server struct {
+	Addr    string  // The TCP address to listen on, ":2575" if empty.
+	Handler Handler // The handler to invoke for each message.
+
+	// ReadTimeout is the maximum duration for reading a message, measured
+	// from when the first bytes of it arrive (or from when the server starts
+	// waiting for it, if there is no IdleTimeout). Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the maximum duration for writing a response. Zero means
+	// no timeout.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is the maximum duration to wait for the next message on a
+	// connection before closing it. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout is the maximum duration for a client to complete the
+	// TLS handshake, when TLSConfig is set. Zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// MaxConns is the maximum number of connections that are served at once.
+	// Further connections are not accepted until one is closed. Zero means no
+	// limit.
+	MaxConns int
+
+	// MaxFrameSize is the largest MLLP frame that will be accepted. Zero means
+	// DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// TLSConfig, if set, is used to serve MLLP over TLS. To require client
+	// certificates, set ClientAuth to tls.RequireAndVerifyClientCert along
+	// with ClientCAs; handlers can then use PeerSubject to see who sent each
+	// message.
+	TLSConfig *tls.Config
+
+	// Store, if set, is used to persist each message before the handler is
+	// called or any acknowledgment is sent. If storing fails, the message is
+	// not handled and the sender gets a negative acknowledgment (CE in
+	// enhanced mode, otherwise AE). Messages are marked as done once the
+	// handler returns without error; any others can be handled again later
+	// using Replay.
+	Store MessageStore
+
+	// ApplicationAcks is used to send application acknowledgments for messages
+	// that use the enhanced acknowledgment mode (see AckAlways), typically a
+	// *Client connected to the sender's own listener. They are sent in the
+	// background, so the connection the message arrived on can carry on with
+	// the next one. If nil, they are sent back on the same connection, after
+	// the accept acknowledgment.
+	ApplicationAcks AckSender
+
+	// ErrorLog is used to log errors, such as handler errors and malformed
+	// frames. If nil, the log package's standard logger is used.
+	ErrorLog *log.Logger
+
+	lock       sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	connsDone  sync.WaitGroup
+	acksDone   sync.WaitGroup
+	inShutdown int32
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// ListenAndServe listens on the TCP address and then calls Serve with the
+// handler to handle incoming messages.
+func ListenAndServe(addr string, handler Handler) error {
+	s := Server{Addr: addr, Handler: handler}
+	return s.ListenAndServe()
+}
+
+// ListenAndServe listens on the TCP address s.Addr and then calls Serve to
+// handle incoming messages. ErrServerClosed is returned after Shutdown or
+// Close.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	addr := s.Addr
+
+	if addr == "" {
+		addr = ":2575"
+	}
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener, creating a new goroutine for
+// each one. If s.TLSConfig is set, the connections are wrapped with TLS. Serve
+// always returns a non-nil error, which is ErrServerClosed after Shutdown or
+// Close. The listener is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	if s.Handler == nil {
+		l.Close()
+		return errors.New("hl7: nil handler")
+	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	var sem chan struct{}
+
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
+	var delay time.Duration
+
+	for {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		rw, err := l.Accept()
+
+		if err != nil {
+			if sem != nil {
+				<-sem
+			}
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			// Back off on temporary errors (such as running out of file
+			// descriptors), the same way net/http does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("hl7: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		c := s.newConn(rw)
+
+		if c == nil {
+			rw.Close()
+			if sem != nil {
+				<-sem
+			}
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.connsDone.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			c.serve()
+		}()
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners, then
+// closes connections as soon as they are idle (that is, not in the middle of
+// handling a message), and waits for them all to be closed, and for any
+// application acknowledgments to be sent (see ApplicationAcks). If the context
+// expires first, its error is returned and the remaining connections are left
+// to finish on their own (see Close).
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			s.connsDone.Wait()
+			return s.waitAcks(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitAcks waits for the application acknowledgments that are being sent in
+// the background, or for the context to expire.
+func (s *Server) waitAcks(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		s.acksDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// Close immediately closes all listeners and connections, and cancels the
+// contexts of any handlers (and application acknowledgments being sent) that
+// are still running.
+func (s *Server) Close() error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	err := s.closeListeners()
+
+	s.lock.Lock()
+	for c := range s.conns {
+		c.rwc.Close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.lock.Unlock()
+
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	logPrintf(s.ErrorLog, format, args...)
+}
+
+// trackListener adds or removes the listener from the set that is closed on
+// shutdown. False is returned if the server is already shutting down.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) closeListeners() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes all idle connections, and reports whether there are
+// no connections left at all.
+func (s *Server) closeIdleConns() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	quiescent := true
+
+	for c := range s.conns {
+		if !c.closeIfIdle() {
+			quiescent = false
+		}
+	}
+	return quiescent
+}
+
+// newConn registers a new connection with the server. Nil is returned if the
+// server is shutting down.
+func (s *Server) newConn(rwc net.Conn) *serverConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.shuttingDown() {
+		return nil
+	}
+	if s.conns == nil {
+		s.conns = map[*serverConn]struct{}{}
+	}
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	c := serverConn{server: s, rwc: rwc, idle: true}
+	c.ctx, c.cancel = context.WithCancel(s.ctx)
+	s.conns[&c] = struct{}{}
+	s.connsDone.Add(1)
+
+	return &c
+}
+
+func (s *Server) removeConn(c *serverConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.conns, c)
+}
+
+// serverConn is a single connection being served by a Server.
+type serverConn struct {
+	server *Server
+	rwc    net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock   sync.Mutex
+	idle   bool
+	closed bool
+}
+
+// setIdle marks the connection as idle or busy. False is returned if the
+// connection has already been closed.
+func (c *serverConn) setIdle(idle bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.idle = idle
+	return !c.closed
+}
+
+// closeIfIdle closes the connection if it is idle, and reports whether the
+// connection is closed.
+func (c *serverConn) closeIfIdle() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.idle && !c.closed {
+		c.closed = true
+		c.rwc.Close()
+	}
+	return c.closed
+}
+
+func (c *serverConn) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.rwc.Close()
+	}
+}
+
+func (c *serverConn) serve() {
+	s := c.server
+
+	defer func() {
+		if err := recover(); err != nil {
+			s.logf("hl7: panic serving %v: %v", c.rwc.RemoteAddr(), err)
+		}
+		c.cancel()
+		c.close()
+		s.removeConn(c)
+	}()
+
+	if err := c.handshake(); err != nil {
+		s.logf("hl7: TLS handshake error from %v: %v", c.rwc.RemoteAddr(), err)
+		return
+	}
+
+	var (
+		tr = &timeoutReader{conn: c.rwc, idle: s.IdleTimeout, read: s.ReadTimeout}
+		r  = NewMLLPReader(tr)
+		w  = NewMLLPWriter(c.rwc)
+	)
+	r.MaxFrameSize = s.MaxFrameSize
+
+	for {
+		msg, err := r.ReadMessage()
+
+		if err != nil {
+			switch {
+			case err == ErrTruncatedFrame, err == ErrFrameTooLarge, err == ErrInvalidHeader:
+				s.logf("hl7: bad frame from %v: %v", c.rwc.RemoteAddr(), err)
+				tr.reset()
+				continue
+			case err != io.EOF && !s.shuttingDown() && !isExpectedReadError(err):
+				s.logf("hl7: read error from %v: %v", c.rwc.RemoteAddr(), err)
+			}
+			return
+		}
+		if !c.setIdle(false) {
+			return
+		}
+		if err = c.handle(msg, w); err != nil {
+			s.logf("hl7: write error to %v: %v", c.rwc.RemoteAddr(), err)
+			return
+		}
+		if !c.setIdle(true) || s.shuttingDown() {
+			return
+		}
+		tr.reset()
+	}
+}
+
+// handle passes the message to the handler and sends back the response. In
+// enhanced acknowledgment mode, an accept acknowledgment is sent before the
+// handler is called (if MSH-15 calls for one), and the response is treated as
+// the application acknowledgment, which is only sent if MSH-16 calls for it.
+// Errors are only returned if writing to the connection fails.
+func (c *serverConn) handle(msg *Message, w *MLLPWriter) error {
+	var (
+		s        = c.server
+		enhanced = msg.EnhancedMode()
+		storeID  string
+		storeErr error
+	)
+	if s.Store != nil {
+		if storeID, storeErr = s.Store.Put(msg); storeErr != nil {
+			s.logf("hl7: error storing message from %v: %v", c.rwc.RemoteAddr(), storeErr)
+		}
+	}
+	if storeErr != nil && !enhanced {
+		return c.nak(w, msg, AckError)
+	}
+	if enhanced {
+		code := AckCommitAccept
+
+		if err := checkMessage(msg.Bytes()); err != nil {
+			s.logf("hl7: rejecting message from %v: %v", c.rwc.RemoteAddr(), err)
+			code = AckCommitReject
+		} else if storeErr != nil {
+			code = AckCommitError
+		}
+		if shouldAck(msg.AcceptAckType(), code == AckCommitAccept) {
+			ack, err := msg.Ack(code, nil)
+
+			if err != nil {
+				s.logf("hl7: error generating accept acknowledgment: %v", err)
+			} else if err = c.write(w, ack); err != nil {
+				return err
+			}
+		}
+		if code != AckCommitAccept {
+			return nil
+		}
+	}
+	resp, err := s.Handler.ServeHL7(c.ctx, msg)
+
+	if err != nil {
+		s.logf("hl7: handler error for message from %v: %v", c.rwc.RemoteAddr(), err)
+
+		if resp == nil {
+			if resp, err = internalErrorAck(msg, AckError); err != nil {
+				s.logf("hl7: error generating acknowledgment: %v", err)
+			}
+		}
+	} else if storeID != "" {
+		if err := s.Store.Done(storeID); err != nil {
+			s.logf("hl7: error marking stored message %s as done: %v", storeID, err)
+		}
+	}
+	if resp == nil {
+		return nil
+	}
+	if !enhanced {
+		return c.write(w, resp)
+	}
+	success := true
+
+	if ack, err := ParseAck(resp); err == nil {
+		success = ack.Code == AckAccept
+	}
+	if !shouldAck(msg.ApplicationAckType(), success) {
+		return nil
+	}
+	if s.ApplicationAcks == nil {
+		return c.write(w, resp)
+	}
+	if resp, err = deferredAck(resp); err != nil {
+		s.logf("hl7: error generating application acknowledgment: %v", err)
+		return nil
+	}
+	// Sending may take a while if the sender's listener is slow or down, which
+	// shouldn't hold up the next message on this connection.
+	s.acksDone.Add(1)
+
+	go func() {
+		defer s.acksDone.Done()
+
+		if _, err := s.ApplicationAcks.Send(s.ctx, resp); err != nil {
+			s.logf("hl7: error sending application acknowledgment: %v", err)
+		}
+	}()
+	return nil
+}
+
+// nak responds with a negative acknowledgment after the server itself could
+// not accept the message, which has not been passed to the handler.
+func (c *serverConn) nak(w *MLLPWriter, msg *Message, code string) error {
+	ack, err := internalErrorAck(msg, code)
+
+	if err != nil {
+		c.server.logf("hl7: error generating acknowledgment: %v", err)
+		return nil
+	}
+	return c.write(w, ack)
+}
+
+// internalErrorAck returns an acknowledgment of the message with the code,
+// and an ERR segment giving code 207, application internal error.
+func internalErrorAck(msg *Message, code string) (*Message, error) {
+	return msg.Ack(code, &AckOptions{Errors: []AckIssue{{
+		Code: errCodeInternal,
+		Text: "Application internal error",
+	}}})
+}
+
+func (c *serverConn) write(w *MLLPWriter, msg *Message) error {
+	if c.server.WriteTimeout > 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+	return w.WriteMessage(msg)
+}
+
+// isExpectedReadError reports whether the error is the result of a timeout or
+// the connection being closed, which are not worth logging.
+func isExpectedReadError(err error) bool {
+	var ne net.Error
+
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	// net.ErrClosed only exists from Go 1.16, and this is the error it wraps.
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// timeoutReader sets read deadlines on a connection before each read. While
+// waiting for a message to begin, the idle timeout applies; once some bytes
+// have arrived, the read timeout applies to the rest of the message.
+type timeoutReader struct {
+	conn    net.Conn
+	idle    time.Duration
+	read    time.Duration
+	started time.Time
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	var deadline time.Time
+
+	switch {
+	case r.started.IsZero() && r.idle > 0:
+		deadline = time.Now().Add(r.idle)
+	case r.started.IsZero() && r.read > 0:
+		deadline = time.Now().Add(r.read)
+	case !r.started.IsZero() && r.read > 0:
+		deadline = r.started.Add(r.read)
+	}
+	r.conn.SetReadDeadline(deadline)
+
+	n, err := r.conn.Read(p)
+
+	if n > 0 && r.started.IsZero() {
+		r.started = time.Now()
+	}
+	return n, err
+}
+
+// reset is called once a message has been read, so the idle timeout applies
+// to the next one.
+func (r *timeoutReader) reset() {
+	r.started = time.Time{}
+}
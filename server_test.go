@@ -0,0 +1,263 @@
+package hl7
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoHandler responds with the message it received.
+var echoHandler = HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+	return msg, nil
+})
+
+// startServer starts the server on a loopback address, and returns the
+// address along with a channel that receives the result of Serve.
+func startServer(t *testing.T, s *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ErrorLog == nil {
+		s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	}
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.Serve(l)
+	}()
+	return l.Addr().String(), done
+}
+
+// roundTrip sends the data as an MLLP frame on the connection and returns the
+// frame that is sent back.
+func roundTrip(t *testing.T, conn net.Conn, data string) (string, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := NewMLLPWriter(conn).WriteFrame([]byte(data)); err != nil {
+		return "", err
+	}
+	frame, err := NewMLLPReader(conn).ReadFrame()
+	return string(frame), err
+}
+
+func TestServer(t *testing.T) {
+	s := &Server{Handler: echoHandler}
+	addr, done := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	for _, data := range []string{"MSH|^~\\&|1\r", "MSH|^~\\&|2\r"} {
+		got, err := roundTrip(t, conn, data)
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+	}
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, ErrServerClosed, <-done)
+
+	// The connection was idle, so it should have been closed.
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerBadFrames(t *testing.T) {
+	var logs bytes.Buffer
+
+	s := &Server{Handler: echoHandler, MaxFrameSize: 20, ErrorLog: log.New(&logs, "", 0)}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Neither of these should get a response, but the connection should stay
+	// usable.
+	conn.Write([]byte("\x0bMSH\x1c\r"))
+	conn.Write([]byte("\x0bMSH|^~\\&|a very long message\x1c\r"))
+
+	got, err := roundTrip(t, conn, "MSH|^~\\&|1\r")
+	assert.Nil(t, err)
+	assert.Equal(t, "MSH|^~\\&|1\r", got)
+	assert.Contains(t, logs.String(), ErrInvalidHeader.Error())
+	assert.Contains(t, logs.String(), ErrFrameTooLarge.Error())
+}
+
+func TestServerNoResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"nothing to send", nil, ""},
+		{"handler error", errors.New("nope"), AckError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			s := &Server{
+				Handler: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+					return nil, tt.err
+				}),
+				ErrorLog: log.New(&logs, "", 0),
+			}
+			addr, _ := startServer(t, s)
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", addr)
+			assert.Nil(t, err)
+			defer conn.Close()
+
+			assert.Nil(t, NewMLLPWriter(conn).WriteMessage(testMessage(msh{controlID: "1"})))
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			resp, err := NewMLLPReader(conn).ReadMessage()
+
+			if tt.code == "" {
+				var ne net.Error
+				assert.True(t, errors.As(err, &ne) && ne.Timeout())
+				return
+			}
+			// The sender is told straight away, instead of waiting for its ACK
+			// timeout.
+			if !assert.Nil(t, err) {
+				return
+			}
+			ack, err := ParseAck(resp)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, ack.Code)
+			assert.Equal(t, "1", ack.ControlID)
+
+			if assert.Len(t, ack.Errors, 1) {
+				assert.Equal(t, errCodeInternal, ack.Errors[0].Code)
+			}
+			assert.Contains(t, logs.String(), "nope")
+		})
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := &Server{Handler: echoHandler, IdleTimeout: 20 * time.Millisecond}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerMaxConns(t *testing.T) {
+	s := &Server{Handler: echoHandler, MaxConns: 1}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	first, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	_, err = roundTrip(t, first, "MSH|^~\\&|1\r")
+	assert.Nil(t, err)
+
+	// The second connection is not served until the first one is closed.
+	second, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	NewMLLPWriter(second).WriteFrame([]byte("MSH|^~\\&|2\r"))
+	_, err = NewMLLPReader(second).ReadFrame()
+	assert.Error(t, err)
+
+	first.Close()
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := NewMLLPReader(second).ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, "MSH|^~\\&|2\r", string(got))
+}
+
+func TestIsExpectedReadError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l.Close()
+	_, closedErr := l.Accept()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	server.SetReadDeadline(time.Now())
+	_, timeoutErr := server.Read(make([]byte, 1))
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"closed", closedErr, true},
+		{"timeout", timeoutErr, true},
+		{"other", io.ErrUnexpectedEOF, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isExpectedReadError(tt.err))
+		})
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		once    sync.Once
+	)
+	s := &Server{Handler: HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		once.Do(func() { close(started) })
+		<-release
+		return msg, nil
+	})}
+	addr, done := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	result := make(chan string, 1)
+
+	go func() {
+		got, _ := roundTrip(t, conn, "MSH|^~\\&|1\r")
+		result <- got
+	}()
+	<-started
+
+	// The handler is still busy, so the shutdown can't complete yet.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-done)
+
+	// New connections are refused.
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	close(release)
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, "MSH|^~\\&|1\r", <-result)
+	assert.Equal(t, ErrServerClosed, s.ListenAndServe())
+}
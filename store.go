@@ -0,0 +1,166 @@
+package hl7
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	storeExt        = ".hl7"
+	storePendingDir = "pending"
+	storeDoneDir    = "done"
+)
+
+// MessageStore is used by a Server to persist each message it receives before
+// passing it to the handler or acknowledging it (see Server.Store), so that
+// messages are never acknowledged without being stored, and ones that were
+// not finished being handled can be replayed after a crash (see Replay).
+type MessageStore interface {
+	// Put stores the message durably, and returns an ID for it.
+	Put(msg *Message) (id string, err error)
+
+	// Done marks the message as having been handled.
+	Done(id string) error
+
+	// Pending returns the messages that have been stored but not marked as
+	// done, in the order they were stored.
+	Pending() ([]StoredMessage, error)
+}
+
+// StoredMessage is a message held in a MessageStore.
+type StoredMessage struct {
+	ID      string
+	Message *Message
+}
+
+// FileStore is a MessageStore that keeps each message in its own file. Files
+// are synced to disk before Put returns, and are moved from the "pending"
+// subdirectory to the "done" subdirectory once handled, so the store doubles
+// as an archive of everything received. Pruning old messages from "done" is
+// left to the caller.
+type FileStore struct {
+	dir string
+	seq uint32
+}
+
+// NewFileStore returns a FileStore that keeps messages in the directory,
+// creating it if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	for _, sub := range []string{storePendingDir, storeDoneDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Put writes the message to a new file in the "pending" directory, and syncs
+// it to disk. The file is written under a temporary name first, so a crash
+// part way through never leaves a partial message behind.
+func (s *FileStore) Put(msg *Message) (string, error) {
+	// IDs sort in the order messages were stored, at least within a process.
+	id := fmt.Sprintf("%s-%06d", time.Now().UTC().Format("20060102T150405.000000000"), atomic.AddUint32(&s.seq, 1)%1000000)
+	dir := filepath.Join(s.dir, storePendingDir)
+	path := filepath.Join(dir, id+storeExt)
+
+	if err := writeFileSync(path+".tmp", msg.Bytes()); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	// If the message might not survive a crash, it is better to have the
+	// sender retry than to handle it later (from Replay) after the sender was
+	// told it failed.
+	if err := syncDir(dir); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return id, nil
+}
+
+// Done moves the message to the "done" directory.
+func (s *FileStore) Done(id string) error {
+	return os.Rename(
+		filepath.Join(s.dir, storePendingDir, id+storeExt),
+		filepath.Join(s.dir, storeDoneDir, id+storeExt),
+	)
+}
+
+// Pending returns the messages in the "pending" directory.
+func (s *FileStore) Pending() ([]StoredMessage, error) {
+	dir := filepath.Join(s.dir, storePendingDir)
+	infos, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+	var pending []StoredMessage
+
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), storeExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+
+		if err != nil {
+			return nil, err
+		}
+		msg, err := NewMessage(data)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", info.Name(), err)
+		}
+		pending = append(pending, StoredMessage{ID: strings.TrimSuffix(info.Name(), storeExt), Message: msg})
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+
+	return pending, nil
+}
+
+// Replay passes the messages that are pending in the store to the handler, in
+// order, and marks each one as done once the handler returns without error.
+// This is meant to be called at startup, before the server starts accepting
+// messages, to finish handling any that were interrupted by a crash. Responses
+// from the handler are discarded, since the sender has long since gone.
+//
+// The number of messages handled successfully is returned. Handler errors do
+// not stop the replay; they are returned together as MessageErrors, and the
+// messages are left pending.
+func Replay(ctx context.Context, store MessageStore, h Handler) (int, error) {
+	pending, err := store.Pending()
+
+	if err != nil {
+		return 0, err
+	}
+	var (
+		handled int
+		errs    MessageErrors
+	)
+	for i, stored := range pending {
+		if err := ctx.Err(); err != nil {
+			return handled, err
+		}
+		if _, err := h.ServeHL7(ctx, stored.Message); err != nil {
+			errs = append(errs, &MessageError{Index: i, Err: fmt.Errorf("%s: %w", stored.ID, err)})
+			continue
+		}
+		if err := store.Done(stored.ID); err != nil {
+			return handled, err
+		}
+		handled++
+	}
+	if len(errs) > 0 {
+		return handled, errs
+	}
+	return handled, nil
+}
@@ -0,0 +1,178 @@
+package hl7
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingStore is a MessageStore that cannot store anything.
+type failingStore struct{}
+
+func (failingStore) Put(msg *Message) (string, error)  { return "", errors.New("disk full") }
+func (failingStore) Done(id string) error              { return nil }
+func (failingStore) Pending() ([]StoredMessage, error) { return nil, nil }
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	assert.Nil(t, err)
+
+	var ids []string
+
+	for _, id := range []string{"1", "2", "3"} {
+		storeID, err := s.Put(testMessage(msh{controlID: id}))
+		assert.Nil(t, err)
+		ids = append(ids, storeID)
+	}
+	assert.Nil(t, s.Done(ids[1]))
+
+	pending, err := s.Pending()
+	assert.Nil(t, err)
+
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, ids[0], pending[0].ID)
+		assert.Equal(t, testMessage(msh{controlID: "1"}).Bytes(), pending[0].Message.Bytes())
+		assert.Equal(t, ids[2], pending[1].ID)
+	}
+	done, _ := filepath.Glob(filepath.Join(dir, "done", "*.hl7"))
+	assert.Len(t, done, 1)
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	assert.Nil(t, err)
+
+	for _, id := range []string{"1", "fail", "2"} {
+		_, err := s.Put(testMessage(msh{controlID: id}))
+		assert.Nil(t, err)
+	}
+	var handled []string
+
+	h := HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		id := string(indexField(headerFields(msg.Bytes()), 10))
+		handled = append(handled, id)
+
+		if id == "fail" {
+			return nil, errors.New("oops")
+		}
+		return nil, nil
+	})
+	n, err := Replay(context.Background(), s, h)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"1", "fail", "2"}, handled)
+
+	var errs MessageErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 1)
+
+	// Only the failed message is left to replay.
+	pending, err := s.Pending()
+	assert.Nil(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestServerStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing bool
+		msg     *Message
+		codes   []string
+		calls   int32
+		pending int
+	}{
+		{"stored", false, testMessage(msh{controlID: "1"}), []string{AckAccept}, 1, 0},
+		{"enhanced mode", false, testMessage(msh{controlID: "1", acceptAck: AckAlways, appAck: AckAlways}), []string{AckCommitAccept, AckAccept}, 1, 0},
+		{"handler error", false, testMessage(msh{controlID: "fail"}), []string{AckError}, 1, 1},
+		{"handler error in enhanced mode", false, testMessage(msh{controlID: "fail", acceptAck: AckAlways, appAck: AckAlways}), []string{AckCommitAccept, AckError}, 1, 1},
+		{"store error", true, testMessage(msh{controlID: "1"}), []string{AckError}, 0, 0},
+		{"store error in enhanced mode", true, testMessage(msh{controlID: "1", acceptAck: AckAlways, appAck: AckAlways}), []string{AckCommitError}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "store")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			store, err := NewFileStore(dir)
+			assert.Nil(t, err)
+
+			var calls int32
+
+			h := HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+				id := string(indexField(headerFields(msg.Bytes()), 10))
+
+				if id == "end" {
+					return ackHandler(ctx, msg)
+				}
+				atomic.AddInt32(&calls, 1)
+
+				// The message must already have been stored.
+				pending, err := store.Pending()
+				assert.Nil(t, err)
+				assert.Len(t, pending, 1)
+
+				if id == "fail" {
+					return nil, errors.New("oops")
+				}
+				return ackHandler(ctx, msg)
+			})
+			s := &Server{Handler: h, Store: store}
+
+			if tt.failing {
+				s.Store = failingStore{}
+			}
+			addr, _ := startServer(t, s)
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", addr)
+			assert.Nil(t, err)
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			w, r := NewMLLPWriter(conn), NewMLLPReader(conn)
+
+			// An original mode message is sent afterwards, so we know when all
+			// of the acknowledgments for the first one have arrived.
+			assert.Nil(t, w.WriteMessage(tt.msg))
+			assert.Nil(t, w.WriteMessage(testMessage(msh{controlID: "end"})))
+
+			var codes []string
+
+			for {
+				msg, err := r.ReadMessage()
+
+				if !assert.Nil(t, err) {
+					return
+				}
+				ack, _ := ParseAck(msg)
+
+				if ack.ControlID == "end" {
+					break
+				}
+				codes = append(codes, ack.Code)
+			}
+			assert.Equal(t, tt.codes, codes)
+			assert.Equal(t, tt.calls, atomic.LoadInt32(&calls))
+
+			pending, err := store.Pending()
+			assert.Nil(t, err)
+			assert.Len(t, pending, tt.pending)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package hl7
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"time"
+)
+
+// DefaultHandshakeTimeout is the default limit on how long a Server waits for
+// a client to complete the TLS handshake.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// connStateKey is the context key under which a Server stores the TLS state of
+// the connection a message arrived on.
+type connStateKey struct{}
+
+// TLSConnectionState returns the state of the TLS connection a message
+// arrived on, given the context passed to Handler.ServeHL7. Nil is returned if
+// the connection does not use TLS.
+func TLSConnectionState(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(connStateKey{}).(*tls.ConnectionState)
+	return state
+}
+
+// PeerSubject returns the subject of the certificate the sender presented,
+// given the context passed to Handler.ServeHL7. This can be used to decide
+// whether the sender is allowed to send a message. False is returned if the
+// connection does not use TLS or the sender did not present a certificate
+// (see tls.Config.ClientAuth).
+func PeerSubject(ctx context.Context) (pkix.Name, bool) {
+	state := TLSConnectionState(ctx)
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return pkix.Name{}, false
+	}
+	return state.PeerCertificates[0].Subject, true
+}
+
+// handshake completes the TLS handshake on a server connection (if it uses
+// TLS), and adds the connection state to the context passed to the handler.
+// The handshake is bound by the server's HandshakeTimeout.
+func (c *serverConn) handshake() error {
+	conn, ok := c.rwc.(*tls.Conn)
+
+	if !ok {
+		return nil
+	}
+	timeout := c.server.HandshakeTimeout
+
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	state := conn.ConnectionState()
+	c.ctx = context.WithValue(c.ctx, connStateKey{}, &state)
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package hl7
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA is a certificate authority used to issue certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for the subject, valid for both server and
+// client authentication on the loopback address.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	var (
+		ca      = newTestCA(t)
+		other   = newTestCA(t)
+		subject = make(chan string, 1)
+	)
+	handler := HandlerFunc(func(ctx context.Context, msg *Message) (*Message, error) {
+		name, ok := PeerSubject(ctx)
+
+		if !ok {
+			return msg.Ack(AckReject, &AckOptions{Text: "no client certificate"})
+		}
+		subject <- name.CommonName
+
+		if name.CommonName != "Sender" {
+			return msg.Ack(AckReject, &AckOptions{Text: "not authorized"})
+		}
+		return msg.Ack(AckAccept, nil)
+	})
+	s := &Server{
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "Receiver"})},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.pool,
+		},
+	}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		config  *tls.Config
+		subject string
+		code    string
+		wantErr bool
+	}{
+		{
+			"authorized",
+			&tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "Sender"})}},
+			"Sender",
+			AckAccept,
+			false,
+		},
+		{
+			"not authorized",
+			&tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "Someone"})}},
+			"Someone",
+			AckReject,
+			true,
+		},
+		{
+			"certificate from another CA",
+			&tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{other.issue(t, pkix.Name{CommonName: "Sender"})}},
+			"",
+			"",
+			true,
+		},
+		{
+			"no client certificate",
+			&tls.Config{RootCAs: ca.pool},
+			"",
+			"",
+			true,
+		},
+		{
+			"untrusted server",
+			&tls.Config{RootCAs: other.pool, Certificates: []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "Sender"})}},
+			"",
+			"",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{Addr: addr, TLSConfig: tt.config, AckTimeout: time.Second}
+			defer client.Close()
+
+			ack, err := client.Send(ctx, testMessage(msh{controlID: "1"}))
+			assert.Equal(t, tt.wantErr, err != nil)
+
+			if tt.code != "" {
+				assert.Equal(t, tt.code, ack.Code)
+			}
+			if tt.subject != "" {
+				assert.Equal(t, tt.subject, <-subject)
+			}
+		})
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	s := &Server{
+		Handler:          echoHandler,
+		HandshakeTimeout: 20 * time.Millisecond,
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{ca.issue(t, pkix.Name{CommonName: "Receiver"})}},
+		ErrorLog:         log.New(ioutil.Discard, "", 0),
+	}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	// A client that never starts the handshake is disconnected.
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPeerSubjectWithoutTLS(t *testing.T) {
+	_, ok := PeerSubject(context.Background())
+	assert.False(t, ok)
+	assert.Nil(t, TLSConnectionState(context.Background()))
+}
@@ -0,0 +1,73 @@
+package hl7
+
+import (
+	"context"
+	"io"
+)
+
+// ErrorHandler is used to report errors for individual messages without
+// stopping the processing of the rest of the input.
+type ErrorHandler func(err *MessageError)
+
+// Summary describes the outcome of EachMessageTolerant.
+type Summary struct {
+	Processed int // Messages that were passed to the MessageFunc successfully.
+	Skipped   int // Messages that could not be parsed, so they were skipped.
+	Failed    int // Messages for which the MessageFunc returned an error.
+}
+
+// Total returns the total number of messages that were read.
+func (s Summary) Total() int {
+	return s.Processed + s.Skipped + s.Failed
+}
+
+// EachMessageTolerant is the same as EachMessage, except that errors for
+// individual messages do not stop the processing of the rest of the input.
+// This is useful for things like nightly extracts, where one malformed message
+// shouldn't cost us the rest of the file.
+//
+// Before a message is passed into the MessageFunc, it is checked to make sure
+// it begins with an MSH segment and that every segment has a valid segment ID.
+// Messages that fail this check are skipped, and messages for which the
+// MessageFunc returns an error are counted as failed. Either way, the error is
+// passed to onError (if it is not nil) along with the position of the message
+// in the input, and reading continues.
+//
+// The returned error is only non-nil if reading from the input fails, in
+// which case the summary covers the messages read up to that point.
+func (r *Reader) EachMessageTolerant(fn MessageFunc, onError ErrorHandler) (Summary, error) {
+	var summary Summary
+
+	for i := 0; ; i++ {
+		r.lock.Lock()
+		data, offset, err := r.readRawContext(context.Background())
+		r.lock.Unlock()
+
+		if err == io.EOF {
+			return summary, nil
+		} else if err != nil {
+			return summary, err
+		}
+		msg, err := parseChecked(data, offset)
+
+		if err != nil {
+			summary.Skipped++
+		} else if err = fn(msg); err != nil {
+			summary.Failed++
+		} else {
+			summary.Processed++
+		}
+		if err != nil && onError != nil {
+			onError(&MessageError{Index: i, Offset: offset, Err: err})
+		}
+	}
+}
+
+// parseChecked returns a new Message after making sure the data looks like a
+// well-formed message.
+func parseChecked(data []byte, offset int64) (*Message, error) {
+	if err := checkMessage(data); err != nil {
+		return nil, err
+	}
+	return newMessageAt(data, offset)
+}
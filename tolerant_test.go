@@ -0,0 +1,74 @@
+package hl7
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderEachMessageTolerant(t *testing.T) {
+	errFoo := errors.New("foo")
+
+	tests := []struct {
+		name    string
+		data    string
+		fnErr   error
+		want    Summary
+		indexes []int
+		offsets []int64
+	}{
+		{"empty", "", nil, Summary{}, nil, nil},
+		{"all good", "MSH|^~\\&|1\rPID|1\rMSH|^~\\&|2\rPID|2", nil, Summary{Processed: 2}, nil, nil},
+		{
+			"bad segment",
+			"MSH|^~\\&|1\rPID|1\rMSH|^~\\&|2\rpid|2\rMSH|^~\\&|3",
+			nil,
+			Summary{Processed: 2, Skipped: 1},
+			[]int{1},
+			[]int64{17},
+		},
+		{
+			"too short",
+			"MSH|^~\\&|1\r\nMSH|\r\nMSH|^~\\&|3",
+			nil,
+			Summary{Processed: 2, Skipped: 1},
+			[]int{1},
+			[]int64{12},
+		},
+		{"callback errors", "MSH|^~\\&|1\rMSH|^~\\&|2", errFoo, Summary{Failed: 2}, []int{0, 1}, []int64{0, 11}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				reader  = NewReader(bytes.NewBufferString(tt.data))
+				indexes []int
+				offsets []int64
+			)
+			summary, err := reader.EachMessageTolerant(func(msg *Message) error {
+				return tt.fnErr
+			}, func(err *MessageError) {
+				indexes = append(indexes, err.Index)
+				offsets = append(offsets, err.Offset)
+			})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, summary)
+			assert.Equal(t, tt.want.Skipped+tt.want.Failed, len(indexes))
+			assert.Equal(t, tt.indexes, indexes)
+			assert.Equal(t, tt.offsets, offsets)
+		})
+	}
+
+	t.Run("read error is propagated", func(t *testing.T) {
+		reader := NewReader(iotest.TimeoutReader(bytes.NewBufferString("MSH|....")))
+
+		_, err := reader.EachMessageTolerant(func(msg *Message) error {
+			return nil
+		}, nil)
+
+		assert.Equal(t, iotest.ErrTimeout, err)
+	})
+}